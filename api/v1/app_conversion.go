@@ -0,0 +1,260 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"k8s.io/apimachinery/pkg/api/equality"
+	"sigs.k8s.io/controller-runtime/pkg/conversion"
+
+	aloystechv2 "aloys.tech/api/v2"
+)
+
+// V2SpecAnnotation keeps the v2 spec on v1 objects when v1 cannot express all of it,
+// so reading and writing an App through v1 does not lose v2-only fields.
+const V2SpecAnnotation = "aloys.tech/v2-spec"
+
+var _ conversion.Convertible = &App{}
+
+// ConvertTo converts this App to the Hub version (v2).
+func (src *App) ConvertTo(dstRaw conversion.Hub) error {
+	dst := dstRaw.(*aloystechv2.App)
+	dst.ObjectMeta = *src.ObjectMeta.DeepCopy()
+
+	// 先恢复 v1 表达不了的字段，再用 v1 里的字段覆盖，v1 客户端的修改始终生效
+	if raw, ok := dst.Annotations[V2SpecAnnotation]; ok {
+		if err := json.Unmarshal([]byte(raw), &dst.Spec); err != nil {
+			return fmt.Errorf("failed to restore the v2 spec from annotation %s: %w", V2SpecAnnotation, err)
+		}
+		delete(dst.Annotations, V2SpecAnnotation)
+		if len(dst.Annotations) == 0 {
+			dst.Annotations = nil
+		}
+	}
+
+	dst.Spec.Deployment.Image = src.Spec.Deployment.Image
+	// replicas 和 replace 都没有设置时保持为空，由 v2 默认成 1 个副本，不能转换成 0
+	dst.Spec.Deployment.Replicas = nil
+	if src.Spec.Deployment.Replicas != nil || src.Spec.Deployment.Replace != 0 {
+		replicas := src.Spec.Deployment.DesiredReplicas()
+		dst.Spec.Deployment.Replicas = &replicas
+	}
+
+	// v1 的 port 是可选的，v2 的端口至少是 1，没有设置时不转换端口
+	if src.Spec.Service.Port != 0 {
+		port := aloystechv2.ServicePort{
+			Name:     aloystechv2.DefaultPortName,
+			Port:     int32(src.Spec.Service.Port),
+			NodePort: int32(src.Spec.Service.NodePort),
+		}
+		if len(dst.Spec.Service.Ports) > 0 {
+			dst.Spec.Service.Ports[0].Port = port.Port
+			dst.Spec.Service.Ports[0].NodePort = port.NodePort
+		} else {
+			dst.Spec.Service.Ports = []aloystechv2.ServicePort{port}
+		}
+	}
+
+	dst.Spec.Ingress.Enabled = src.Spec.Ingress.IsEnable
+	dst.Spec.Ingress.Host = src.Spec.Ingress.Host
+	dst.Spec.Ingress.Path = src.Spec.Ingress.Path
+
+	convertStatusTo(&src.Status, &dst.Status)
+	return nil
+}
+
+// ConvertFrom converts from the Hub version (v2) to this version.
+func (dst *App) ConvertFrom(srcRaw conversion.Hub) error {
+	src := srcRaw.(*aloystechv2.App)
+	dst.ObjectMeta = *src.ObjectMeta.DeepCopy()
+
+	dst.Spec.Deployment.Image = src.Spec.Deployment.Image
+	if src.Spec.Deployment.Replicas != nil {
+		replicas := *src.Spec.Deployment.Replicas
+		dst.Spec.Deployment.Replicas = &replicas
+	}
+
+	port := src.Spec.Service.PrimaryPort()
+	dst.Spec.Service.Port = int(port.Port)
+	dst.Spec.Service.NodePort = int(port.NodePort)
+
+	dst.Spec.Ingress.IsEnable = src.Spec.Ingress.Enabled
+	dst.Spec.Ingress.Host = src.Spec.Ingress.Host
+	dst.Spec.Ingress.Path = src.Spec.Ingress.Path
+
+	convertStatusFrom(&src.Status, &dst.Status)
+
+	// 只有转换会丢字段的时候才把完整的 v2 spec 记到注解里
+	restored := &aloystechv2.App{}
+	if err := dst.ConvertTo(restored); err != nil {
+		return err
+	}
+	if equality.Semantic.DeepEqual(restored.Spec, src.Spec) {
+		return nil
+	}
+	raw, err := json.Marshal(src.Spec)
+	if err != nil {
+		return fmt.Errorf("failed to store the v2 spec in annotation %s: %w", V2SpecAnnotation, err)
+	}
+	if dst.Annotations == nil {
+		dst.Annotations = map[string]string{}
+	}
+	dst.Annotations[V2SpecAnnotation] = string(raw)
+	return nil
+}
+
+func convertStatusTo(src *AppStatus, dst *aloystechv2.AppStatus) {
+	dst.ObservedGeneration = src.ObservedGeneration
+	dst.Phase = aloystechv2.AppPhase(src.Phase)
+	dst.Conditions = src.Conditions
+	dst.Deployment = (*aloystechv2.DeploymentSummary)(src.Deployment)
+	dst.StatefulSet = (*aloystechv2.StatefulSetSummary)(src.StatefulSet)
+	if src.Job != nil {
+		dst.Job = &aloystechv2.JobSummary{
+			Name:               src.Job.Name,
+			LastJob:            src.Job.LastJob,
+			LastRunTime:        src.Job.LastRunTime,
+			LastCompletionTime: src.Job.LastCompletionTime,
+			LastResult:         aloystechv2.JobResult(src.Job.LastResult),
+			NextScheduleTime:   src.Job.NextScheduleTime,
+		}
+	}
+	dst.Service = (*aloystechv2.ServiceSummary)(src.Service)
+	dst.Ingress = (*aloystechv2.IngressSummary)(src.Ingress)
+	dst.HTTPRoute = (*aloystechv2.RouteSummary)(src.HTTPRoute)
+	dst.GRPCRoute = (*aloystechv2.RouteSummary)(src.GRPCRoute)
+	if src.Canary != nil {
+		dst.Canary = &aloystechv2.CanaryStatus{
+			Revision:        src.Canary.Revision,
+			Step:            src.Canary.Step,
+			Weight:          src.Canary.Weight,
+			Phase:           aloystechv2.CanaryPhase(src.Canary.Phase),
+			StepStartedTime: src.Canary.StepStartedTime,
+			Message:         src.Canary.Message,
+		}
+	}
+	if src.BlueGreen != nil {
+		dst.BlueGreen = &aloystechv2.BlueGreenStatus{
+			ActiveColor:     src.BlueGreen.ActiveColor,
+			ActiveRevision:  src.BlueGreen.ActiveRevision,
+			PreviewRevision: src.BlueGreen.PreviewRevision,
+			Phase:           aloystechv2.BlueGreenPhase(src.BlueGreen.Phase),
+			ScaleDownTime:   src.BlueGreen.ScaleDownTime,
+			Message:         src.BlueGreen.Message,
+		}
+	}
+	dst.Rollback = (*aloystechv2.RollbackStatus)(src.Rollback)
+	dst.Adopted = src.Adopted
+	dst.LastHandledReconcileAt = src.LastHandledReconcileAt
+	dst.TemplateVersion = src.TemplateVersion
+	if src.Deletion != nil {
+		dst.Deletion = &aloystechv2.DeletionStatus{
+			Phase:             aloystechv2.DeletionPhase(src.Deletion.Phase),
+			HookJob:           src.Deletion.HookJob,
+			RemainingChildren: src.Deletion.RemainingChildren,
+			RetainedChildren:  src.Deletion.RetainedChildren,
+			Message:           src.Deletion.Message,
+		}
+	}
+	dst.History = nil
+	for _, h := range src.History {
+		dst.History = append(dst.History, aloystechv2.RevisionRecord{
+			Revision:   h.Revision,
+			Hash:       h.Hash,
+			Image:      h.Image,
+			Generation: h.Generation,
+			Time:       h.Time,
+			Outcome:    aloystechv2.RevisionOutcome(h.Outcome),
+		})
+	}
+	dst.Autoscaler = (*aloystechv2.AutoscalerSummary)(src.Autoscaler)
+	dst.Replicas = src.Replicas
+	dst.ReplicasControlledBy = aloystechv2.ReplicaController(src.ReplicasControlledBy)
+	dst.Selector = src.Selector
+}
+
+func convertStatusFrom(src *aloystechv2.AppStatus, dst *AppStatus) {
+	dst.ObservedGeneration = src.ObservedGeneration
+	dst.Phase = AppPhase(src.Phase)
+	dst.Conditions = src.Conditions
+	dst.Deployment = (*DeploymentSummary)(src.Deployment)
+	dst.StatefulSet = (*StatefulSetSummary)(src.StatefulSet)
+	if src.Job != nil {
+		dst.Job = &JobSummary{
+			Name:               src.Job.Name,
+			LastJob:            src.Job.LastJob,
+			LastRunTime:        src.Job.LastRunTime,
+			LastCompletionTime: src.Job.LastCompletionTime,
+			LastResult:         JobResult(src.Job.LastResult),
+			NextScheduleTime:   src.Job.NextScheduleTime,
+		}
+	}
+	dst.Service = (*ServiceSummary)(src.Service)
+	dst.Ingress = (*IngressSummary)(src.Ingress)
+	dst.HTTPRoute = (*RouteSummary)(src.HTTPRoute)
+	dst.GRPCRoute = (*RouteSummary)(src.GRPCRoute)
+	if src.Canary != nil {
+		dst.Canary = &CanaryStatus{
+			Revision:        src.Canary.Revision,
+			Step:            src.Canary.Step,
+			Weight:          src.Canary.Weight,
+			Phase:           CanaryPhase(src.Canary.Phase),
+			StepStartedTime: src.Canary.StepStartedTime,
+			Message:         src.Canary.Message,
+		}
+	}
+	if src.BlueGreen != nil {
+		dst.BlueGreen = &BlueGreenStatus{
+			ActiveColor:     src.BlueGreen.ActiveColor,
+			ActiveRevision:  src.BlueGreen.ActiveRevision,
+			PreviewRevision: src.BlueGreen.PreviewRevision,
+			Phase:           BlueGreenPhase(src.BlueGreen.Phase),
+			ScaleDownTime:   src.BlueGreen.ScaleDownTime,
+			Message:         src.BlueGreen.Message,
+		}
+	}
+	dst.Rollback = (*RollbackStatus)(src.Rollback)
+	dst.Adopted = src.Adopted
+	dst.LastHandledReconcileAt = src.LastHandledReconcileAt
+	dst.TemplateVersion = src.TemplateVersion
+	if src.Deletion != nil {
+		dst.Deletion = &DeletionStatus{
+			Phase:             DeletionPhase(src.Deletion.Phase),
+			HookJob:           src.Deletion.HookJob,
+			RemainingChildren: src.Deletion.RemainingChildren,
+			RetainedChildren:  src.Deletion.RetainedChildren,
+			Message:           src.Deletion.Message,
+		}
+	}
+	dst.History = nil
+	for _, h := range src.History {
+		dst.History = append(dst.History, RevisionRecord{
+			Revision:   h.Revision,
+			Hash:       h.Hash,
+			Image:      h.Image,
+			Generation: h.Generation,
+			Time:       h.Time,
+			Outcome:    RevisionOutcome(h.Outcome),
+		})
+	}
+	dst.Autoscaler = (*AutoscalerSummary)(src.Autoscaler)
+	dst.Replicas = src.Replicas
+	dst.ReplicasControlledBy = ReplicaController(src.ReplicasControlledBy)
+	dst.Selector = src.Selector
+}
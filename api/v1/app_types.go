@@ -17,10 +17,7 @@ limitations under the License.
 package v1
 
 import (
-	appsv1 "k8s.io/api/apps/v1"
-	autoscalingv2 "k8s.io/api/autoscaling/v2"
 	corev1 "k8s.io/api/core/v1"
-	netv1 "k8s.io/api/networking/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
@@ -30,12 +27,27 @@ import (
 type MyDeployment struct {
 	// +kubebuilder:validation:Required
 	Image string `json:"image"`
-	// +kubebuilder:validation:Required
+	// Replace is the old name of Replicas and is only read when Replicas is not set.
+	// Deprecated: use Replicas.
+	// +kubebuilder:validation:Optional
 	// +kubebuilder:validation:Maximum=8
-	Replace int `json:"replace"`
+	Replace int `json:"replace,omitempty"`
+	// Replicas is the desired number of pods, it is also the spec path of the scale subresource.
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:validation:Minimum=0
+	Replicas *int32 `json:"replicas,omitempty"`
 }
 
-// Replace 这个有一个问题，就是hpa最大8，这里设置超过8 的时候，就会一直导致更新，但是受限扩容不了，一直在刷日志
+// DesiredReplicas returns Replicas, falling back to the deprecated Replace field.
+func (d MyDeployment) DesiredReplicas() int32 {
+	if d.Replicas != nil {
+		return *d.Replicas
+	}
+	return int32(d.Replace)
+}
+
+// Replace 以前有一个问题，就是hpa最大8，这里设置超过8 的时候，就会一直导致更新，但是受限扩容不了，一直在刷日志。
+// 现在开启 HPA 时副本数只作为 HPA 的最小值，HPA 的最大值也不再限制在 8
 
 type MyService struct {
 	// Type     string `json:"type,omitempty"`
@@ -67,16 +79,346 @@ type AppSpec struct {
 	Ingress    MyIngress    `json:"ingress,omitempty"`
 }
 
+// AppPhase is a short, human-readable summary of the App lifecycle.
+// +kubebuilder:validation:Enum=Pending;Progressing;Running;Degraded;Terminating
+type AppPhase string
+
+const (
+	AppPhasePending     AppPhase = "Pending"
+	AppPhaseProgressing AppPhase = "Progressing"
+	AppPhaseRunning     AppPhase = "Running"
+	AppPhaseDegraded    AppPhase = "Degraded"
+	AppPhaseTerminating AppPhase = "Terminating"
+)
+
+// ReplicaController names who currently decides the replica count of the Deployment.
+// +kubebuilder:validation:Enum=App;HorizontalPodAutoscaler
+type ReplicaController string
+
+const (
+	// ReplicaControllerApp means the controller enforces the replica count from the App spec.
+	ReplicaControllerApp ReplicaController = "App"
+	// ReplicaControllerHPA means the HorizontalPodAutoscaler scales the Deployment,
+	// the App replica count is only used as the initial and minimum value.
+	ReplicaControllerHPA ReplicaController = "HorizontalPodAutoscaler"
+)
+
+// Condition types reported in AppStatus.Conditions.
+const (
+	// ConditionReady is True once every child resource of the App is ready.
+	// AutoscalerActive is reported on its own and does not gate it, the HPA may lack metrics.
+	ConditionReady = "Ready"
+	// ConditionProgressing is True while at least one child is still converging.
+	ConditionProgressing = "Progressing"
+	// ConditionDegraded is True when a child failed and will not recover on its own.
+	ConditionDegraded = "Degraded"
+	// ConditionSuspended is True while spec.suspend stops the controller from changing the children.
+	ConditionSuspended = "Suspended"
+	// ConditionRenderFailed is True when the templates cannot render a child from the spec,
+	// the App is not retried until the spec or the app-templates ConfigMap changes.
+	ConditionRenderFailed = "RenderFailed"
+	// ConditionOverridesApplied reports whether spec.overrides could be applied to the children.
+	ConditionOverridesApplied = "OverridesApplied"
+
+	ConditionDeploymentAvailable  = "DeploymentAvailable"
+	ConditionStatefulSetAvailable = "StatefulSetAvailable"
+	ConditionJobSucceeded         = "JobSucceeded"
+	ConditionCronJobScheduled     = "CronJobScheduled"
+	ConditionServiceReady         = "ServiceReady"
+	ConditionIngressAdmitted      = "IngressAdmitted"
+	ConditionRouteAccepted        = "RouteAccepted"
+	ConditionAutoscalerActive     = "AutoscalerActive"
+)
+
+// DeploymentSummary is a short summary of the Deployment owned by the App.
+type DeploymentSummary struct {
+	Name              string `json:"name,omitempty"`
+	Replicas          int32  `json:"replicas,omitempty"`
+	UpdatedReplicas   int32  `json:"updatedReplicas,omitempty"`
+	ReadyReplicas     int32  `json:"readyReplicas,omitempty"`
+	AvailableReplicas int32  `json:"availableReplicas,omitempty"`
+}
+
+// StatefulSetSummary is a short summary of the StatefulSet owned by the App.
+type StatefulSetSummary struct {
+	Name              string `json:"name,omitempty"`
+	Replicas          int32  `json:"replicas,omitempty"`
+	UpdatedReplicas   int32  `json:"updatedReplicas,omitempty"`
+	ReadyReplicas     int32  `json:"readyReplicas,omitempty"`
+	AvailableReplicas int32  `json:"availableReplicas,omitempty"`
+	CurrentRevision   string `json:"currentRevision,omitempty"`
+	UpdateRevision    string `json:"updateRevision,omitempty"`
+}
+
+// JobResult is the outcome of the last Job run.
+type JobResult string
+
+const (
+	JobResultRunning   JobResult = "Running"
+	JobResultSucceeded JobResult = "Succeeded"
+	JobResultFailed    JobResult = "Failed"
+)
+
+// JobSummary is a short summary of the Job or CronJob owned by the App.
+type JobSummary struct {
+	Name string `json:"name,omitempty"`
+	// LastJob is the name of the Job of the last run.
+	LastJob string `json:"lastJob,omitempty"`
+	// +optional
+	LastRunTime *metav1.Time `json:"lastRunTime,omitempty"`
+	// +optional
+	LastCompletionTime *metav1.Time `json:"lastCompletionTime,omitempty"`
+	// LastResult is Running, Succeeded or Failed.
+	LastResult JobResult `json:"lastResult,omitempty"`
+	// NextScheduleTime is only set for the CronJob kind.
+	// +optional
+	NextScheduleTime *metav1.Time `json:"nextScheduleTime,omitempty"`
+}
+
+// ServiceSummary is a short summary of the Service owned by the App.
+type ServiceSummary struct {
+	Name      string             `json:"name,omitempty"`
+	Type      corev1.ServiceType `json:"type,omitempty"`
+	ClusterIP string             `json:"clusterIP,omitempty"`
+	// +optional
+	Ports []int32 `json:"ports,omitempty"`
+}
+
+// IngressSummary is a short summary of the Ingress owned by the App.
+type IngressSummary struct {
+	Name string `json:"name,omitempty"`
+	// +optional
+	Hosts []string `json:"hosts,omitempty"`
+	// Addresses are the load balancer IPs or hostnames published by the ingress controller.
+	// +optional
+	Addresses []string `json:"addresses,omitempty"`
+}
+
+// RouteSummary is a short summary of a Gateway API route owned by the App.
+type RouteSummary struct {
+	Name string `json:"name,omitempty"`
+	// +optional
+	Hostnames []string `json:"hostnames,omitempty"`
+	// AcceptedBy are the parent Gateways that accepted the route.
+	// +optional
+	AcceptedBy []string `json:"acceptedBy,omitempty"`
+}
+
+// CanaryPhase is the state of a canary rollout.
+type CanaryPhase string
+
+const (
+	// CanaryProgressing waits for the canary pods of the current step to become available.
+	CanaryProgressing CanaryPhase = "Progressing"
+	// CanaryPaused waits for the pause of the current step or for a manual promotion.
+	CanaryPaused CanaryPhase = "Paused"
+	// CanaryPromoting updates the stable Deployment to the new pod template.
+	CanaryPromoting CanaryPhase = "Promoting"
+	// CanaryAborted keeps the stable pods until the pod template changes again or the rollout is promoted.
+	CanaryAborted CanaryPhase = "Aborted"
+)
+
+// CanaryStatus is the progress of the canary rollout in progress.
+type CanaryStatus struct {
+	// Revision is the hash of the pod template being rolled out.
+	Revision string `json:"revision,omitempty"`
+	// Step is the index of the current step in spec.strategy.canary.steps.
+	Step int32 `json:"step"`
+	// Weight is the percentage of the traffic currently sent to the canary.
+	Weight int32 `json:"weight"`
+	// +optional
+	Phase CanaryPhase `json:"phase,omitempty"`
+	// StepStartedTime is when the canary of the current step became available, the pause counts from it.
+	// +optional
+	StepStartedTime *metav1.Time `json:"stepStartedTime,omitempty"`
+	// +optional
+	Message string `json:"message,omitempty"`
+}
+
+// BlueGreenPhase is the state of a blue/green rollout.
+type BlueGreenPhase string
+
+const (
+	// BlueGreenPreviewing waits for the preview pods to become available.
+	BlueGreenPreviewing BlueGreenPhase = "Previewing"
+	// BlueGreenAwaitingPromotion waits for the promote annotation.
+	BlueGreenAwaitingPromotion BlueGreenPhase = "AwaitingPromotion"
+	// BlueGreenActive serves the active color only.
+	BlueGreenActive BlueGreenPhase = "Active"
+	// BlueGreenAborted removed the preview and keeps serving the active color.
+	BlueGreenAborted BlueGreenPhase = "Aborted"
+)
+
+// BlueGreenStatus is the state of the blue/green Deployments.
+type BlueGreenStatus struct {
+	// ActiveColor is blue or green, the Service selects its pods.
+	// +optional
+	ActiveColor string `json:"activeColor,omitempty"`
+	// ActiveRevision is the hash of the pod template served by the Service.
+	// +optional
+	ActiveRevision string `json:"activeRevision,omitempty"`
+	// PreviewRevision is the hash of the pod template served by the preview Service.
+	// +optional
+	PreviewRevision string `json:"previewRevision,omitempty"`
+	// +optional
+	Phase BlueGreenPhase `json:"phase,omitempty"`
+	// ScaleDownTime is when the previous color is removed after a promotion.
+	// +optional
+	ScaleDownTime *metav1.Time `json:"scaleDownTime,omitempty"`
+	// +optional
+	Message string `json:"message,omitempty"`
+}
+
+// RollbackStatus records the last pod template that rolled out successfully and the one that was reverted.
+type RollbackStatus struct {
+	// LastGoodRevision is the hash of the last pod template that became available.
+	// +optional
+	LastGoodRevision string `json:"lastGoodRevision,omitempty"`
+	// FailedRevision is the hash of the pod template that exceeded its progress deadline and was reverted.
+	// +optional
+	FailedRevision string `json:"failedRevision,omitempty"`
+	// FailedImage is the image of the reverted pod template.
+	// +optional
+	FailedImage string `json:"failedImage,omitempty"`
+	// RollbackTime is when the Deployment was reverted.
+	// +optional
+	RollbackTime *metav1.Time `json:"rollbackTime,omitempty"`
+}
+
+// RevisionOutcome is how the rollout of a spec revision ended.
+type RevisionOutcome string
+
+const (
+	// RevisionProgressing is still rolling out.
+	RevisionProgressing RevisionOutcome = "Progressing"
+	// RevisionSucceeded became available.
+	RevisionSucceeded RevisionOutcome = "Succeeded"
+	// RevisionFailed exceeded its progress deadline or failed to create pods.
+	RevisionFailed RevisionOutcome = "Failed"
+	// RevisionRolledBack failed and was reverted by the automatic rollback.
+	RevisionRolledBack RevisionOutcome = "RolledBack"
+	// RevisionAborted was aborted during a canary or blue/green rollout.
+	RevisionAborted RevisionOutcome = "Aborted"
+	// RevisionSuperseded was replaced by a newer revision before it finished.
+	RevisionSuperseded RevisionOutcome = "Superseded"
+)
+
+// RevisionRecord is one revision of spec.deployment rolled out by the App.
+type RevisionRecord struct {
+	// Revision increases with every new spec.deployment, it is the value of the rollback-to annotation.
+	Revision int64 `json:"revision"`
+	// Hash identifies spec.deployment, the spec itself is kept in the ControllerRevision <app>-<hash>.
+	Hash  string `json:"hash"`
+	Image string `json:"image,omitempty"`
+	// Generation is the App generation that introduced the revision.
+	Generation int64 `json:"generation,omitempty"`
+	// Time is when the revision started to roll out.
+	Time    metav1.Time     `json:"time,omitempty"`
+	Outcome RevisionOutcome `json:"outcome,omitempty"`
+}
+
+// DeletionPhase is the step the controller is at while the App is being deleted.
+type DeletionPhase string
+
+const (
+	// DeletionRunningHook waits for the pre-delete hook Job to finish.
+	DeletionRunningHook DeletionPhase = "RunningPreDeleteHook"
+	// DeletionHookFailed keeps the App until the hook succeeds or the hook Job is deleted to retry it.
+	DeletionHookFailed DeletionPhase = "PreDeleteHookFailed"
+	// DeletionRemovingChildren waits for the children to be deleted.
+	DeletionRemovingChildren DeletionPhase = "RemovingChildren"
+)
+
+// DeletionStatus shows the progress of the App deletion.
+type DeletionStatus struct {
+	// +optional
+	Phase DeletionPhase `json:"phase,omitempty"`
+	// HookJob is the name of the pre-delete hook Job.
+	// +optional
+	HookJob string `json:"hookJob,omitempty"`
+	// RemainingChildren lists the children that have not been deleted yet as Kind/name.
+	// +optional
+	RemainingChildren []string `json:"remainingChildren,omitempty"`
+	// RetainedChildren lists the children kept by the deletion policy as Kind/name.
+	// +optional
+	RetainedChildren []string `json:"retainedChildren,omitempty"`
+	// +optional
+	Message string `json:"message,omitempty"`
+}
+
+// AutoscalerSummary is a short summary of the HorizontalPodAutoscaler owned by the App.
+type AutoscalerSummary struct {
+	Name            string `json:"name,omitempty"`
+	MinReplicas     int32  `json:"minReplicas,omitempty"`
+	MaxReplicas     int32  `json:"maxReplicas,omitempty"`
+	CurrentReplicas int32  `json:"currentReplicas,omitempty"`
+	DesiredReplicas int32  `json:"desiredReplicas,omitempty"`
+}
+
 // AppStatus defines the observed state of App
 type AppStatus struct {
-	// INSERT ADDITIONAL STATUS FIELD - define observed state of cluster
-	// Important: Run "make" to regenerate code after modifying this file
-	// HealthyReplicas *int32 `json:"healthy_replicas,omitempty"`
-	DeploymentStatus              appsv1.DeploymentStatus                     `json:"deploymentStatus"`
-	ServiceSpec                   corev1.ServiceSpec                          `json:"service_spec"`
-	IngressSpec                   netv1.IngressSpec                           `json:"ingress_spec"`
-	HorizontalPodAutoscalerStatus autoscalingv2.HorizontalPodAutoscalerStatus `json:"horizontal_pod_autoscaler_status"`
-	Selector                      string                                      `json:"selector"`
+	// ObservedGeneration is the most recent App generation the controller has acted on.
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+	// +optional
+	Phase AppPhase `json:"phase,omitempty"`
+	// Conditions holds Ready, Progressing, Degraded and one condition per child resource.
+	// +optional
+	// +patchMergeKey=type
+	// +patchStrategy=merge
+	// +listType=map
+	// +listMapKey=type
+	Conditions []metav1.Condition `json:"conditions,omitempty" patchStrategy:"merge" patchMergeKey:"type"`
+
+	// +optional
+	Deployment *DeploymentSummary `json:"deployment,omitempty"`
+	// +optional
+	StatefulSet *StatefulSetSummary `json:"statefulSet,omitempty"`
+	// +optional
+	Job *JobSummary `json:"job,omitempty"`
+	// +optional
+	Service *ServiceSummary `json:"service,omitempty"`
+	// +optional
+	Ingress *IngressSummary `json:"ingress,omitempty"`
+	// +optional
+	HTTPRoute *RouteSummary `json:"httpRoute,omitempty"`
+	// +optional
+	GRPCRoute *RouteSummary `json:"grpcRoute,omitempty"`
+	// +optional
+	Canary *CanaryStatus `json:"canary,omitempty"`
+	// +optional
+	BlueGreen *BlueGreenStatus `json:"blueGreen,omitempty"`
+	// +optional
+	Rollback *RollbackStatus `json:"rollback,omitempty"`
+	// History lists the revisions of spec.deployment, the newest first.
+	// +optional
+	History []RevisionRecord `json:"history,omitempty"`
+	// Adopted lists the existing children taken over with the adopt annotation as Kind/name.
+	// +optional
+	Adopted []string `json:"adopted,omitempty"`
+	// LastHandledReconcileAt is the last value of the reconcile.aloys.tech/requestedAt annotation the controller handled.
+	// +optional
+	LastHandledReconcileAt string `json:"lastHandledReconcileAt,omitempty"`
+	// TemplateVersion identifies the templates the children were last rendered with,
+	// "builtin" followed by the versions of the app-templates ConfigMaps that override them.
+	// +optional
+	TemplateVersion string `json:"templateVersion,omitempty"`
+	// Deletion shows the progress of the deletion once the App is being deleted.
+	// +optional
+	Deletion *DeletionStatus `json:"deletion,omitempty"`
+	// +optional
+	Autoscaler *AutoscalerSummary `json:"autoscaler,omitempty"`
+
+	// Replicas is the number of pods observed by the Deployment, it is the status path of the scale subresource.
+	// +optional
+	Replicas int32 `json:"replicas,omitempty"`
+	// ReplicasControlledBy tells whether the App or the HorizontalPodAutoscaler owns the replica count.
+	// +optional
+	ReplicasControlledBy ReplicaController `json:"replicasControlledBy,omitempty"`
+	// Selector is the label selector of the pods, it is the selector path of the scale subresource.
+	// It is empty for the Job and CronJob kinds, which cannot be scaled.
+	// +optional
+	Selector string `json:"selector,omitempty"`
 }
 
 // +kubebuilder:object:root=true
@@ -85,10 +427,12 @@ type AppStatus struct {
 
 // App is the Schema for the apps API
 // +kubebuilder:printcolumn:name="Image",type="string",JSONPath=".spec.deployment.image",description="The Docker Image of MyAPP"
-// +kubebuilder:printcolumn:name="Size",type="integer",JSONPath=".status.deploymentStatus.readyReplicas",description="Replicas of deploy"
+// +kubebuilder:printcolumn:name="Size",type="integer",JSONPath=".status.deployment.readyReplicas",description="Replicas of deploy"
+// +kubebuilder:printcolumn:name="Ready",type="string",JSONPath=".status.conditions[?(@.type==\"Ready\")].status"
+// +kubebuilder:printcolumn:name="Phase",type="string",JSONPath=".status.phase"
 // +kubebuilder:printcolumn:name="Age",type="date",JSONPath=".metadata.creationTimestamp"
 // +kubebuilder:subresource:status
-// +kubebuilder:subresource:scale:specpath=.spec.deployment.replicas,statuspath=.status.deploymentStatus.replicas,selectorpath=.status.selector
+// +kubebuilder:subresource:scale:specpath=.spec.deployment.replicas,statuspath=.status.replicas,selectorpath=.status.selector
 // +kubebuilder:resource:path=apps,categories=all,singular=aloys
 type App struct {
 	metav1.TypeMeta   `json:",inline"`
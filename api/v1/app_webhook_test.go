@@ -18,29 +18,106 @@ package v1
 
 import (
 	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	aloystechv2 "aloys.tech/api/v2"
 )
 
 var _ = Describe("App Webhook", func() {
 
-	Context("When creating App under Defaulting Webhook", func() {
-		It("Should fill in the default value if a required field is empty", func() {
-
-			// TODO(user): Add your logic here
-
+	Context("When converting App to v2", func() {
+		It("Should fill in replicas from the deprecated replace field", func() {
+			app := &App{Spec: AppSpec{Deployment: MyDeployment{Image: "nginx", Replace: 3}, Service: MyService{Port: 80}}}
+			hub := &aloystechv2.App{}
+			Expect(app.ConvertTo(hub)).To(Succeed())
+			Expect(hub.Spec.Deployment.Replicas).NotTo(BeNil())
+			Expect(*hub.Spec.Deployment.Replicas).To(Equal(int32(3)))
+			Expect(hub.Spec.Service.Ports).To(Equal([]aloystechv2.ServicePort{{Name: aloystechv2.DefaultPortName, Port: 80}}))
 		})
-	})
 
-	Context("When creating App under Validating Webhook", func() {
-		It("Should deny if a required field is empty", func() {
+		It("Should keep replicas set through the scale subresource", func() {
+			replicas := int32(5)
+			app := &App{Spec: AppSpec{Deployment: MyDeployment{Image: "nginx", Replace: 3, Replicas: &replicas}}}
+			hub := &aloystechv2.App{}
+			Expect(app.ConvertTo(hub)).To(Succeed())
+			Expect(hub.Spec.Deployment.DesiredReplicas()).To(Equal(int32(5)))
+		})
 
-			// TODO(user): Add your logic here
+		It("Should keep a minimal v1 App valid in v2 and through a round trip", func() {
+			app := &App{Spec: AppSpec{Deployment: MyDeployment{Image: "nginx"}}}
+			hub := &aloystechv2.App{}
+			Expect(app.ConvertTo(hub)).To(Succeed())
+			Expect(hub.Spec.Deployment.Replicas).To(BeNil())
+			Expect(hub.Spec.Deployment.DesiredReplicas()).To(Equal(int32(1)))
+			Expect(hub.Spec.Service.Ports).To(BeEmpty())
+
+			back := &App{}
+			Expect(back.ConvertFrom(hub)).To(Succeed())
+			Expect(back.Annotations).NotTo(HaveKey(V2SpecAnnotation))
+			Expect(back.Spec).To(Equal(app.Spec))
+		})
 
+		It("Should map the ingress isEnable flag to enabled", func() {
+			app := &App{Spec: AppSpec{Ingress: MyIngress{IsEnable: true, Host: "aloys.tech", Path: "/"}}}
+			hub := &aloystechv2.App{}
+			Expect(app.ConvertTo(hub)).To(Succeed())
+			Expect(hub.Spec.Ingress).To(Equal(aloystechv2.AppIngressSpec{Enabled: true, Host: "aloys.tech", Path: "/"}))
 		})
+	})
 
-		It("Should admit if all required fields are provided", func() {
+	Context("When converting App from v2", func() {
+		It("Should keep the revision history in status", func() {
+			hub := &aloystechv2.App{Status: aloystechv2.AppStatus{
+				Rollback: &aloystechv2.RollbackStatus{LastGoodRevision: "0123456789abcdef"},
+				History: []aloystechv2.RevisionRecord{
+					{Revision: 2, Hash: "fedcba9876543210", Image: "nginx:1.26", Outcome: aloystechv2.RevisionRolledBack},
+					{Revision: 1, Hash: "0123456789abcdef", Image: "nginx:1.25", Outcome: aloystechv2.RevisionSucceeded},
+				},
+			}}
+			app := &App{}
+			Expect(app.ConvertFrom(hub)).To(Succeed())
+			Expect(app.Status.History).To(HaveLen(2))
+
+			back := &aloystechv2.App{}
+			Expect(app.ConvertTo(back)).To(Succeed())
+			Expect(back.Status.History).To(Equal(hub.Status.History))
+			Expect(back.Status.Rollback).To(Equal(hub.Status.Rollback))
+		})
 
-			// TODO(user): Add your logic here
+		It("Should not record the v2 spec when v1 can express it", func() {
+			replicas := int32(2)
+			hub := &aloystechv2.App{Spec: aloystechv2.AppSpec{
+				Deployment: aloystechv2.AppDeploymentSpec{Image: "nginx", Replicas: &replicas},
+				Service:    aloystechv2.AppServiceSpec{Ports: []aloystechv2.ServicePort{{Name: "http", Port: 80}}},
+			}}
+			app := &App{}
+			Expect(app.ConvertFrom(hub)).To(Succeed())
+			Expect(app.Annotations).NotTo(HaveKey(V2SpecAnnotation))
+			Expect(app.Spec.Service.Port).To(Equal(80))
+		})
 
+		It("Should keep extra ports through a v1 round trip", func() {
+			replicas := int32(2)
+			hub := &aloystechv2.App{Spec: aloystechv2.AppSpec{
+				Deployment: aloystechv2.AppDeploymentSpec{Image: "nginx", Replicas: &replicas},
+				Service: aloystechv2.AppServiceSpec{Ports: []aloystechv2.ServicePort{
+					{Name: "http", Port: 80},
+					{Name: "metrics", Port: 9090},
+				}},
+			}}
+			app := &App{}
+			Expect(app.ConvertFrom(hub)).To(Succeed())
+			Expect(app.Annotations).To(HaveKey(V2SpecAnnotation))
+
+			// v1 客户端修改了主端口，其余端口保持不变
+			app.Spec.Service.Port = 8080
+			restored := &aloystechv2.App{}
+			Expect(app.ConvertTo(restored)).To(Succeed())
+			Expect(restored.Annotations).NotTo(HaveKey(V2SpecAnnotation))
+			Expect(restored.Spec.Service.Ports).To(Equal([]aloystechv2.ServicePort{
+				{Name: "http", Port: 8080},
+				{Name: "metrics", Port: 9090},
+			}))
 		})
 	})
 
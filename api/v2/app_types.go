@@ -0,0 +1,1355 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v2
+
+import (
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	autoscalingv2 "k8s.io/api/autoscaling/v2"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	netv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// AppDeploymentSpec describes the Deployment generated for the App.
+type AppDeploymentSpec struct {
+	// Image is the container image of the App.
+	// +kubebuilder:validation:Required
+	Image string `json:"image"`
+	// Replicas is the desired number of pods, it is also the spec path of the scale subresource.
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:validation:Minimum=0
+	// +kubebuilder:default=1
+	Replicas *int32 `json:"replicas,omitempty"`
+	// Resources are the requests and limits of the container. The HPA utilization
+	// targets are computed against the requests.
+	// +kubebuilder:validation:Optional
+	Resources corev1.ResourceRequirements `json:"resources,omitempty"`
+	// LivenessProbe restarts the container when it fails.
+	// +kubebuilder:validation:Optional
+	LivenessProbe *corev1.Probe `json:"livenessProbe,omitempty"`
+	// ReadinessProbe removes the pod from the Service endpoints when it fails.
+	// +kubebuilder:validation:Optional
+	ReadinessProbe *corev1.Probe `json:"readinessProbe,omitempty"`
+	// StartupProbe holds off the other probes until the container has started.
+	// +kubebuilder:validation:Optional
+	StartupProbe *corev1.Probe `json:"startupProbe,omitempty"`
+	// PreStop runs before the container is stopped, for example to drain connections.
+	// +kubebuilder:validation:Optional
+	PreStop *corev1.LifecycleHandler `json:"preStop,omitempty"`
+	// TerminationGracePeriodSeconds is how long the pod may take to shut down after SIGTERM.
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:validation:Minimum=0
+	TerminationGracePeriodSeconds *int64 `json:"terminationGracePeriodSeconds,omitempty"`
+	// Env is the list of environment variables of the container.
+	// +kubebuilder:validation:Optional
+	Env []corev1.EnvVar `json:"env,omitempty"`
+	// EnvFrom populates environment variables from ConfigMaps and Secrets.
+	// +kubebuilder:validation:Optional
+	EnvFrom []corev1.EnvFromSource `json:"envFrom,omitempty"`
+	// ConfigMaps are mounted into the container as files.
+	// +kubebuilder:validation:Optional
+	ConfigMaps []ConfigMount `json:"configMaps,omitempty"`
+	// Secrets are mounted into the container as files.
+	// +kubebuilder:validation:Optional
+	Secrets []ConfigMount `json:"secrets,omitempty"`
+	// NodeSelector restricts the pods to nodes with these labels.
+	// +kubebuilder:validation:Optional
+	NodeSelector map[string]string `json:"nodeSelector,omitempty"`
+	// Tolerations let the pods run on tainted nodes.
+	// +kubebuilder:validation:Optional
+	Tolerations []corev1.Toleration `json:"tolerations,omitempty"`
+	// Affinity holds the node, pod and pod anti-affinity rules of the pods.
+	// +kubebuilder:validation:Optional
+	Affinity *corev1.Affinity `json:"affinity,omitempty"`
+	// TopologySpreadConstraints spread the pods across zones, nodes or other topology domains.
+	// A constraint without a labelSelector selects the pods of its own workload, so the canary
+	// and the blue/green Deployments are each spread on their own.
+	// When it is empty the controller may add its default spread across zones and hostnames, see DefaultTopologySpread.
+	// +kubebuilder:validation:Optional
+	TopologySpreadConstraints []corev1.TopologySpreadConstraint `json:"topologySpreadConstraints,omitempty"`
+	// DefaultTopologySpread turns the default spread across zones and hostnames on or off for this App
+	// when TopologySpreadConstraints is empty. When it is not set, the --default-topology-spread flag of the
+	// controller decides. The controller adds the default spread to the rendered workload, it is not in the templates.
+	// +kubebuilder:validation:Optional
+	DefaultTopologySpread *bool `json:"defaultTopologySpread,omitempty"`
+	// PriorityClassName sets the scheduling priority of the pods.
+	// +kubebuilder:validation:Optional
+	PriorityClassName string `json:"priorityClassName,omitempty"`
+}
+
+// ConfigMount mounts a ConfigMap or a Secret from the App namespace into the container.
+// Changing the content of a referenced ConfigMap or Secret restarts the pods.
+type ConfigMount struct {
+	// Name of the ConfigMap or Secret.
+	// +kubebuilder:validation:Required
+	Name string `json:"name"`
+	// MountPath is the directory the keys are mounted in.
+	// +kubebuilder:validation:Required
+	MountPath string `json:"mountPath"`
+	// Items selects the keys to mount, all keys are mounted when it is empty.
+	// +kubebuilder:validation:Optional
+	Items []corev1.KeyToPath `json:"items,omitempty"`
+	// Optional lets the pod start when the ConfigMap or Secret does not exist.
+	// +kubebuilder:validation:Optional
+	Optional *bool `json:"optional,omitempty"`
+}
+
+// DesiredReplicas returns Replicas, or 1 when it is not set.
+func (d AppDeploymentSpec) DesiredReplicas() int32 {
+	if d.Replicas == nil {
+		return 1
+	}
+	return *d.Replicas
+}
+
+// ServicePort is a port exposed by both the container and the Service.
+type ServicePort struct {
+	// Name of the port. It is required when more than one port is declared.
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:validation:MaxLength=15
+	Name string `json:"name,omitempty"`
+	// Protocol of the port, defaults to TCP.
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:validation:Enum=TCP;UDP;SCTP
+	Protocol corev1.Protocol `json:"protocol,omitempty"`
+	// Port is the port exposed by the Service.
+	// +kubebuilder:validation:Required
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=65535
+	Port int32 `json:"port"`
+	// TargetPort is the port the container listens on, defaults to port.
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=65535
+	TargetPort int32 `json:"targetPort,omitempty"`
+	// AppProtocol is a hint for the implementations of the Service, such as http, grpc or kubernetes.io/h2c.
+	// +kubebuilder:validation:Optional
+	AppProtocol *string `json:"appProtocol,omitempty"`
+	// NodePort exposes the port on every node, it requires the NodePort or LoadBalancer type.
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:validation:Minimum=30000
+	// +kubebuilder:validation:Maximum=37000
+	NodePort int32 `json:"nodePort,omitempty"`
+}
+
+// ContainerPort returns TargetPort, or Port when it is not set.
+func (p ServicePort) ContainerPort() int32 {
+	if p.TargetPort == 0 {
+		return p.Port
+	}
+	return p.TargetPort
+}
+
+// PortProtocol returns Protocol, or TCP when it is not set.
+func (p ServicePort) PortProtocol() corev1.Protocol {
+	if p.Protocol == "" {
+		return corev1.ProtocolTCP
+	}
+	return p.Protocol
+}
+
+// ServiceType is the type of the Service generated for the App.
+// +kubebuilder:validation:Enum=ClusterIP;NodePort;LoadBalancer;Headless
+type ServiceType string
+
+const (
+	ServiceTypeClusterIP    ServiceType = "ClusterIP"
+	ServiceTypeNodePort     ServiceType = "NodePort"
+	ServiceTypeLoadBalancer ServiceType = "LoadBalancer"
+	// ServiceTypeHeadless is a ClusterIP Service without a cluster IP.
+	ServiceTypeHeadless ServiceType = "Headless"
+)
+
+// AppServiceSpec describes the Service generated for the App.
+type AppServiceSpec struct {
+	// Type defaults to NodePort when any port sets a nodePort, otherwise ClusterIP.
+	// +kubebuilder:validation:Optional
+	Type ServiceType `json:"type,omitempty"`
+	// Ports are required unless the workload is a Job or a CronJob, which have no Service.
+	// +kubebuilder:validation:Optional
+	Ports []ServicePort `json:"ports,omitempty"`
+	// SessionAffinity is None or ClientIP.
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:validation:Enum=None;ClientIP
+	SessionAffinity corev1.ServiceAffinity `json:"sessionAffinity,omitempty"`
+	// SessionAffinityConfig sets the ClientIP affinity timeout.
+	// +kubebuilder:validation:Optional
+	SessionAffinityConfig *corev1.SessionAffinityConfig `json:"sessionAffinityConfig,omitempty"`
+	// ExternalTrafficPolicy is Cluster or Local, it is only supported by the NodePort and LoadBalancer types.
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:validation:Enum=Cluster;Local
+	ExternalTrafficPolicy corev1.ServiceExternalTrafficPolicy `json:"externalTrafficPolicy,omitempty"`
+}
+
+// ServiceType returns the declared type, falling back to NodePort when a nodePort is set.
+func (s AppServiceSpec) ServiceType() ServiceType {
+	if s.Type != "" {
+		return s.Type
+	}
+	if s.HasNodePort() {
+		return ServiceTypeNodePort
+	}
+	return ServiceTypeClusterIP
+}
+
+// IsHeadless reports whether the Service has no cluster IP.
+func (s AppServiceSpec) IsHeadless() bool {
+	return s.ServiceType() == ServiceTypeHeadless
+}
+
+// CoreServiceType returns the corev1 type of the Service, a headless Service is a ClusterIP Service.
+func (s AppServiceSpec) CoreServiceType() corev1.ServiceType {
+	if s.IsHeadless() {
+		return corev1.ServiceTypeClusterIP
+	}
+	return corev1.ServiceType(s.ServiceType())
+}
+
+// PrimaryPort returns the first declared port, the Ingress routes traffic to it.
+func (s AppServiceSpec) PrimaryPort() ServicePort {
+	if len(s.Ports) == 0 {
+		return ServicePort{}
+	}
+	return s.Ports[0]
+}
+
+// HasNodePort reports whether any port asks for a NodePort.
+func (s AppServiceSpec) HasNodePort() bool {
+	for _, p := range s.Ports {
+		if p.NodePort != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// DefaultIngressClassName is the ingress class used when the App does not set one.
+const DefaultIngressClassName = "nginx"
+
+// IngressPath routes a path of a host to a port of the Service.
+type IngressPath struct {
+	// Path defaults to /.
+	// +kubebuilder:validation:Optional
+	Path string `json:"path,omitempty"`
+	// PathType defaults to Prefix.
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:validation:Enum=Exact;Prefix;ImplementationSpecific
+	PathType *netv1.PathType `json:"pathType,omitempty"`
+	// Port is the name of a service port, it defaults to the first port.
+	// +kubebuilder:validation:Optional
+	Port string `json:"port,omitempty"`
+}
+
+// PathOrDefault returns Path, or / when it is not set.
+func (p IngressPath) PathOrDefault() string {
+	if p.Path == "" {
+		return "/"
+	}
+	return p.Path
+}
+
+// PathTypeOrDefault returns PathType, or Prefix when it is not set.
+func (p IngressPath) PathTypeOrDefault() netv1.PathType {
+	if p.PathType == nil {
+		return netv1.PathTypePrefix
+	}
+	return *p.PathType
+}
+
+// IngressRule routes the paths of a host.
+type IngressRule struct {
+	// Host matches every host when it is empty.
+	// +kubebuilder:validation:Optional
+	Host string `json:"host,omitempty"`
+	// Paths default to a single / prefix.
+	// +kubebuilder:validation:Optional
+	Paths []IngressPath `json:"paths,omitempty"`
+}
+
+// IngressPaths returns Paths, or a single / prefix when it is empty.
+func (r IngressRule) IngressPaths() []IngressPath {
+	if len(r.Paths) == 0 {
+		return []IngressPath{{}}
+	}
+	return r.Paths
+}
+
+// IngressCertManager asks cert-manager to issue the certificates of the TLS entries.
+type IngressCertManager struct {
+	// Issuer is a namespaced Issuer, it is mutually exclusive with ClusterIssuer.
+	// +kubebuilder:validation:Optional
+	Issuer string `json:"issuer,omitempty"`
+	// ClusterIssuer is a ClusterIssuer, it is mutually exclusive with Issuer.
+	// +kubebuilder:validation:Optional
+	ClusterIssuer string `json:"clusterIssuer,omitempty"`
+}
+
+// AppIngressSpec describes the Ingress generated for the App.
+type AppIngressSpec struct {
+	// Enabled creates an Ingress in front of the Service.
+	// +kubebuilder:validation:Optional
+	Enabled bool `json:"enabled,omitempty"`
+	// Host and Path describe a single rule, they cannot be used together with Rules.
+	// +kubebuilder:validation:Optional
+	Host string `json:"host,omitempty"`
+	// +kubebuilder:validation:Optional
+	Path string `json:"path,omitempty"`
+	// IngressClassName defaults to nginx.
+	// +kubebuilder:validation:Optional
+	IngressClassName *string `json:"ingressClassName,omitempty"`
+	// Rules route several hosts and paths to the ports of the Service.
+	// +kubebuilder:validation:Optional
+	Rules []IngressRule `json:"rules,omitempty"`
+	// TLS terminates TLS for the hosts with the certificate in the secret.
+	// +kubebuilder:validation:Optional
+	TLS []netv1.IngressTLS `json:"tls,omitempty"`
+	// Annotations are copied to the Ingress as they are, for example to configure the ingress controller.
+	// +kubebuilder:validation:Optional
+	Annotations map[string]string `json:"annotations,omitempty"`
+	// CertManager adds the cert-manager annotations so the TLS secrets are issued automatically.
+	// +kubebuilder:validation:Optional
+	CertManager *IngressCertManager `json:"certManager,omitempty"`
+}
+
+// ClassName returns IngressClassName, or nginx when it is not set.
+func (s AppIngressSpec) ClassName() string {
+	if s.IngressClassName == nil {
+		return DefaultIngressClassName
+	}
+	return *s.IngressClassName
+}
+
+// IngressRules returns Rules, or a single rule built from Host and Path.
+func (s AppIngressSpec) IngressRules() []IngressRule {
+	if len(s.Rules) > 0 {
+		return s.Rules
+	}
+	return []IngressRule{{Host: s.Host, Paths: []IngressPath{{Path: s.Path}}}}
+}
+
+// IngressAnnotations returns Annotations together with the cert-manager annotations.
+func (s AppIngressSpec) IngressAnnotations() map[string]string {
+	if len(s.Annotations) == 0 && s.CertManager == nil {
+		return nil
+	}
+	annotations := map[string]string{}
+	for k, v := range s.Annotations {
+		annotations[k] = v
+	}
+	if cm := s.CertManager; cm != nil {
+		if cm.Issuer != "" {
+			annotations["cert-manager.io/issuer"] = cm.Issuer
+		}
+		if cm.ClusterIssuer != "" {
+			annotations["cert-manager.io/cluster-issuer"] = cm.ClusterIssuer
+		}
+	}
+	return annotations
+}
+
+// ExposureMode selects how the Service is exposed outside the cluster.
+// +kubebuilder:validation:Enum=ingress;gatewayAPI
+type ExposureMode string
+
+const (
+	// ExposureIngress exposes the Service through an Ingress when ingress.enabled is set.
+	ExposureIngress ExposureMode = "ingress"
+	// ExposureGatewayAPI exposes the Service through Gateway API routes instead of an Ingress.
+	ExposureGatewayAPI ExposureMode = "gatewayAPI"
+)
+
+// GatewayParentRef names the Gateway a route attaches to.
+type GatewayParentRef struct {
+	// +kubebuilder:validation:Required
+	Name string `json:"name"`
+	// Namespace defaults to the namespace of the App.
+	// +kubebuilder:validation:Optional
+	Namespace string `json:"namespace,omitempty"`
+	// SectionName is the name of a listener of the Gateway.
+	// +kubebuilder:validation:Optional
+	SectionName string `json:"sectionName,omitempty"`
+}
+
+// RoutePathMatch matches the request path.
+type RoutePathMatch struct {
+	// Type defaults to PathPrefix.
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:validation:Enum=Exact;PathPrefix;RegularExpression
+	Type string `json:"type,omitempty"`
+	// +kubebuilder:validation:Required
+	Value string `json:"value"`
+}
+
+// RouteHeaderMatch matches a request header.
+type RouteHeaderMatch struct {
+	// Type defaults to Exact.
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:validation:Enum=Exact;RegularExpression
+	Type string `json:"type,omitempty"`
+	// +kubebuilder:validation:Required
+	Name string `json:"name"`
+	// +kubebuilder:validation:Required
+	Value string `json:"value"`
+}
+
+// RouteMatch matches a request by path and headers, every condition must match.
+type RouteMatch struct {
+	// +kubebuilder:validation:Optional
+	Path *RoutePathMatch `json:"path,omitempty"`
+	// +kubebuilder:validation:Optional
+	Headers []RouteHeaderMatch `json:"headers,omitempty"`
+}
+
+// RouteBackend is a Service the matched requests are sent to.
+type RouteBackend struct {
+	// Name of the Service, it defaults to the Service of the App.
+	// +kubebuilder:validation:Optional
+	Name string `json:"name,omitempty"`
+	// Port of the Service, it defaults to the first port of the App.
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=65535
+	Port int32 `json:"port,omitempty"`
+	// Weight is the proportion of requests sent to this backend.
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:validation:Minimum=0
+	// +kubebuilder:validation:Maximum=1000000
+	Weight *int32 `json:"weight,omitempty"`
+}
+
+// HTTPRouteRule sends the requests matching any of the matches to the backends.
+type HTTPRouteRule struct {
+	// Matches default to every request.
+	// +kubebuilder:validation:Optional
+	Matches []RouteMatch `json:"matches,omitempty"`
+	// Backends default to the Service of the App.
+	// +kubebuilder:validation:Optional
+	Backends []RouteBackend `json:"backends,omitempty"`
+}
+
+// RouteBackends returns Backends, or the Service of the App when it is empty.
+func (r HTTPRouteRule) RouteBackends() []RouteBackend {
+	if len(r.Backends) == 0 {
+		return []RouteBackend{{}}
+	}
+	return r.Backends
+}
+
+// GRPCMethodMatch matches a gRPC service and method, an empty field matches everything.
+type GRPCMethodMatch struct {
+	// +kubebuilder:validation:Optional
+	Service string `json:"service,omitempty"`
+	// +kubebuilder:validation:Optional
+	Method string `json:"method,omitempty"`
+}
+
+// GRPCRouteRule sends the gRPC calls matching the method and headers to the backends.
+type GRPCRouteRule struct {
+	// +kubebuilder:validation:Optional
+	Method *GRPCMethodMatch `json:"method,omitempty"`
+	// +kubebuilder:validation:Optional
+	Headers []RouteHeaderMatch `json:"headers,omitempty"`
+	// Backends default to the Service of the App.
+	// +kubebuilder:validation:Optional
+	Backends []RouteBackend `json:"backends,omitempty"`
+}
+
+// RouteBackends returns Backends, or the Service of the App when it is empty.
+func (r GRPCRouteRule) RouteBackends() []RouteBackend {
+	if len(r.Backends) == 0 {
+		return []RouteBackend{{}}
+	}
+	return r.Backends
+}
+
+// AppGatewaySpec describes the Gateway API routes generated for the App.
+type AppGatewaySpec struct {
+	// ParentRefs are the Gateways the routes attach to.
+	// +kubebuilder:validation:Required
+	// +kubebuilder:validation:MinItems=1
+	ParentRefs []GatewayParentRef `json:"parentRefs"`
+	// +kubebuilder:validation:Optional
+	Hostnames []string `json:"hostnames,omitempty"`
+	// Rules of the HTTPRoute, a single rule sending every request to the App is used when it is empty.
+	// +kubebuilder:validation:Optional
+	Rules []HTTPRouteRule `json:"rules,omitempty"`
+	// GRPCRules create a GRPCRoute next to the HTTPRoute.
+	// +kubebuilder:validation:Optional
+	GRPCRules []GRPCRouteRule `json:"grpcRules,omitempty"`
+}
+
+// HTTPRules returns Rules, or a single rule sending every request to the App.
+func (g AppGatewaySpec) HTTPRules() []HTTPRouteRule {
+	if len(g.Rules) == 0 {
+		return []HTTPRouteRule{{}}
+	}
+	return g.Rules
+}
+
+// AppExposureSpec selects between an Ingress and Gateway API routes.
+type AppExposureSpec struct {
+	// Mode defaults to ingress.
+	// +kubebuilder:validation:Optional
+	Mode ExposureMode `json:"mode,omitempty"`
+	// Gateway is required by the gatewayAPI mode.
+	// +kubebuilder:validation:Optional
+	Gateway *AppGatewaySpec `json:"gateway,omitempty"`
+}
+
+// GatewayAPIEnabled reports whether the App is exposed through Gateway API routes.
+func (e AppExposureSpec) GatewayAPIEnabled() bool {
+	return e.Mode == ExposureGatewayAPI && e.Gateway != nil
+}
+
+// DefaultMaxReplicas is the HPA maxReplicas used when the App does not set one.
+const DefaultMaxReplicas int32 = 8
+
+// DefaultTargetCPUUtilization is the CPU target used when no metric is configured.
+const DefaultTargetCPUUtilization int32 = 80
+
+// AppAutoscalingSpec describes the HorizontalPodAutoscaler generated for the App.
+type AppAutoscalingSpec struct {
+	// Enabled creates the HorizontalPodAutoscaler. Turning it off deletes the HPA
+	// and the App enforces deployment.replicas again. Defaults to true.
+	// +kubebuilder:validation:Optional
+	Enabled *bool `json:"enabled,omitempty"`
+	// MinReplicas defaults to deployment.replicas.
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:validation:Minimum=1
+	MinReplicas *int32 `json:"minReplicas,omitempty"`
+	// MaxReplicas defaults to the larger of minReplicas and 8.
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:validation:Minimum=1
+	MaxReplicas *int32 `json:"maxReplicas,omitempty"`
+	// TargetCPUUtilization is the average CPU utilization in percent of the requests.
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:validation:Minimum=1
+	TargetCPUUtilization *int32 `json:"targetCPUUtilization,omitempty"`
+	// TargetMemoryUtilization is the average memory utilization in percent of the requests.
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:validation:Minimum=1
+	TargetMemoryUtilization *int32 `json:"targetMemoryUtilization,omitempty"`
+	// Metrics are appended to the CPU and memory targets, they support the
+	// Resource, ContainerResource, Pods, Object and External metric sources.
+	// +kubebuilder:validation:Optional
+	Metrics []autoscalingv2.MetricSpec `json:"metrics,omitempty"`
+	// Behavior configures the scale up and scale down policies of the HPA.
+	// +kubebuilder:validation:Optional
+	Behavior *autoscalingv2.HorizontalPodAutoscalerBehavior `json:"behavior,omitempty"`
+}
+
+// WorkloadKind is the kind of workload that runs the App pods.
+// +kubebuilder:validation:Enum=Deployment;StatefulSet;Job;CronJob
+type WorkloadKind string
+
+const (
+	WorkloadDeployment  WorkloadKind = "Deployment"
+	WorkloadStatefulSet WorkloadKind = "StatefulSet"
+	// WorkloadJob runs the pods to completion once. A Job cannot be updated, so a change of the
+	// pod template or of a referenced ConfigMap/Secret recreates the Job, but only after the
+	// running Job has finished. Until then the JobSucceeded condition reports JobSpecPending.
+	WorkloadJob     WorkloadKind = "Job"
+	WorkloadCronJob WorkloadKind = "CronJob"
+)
+
+// VolumeClaimTemplate is a PersistentVolumeClaim created for every StatefulSet pod
+// and mounted into the container.
+type VolumeClaimTemplate struct {
+	// Name of the claim, it is also the volume name in the pod.
+	// +kubebuilder:validation:Required
+	// +kubebuilder:validation:MaxLength=63
+	Name string `json:"name"`
+	// MountPath is where the volume is mounted in the container.
+	// +kubebuilder:validation:Required
+	MountPath string `json:"mountPath"`
+	// +kubebuilder:validation:Required
+	Spec corev1.PersistentVolumeClaimSpec `json:"spec"`
+}
+
+// AppWorkloadSpec selects the workload kind and holds the settings that only apply to some kinds.
+type AppWorkloadSpec struct {
+	// Kind of the workload. Defaults to Deployment.
+	// A changed Job is recreated only after the running Job has finished.
+	// +kubebuilder:validation:Optional
+	Kind WorkloadKind `json:"kind,omitempty"`
+	// VolumeClaimTemplates are only supported by the StatefulSet kind and cannot be changed once created.
+	// +kubebuilder:validation:Optional
+	VolumeClaimTemplates []VolumeClaimTemplate `json:"volumeClaimTemplates,omitempty"`
+	// PodManagementPolicy controls whether StatefulSet pods are created one by one or in parallel.
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:validation:Enum=OrderedReady;Parallel
+	PodManagementPolicy appsv1.PodManagementPolicyType `json:"podManagementPolicy,omitempty"`
+	// Partition only updates the StatefulSet pods with an ordinal greater or equal to it,
+	// lowering it step by step gives an ordered, staged rollout.
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:validation:Minimum=0
+	Partition *int32 `json:"partition,omitempty"`
+
+	// Schedule is the cron schedule of the CronJob kind, for example "0 2 * * *".
+	// +kubebuilder:validation:Optional
+	Schedule string `json:"schedule,omitempty"`
+	// TimeZone of the schedule, for example "Asia/Shanghai". Defaults to the time zone of the kube-controller-manager.
+	// +kubebuilder:validation:Optional
+	TimeZone *string `json:"timeZone,omitempty"`
+	// ConcurrencyPolicy tells the CronJob what to do when the previous run is still active.
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:validation:Enum=Allow;Forbid;Replace
+	ConcurrencyPolicy batchv1.ConcurrencyPolicy `json:"concurrencyPolicy,omitempty"`
+	// BackoffLimit is the number of retries before a Job or a CronJob run is marked as failed.
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:validation:Minimum=0
+	BackoffLimit *int32 `json:"backoffLimit,omitempty"`
+	// SuccessfulJobsHistoryLimit is the number of finished CronJob runs to keep.
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:validation:Minimum=0
+	SuccessfulJobsHistoryLimit *int32 `json:"successfulJobsHistoryLimit,omitempty"`
+	// FailedJobsHistoryLimit is the number of failed CronJob runs to keep.
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:validation:Minimum=0
+	FailedJobsHistoryLimit *int32 `json:"failedJobsHistoryLimit,omitempty"`
+}
+
+// IsStatefulSet reports whether the App runs as a StatefulSet.
+func (w AppWorkloadSpec) IsStatefulSet() bool {
+	return w.Kind == WorkloadStatefulSet
+}
+
+// IsBatch reports whether the App runs as a Job or a CronJob. Batch workloads
+// have no Service, Ingress or HorizontalPodAutoscaler.
+func (w AppWorkloadSpec) IsBatch() bool {
+	return w.Kind == WorkloadJob || w.Kind == WorkloadCronJob
+}
+
+// StrategyType selects how a new pod template of the Deployment is rolled out.
+// +kubebuilder:validation:Enum=RollingUpdate;Canary;BlueGreen
+type StrategyType string
+
+const (
+	// StrategyRollingUpdate updates the Deployment in place.
+	StrategyRollingUpdate StrategyType = "RollingUpdate"
+	// StrategyCanary runs the new pod template in a second Deployment and shifts traffic to it step by step.
+	StrategyCanary StrategyType = "Canary"
+	// StrategyBlueGreen runs the new pod template next to the active one and switches the Service on promotion.
+	StrategyBlueGreen StrategyType = "BlueGreen"
+)
+
+// RolloutActionAnnotation is set on the App to promote or abort the rollout in progress,
+// the controller removes it once the action is taken.
+const RolloutActionAnnotation = "aloys.tech/rollout"
+
+const (
+	// RolloutActionPromote moves the rollout to its next step without waiting for the pause.
+	RolloutActionPromote = "promote"
+	// RolloutActionAbort sends all traffic back to the stable pods and removes the new ones.
+	RolloutActionAbort = "abort"
+)
+
+// CanaryStep sends a share of the traffic to the canary.
+type CanaryStep struct {
+	// Weight is the percentage of the traffic sent to the canary.
+	// +kubebuilder:validation:Required
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=100
+	Weight int32 `json:"weight"`
+	// Pause is how long to wait once the canary is healthy before moving to the next step.
+	// Without a pause the rollout waits at this step until it is promoted through the annotation.
+	// +kubebuilder:validation:Optional
+	Pause *metav1.Duration `json:"pause,omitempty"`
+}
+
+// CanaryStrategy describes the steps of a canary rollout.
+type CanaryStrategy struct {
+	// Steps are taken in order, the stable Deployment is updated after the last one.
+	// +kubebuilder:validation:Required
+	// +kubebuilder:validation:MinItems=1
+	Steps []CanaryStep `json:"steps"`
+}
+
+// DefaultScaleDownDelay is how long the previous color keeps running after a blue/green promotion.
+const DefaultScaleDownDelay = 30 * time.Second
+
+// BlueGreenStrategy describes a blue/green rollout.
+type BlueGreenStrategy struct {
+	// AutoPromotion switches the Service as soon as the preview pods are available,
+	// otherwise the rollout waits for the promote annotation.
+	// +kubebuilder:validation:Optional
+	AutoPromotion bool `json:"autoPromotion,omitempty"`
+	// ScaleDownDelay is how long the previous color keeps running after the promotion, it defaults to 30s.
+	// +kubebuilder:validation:Optional
+	ScaleDownDelay *metav1.Duration `json:"scaleDownDelay,omitempty"`
+}
+
+// ScaleDownDelayOrDefault returns ScaleDownDelay, or 30s when it is not set.
+func (b *BlueGreenStrategy) ScaleDownDelayOrDefault() time.Duration {
+	if b == nil || b.ScaleDownDelay == nil {
+		return DefaultScaleDownDelay
+	}
+	return b.ScaleDownDelay.Duration
+}
+
+// AppStrategySpec describes how changes of the pod template are rolled out.
+type AppStrategySpec struct {
+	// Type defaults to RollingUpdate.
+	// +kubebuilder:validation:Optional
+	Type StrategyType `json:"type,omitempty"`
+	// Canary is required by the Canary type.
+	// +kubebuilder:validation:Optional
+	Canary *CanaryStrategy `json:"canary,omitempty"`
+	// BlueGreen tunes the BlueGreen type.
+	// +kubebuilder:validation:Optional
+	BlueGreen *BlueGreenStrategy `json:"blueGreen,omitempty"`
+}
+
+// IsBlueGreen reports whether new pod templates are rolled out as blue/green.
+func (s AppStrategySpec) IsBlueGreen() bool {
+	return s.Type == StrategyBlueGreen
+}
+
+// IsCanary reports whether new pod templates are rolled out as a canary.
+func (s AppStrategySpec) IsCanary() bool {
+	return s.Type == StrategyCanary && s.Canary != nil && len(s.Canary.Steps) > 0
+}
+
+// AppFinalizer lets the controller run the pre-delete hook and apply the deletion policy before the App goes away.
+const AppFinalizer = "aloys.tech/cleanup"
+
+// DeletionPolicy decides what happens to the children when the App is deleted.
+// +kubebuilder:validation:Enum=Delete;Orphan;RetainIngressAndService
+type DeletionPolicy string
+
+const (
+	// DeletionPolicyDelete deletes all children, it is the default.
+	DeletionPolicyDelete DeletionPolicy = "Delete"
+	// DeletionPolicyOrphan keeps all children and removes their owner reference to the App.
+	DeletionPolicyOrphan DeletionPolicy = "Orphan"
+	// DeletionPolicyRetainIngressAndService keeps the Services, Ingresses and Gateway API routes and deletes the rest.
+	DeletionPolicyRetainIngressAndService DeletionPolicy = "RetainIngressAndService"
+)
+
+// DefaultPreDeleteDeadlineSeconds is how long the pre-delete hook may run when ActiveDeadlineSeconds is not set.
+const DefaultPreDeleteDeadlineSeconds = 300
+
+// PreDeleteHook is a Job that runs to completion before the children of a deleted App are removed,
+// for example to deregister the App from an external registry.
+type PreDeleteHook struct {
+	// Image defaults to spec.deployment.image.
+	// +optional
+	Image string `json:"image,omitempty"`
+	// +optional
+	Command []string `json:"command,omitempty"`
+	// +optional
+	Args []string `json:"args,omitempty"`
+	// +optional
+	Env []corev1.EnvVar `json:"env,omitempty"`
+	// BackoffLimit is how many times a failed hook pod is retried, it defaults to the Job default of 6.
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	BackoffLimit *int32 `json:"backoffLimit,omitempty"`
+	// ActiveDeadlineSeconds fails the hook when it runs longer, it defaults to 300.
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	ActiveDeadlineSeconds *int64 `json:"activeDeadlineSeconds,omitempty"`
+	// IgnoreFailure removes the children even when the hook fails.
+	// Otherwise the App stays in deletion until the hook succeeds or the hook Job is deleted to retry it.
+	// +optional
+	IgnoreFailure bool `json:"ignoreFailure,omitempty"`
+}
+
+// DeadlineSeconds returns ActiveDeadlineSeconds, or 300 when it is not set.
+func (h *PreDeleteHook) DeadlineSeconds() int64 {
+	if h.ActiveDeadlineSeconds == nil {
+		return DefaultPreDeleteDeadlineSeconds
+	}
+	return *h.ActiveDeadlineSeconds
+}
+
+// DefaultRevisionHistoryLimit is how many spec revisions are kept when RevisionHistoryLimit is not set.
+const DefaultRevisionHistoryLimit = 10
+
+// AdoptAnnotation set to "true" lets the controller take over existing children with the generated names,
+// for example a <name>-deploy Deployment and a <name>-svc Service created before the App.
+const AdoptAnnotation = "aloys.tech/adopt"
+
+// RollbackToAnnotation restores spec.deployment from the revision with the given number in status.history.
+// The controller removes the annotation once it has been handled.
+const RollbackToAnnotation = "aloys.tech/rollback-to"
+
+// RequestedAtAnnotation triggers an immediate reconcile whenever its value changes,
+// the handled value is echoed back in status.lastHandledReconcileAt.
+const RequestedAtAnnotation = "reconcile.aloys.tech/requestedAt"
+
+// OverridePatchType is the format of ChildOverride.Patch.
+// +kubebuilder:validation:Enum=StrategicMerge;JSON6902
+type OverridePatchType string
+
+const (
+	// OverrideStrategicMerge merges the patch into the child like kubectl patch --type=strategic.
+	// Gateway API routes have no patch strategy and are merged as a JSON merge patch.
+	OverrideStrategicMerge OverridePatchType = "StrategicMerge"
+	// OverrideJSON6902 applies a list of RFC 6902 operations.
+	OverrideJSON6902 OverridePatchType = "JSON6902"
+)
+
+// ChildOverride patches the children of one kind after they are rendered from the templates,
+// for the fields the App does not model such as an annotation, a toleration or a sidecar.
+type ChildOverride struct {
+	// Kind of the children to patch, the canary and blue/green Deployments and Services are patched too.
+	// +kubebuilder:validation:Enum=Deployment;StatefulSet;Job;CronJob;Service;Ingress;HorizontalPodAutoscaler;HTTPRoute;GRPCRoute
+	Kind string `json:"kind"`
+	// Type defaults to StrategicMerge.
+	// +optional
+	Type OverridePatchType `json:"type,omitempty"`
+	// Patch in YAML or JSON: an object for StrategicMerge, a list of operations for JSON6902.
+	// The patch must not change the apiVersion, kind, name or namespace of the child,
+	// nor set privileged, hostPath, hostNetwork, hostPID, hostIPC or capabilities.add.
+	// +kubebuilder:validation:MinLength=1
+	Patch string `json:"patch"`
+}
+
+// TypeOrDefault returns Type, or StrategicMerge when it is not set.
+func (o ChildOverride) TypeOrDefault() OverridePatchType {
+	if o.Type == "" {
+		return OverrideStrategicMerge
+	}
+	return o.Type
+}
+
+// AppRollbackSpec controls what happens when a rollout fails.
+type AppRollbackSpec struct {
+	// Auto reverts the Deployment to the last pod template that rolled out successfully
+	// once the new one exceeds its progress deadline.
+	// +optional
+	Auto bool `json:"auto,omitempty"`
+	// RevisionHistoryLimit is how many revisions of spec.deployment are kept in status.history, it defaults to 10.
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	RevisionHistoryLimit *int32 `json:"revisionHistoryLimit,omitempty"`
+}
+
+// AppSpec defines the desired state of App
+type AppSpec struct {
+	Deployment AppDeploymentSpec `json:"deployment"`
+	// +kubebuilder:validation:Optional
+	Service AppServiceSpec `json:"service,omitempty"`
+	// +kubebuilder:validation:Optional
+	Ingress AppIngressSpec `json:"ingress,omitempty"`
+	// Exposure switches from the Ingress to Gateway API routes.
+	// +kubebuilder:validation:Optional
+	Exposure AppExposureSpec `json:"exposure,omitempty"`
+	// Autoscaling is enabled with a CPU target of 80% when it is not set.
+	// +kubebuilder:validation:Optional
+	Autoscaling *AppAutoscalingSpec `json:"autoscaling,omitempty"`
+	// Workload selects a Deployment, a StatefulSet, a Job or a CronJob for the App pods.
+	// +kubebuilder:validation:Optional
+	Workload AppWorkloadSpec `json:"workload,omitempty"`
+	// Strategy rolls out pod template changes of a Deployment as a canary or as blue/green.
+	// +kubebuilder:validation:Optional
+	Strategy AppStrategySpec `json:"strategy,omitempty"`
+	// Rollback reverts failed rollouts of the Deployment.
+	// +kubebuilder:validation:Optional
+	Rollback *AppRollbackSpec `json:"rollback,omitempty"`
+	// DeletionPolicy decides what happens to the children when the App is deleted, it defaults to Delete.
+	// +kubebuilder:validation:Optional
+	DeletionPolicy DeletionPolicy `json:"deletionPolicy,omitempty"`
+	// PreDeleteHook runs before the children are removed when the App is deleted.
+	// +kubebuilder:validation:Optional
+	PreDeleteHook *PreDeleteHook `json:"preDeleteHook,omitempty"`
+	// Suspend freezes the App: the controller stops creating, updating and deleting the children
+	// but keeps reporting their state in the status. Deleting the App is still handled.
+	// +kubebuilder:validation:Optional
+	Suspend bool `json:"suspend,omitempty"`
+	// Overrides are applied in order on top of the rendered children.
+	// +kubebuilder:validation:Optional
+	Overrides []ChildOverride `json:"overrides,omitempty"`
+}
+
+// DeletionPolicyOrDefault returns DeletionPolicy, or Delete when it is not set.
+func (s AppSpec) DeletionPolicyOrDefault() DeletionPolicy {
+	if s.DeletionPolicy == "" {
+		return DeletionPolicyDelete
+	}
+	return s.DeletionPolicy
+}
+
+// PreDeleteImage returns the image of the pre-delete hook.
+func (s AppSpec) PreDeleteImage() string {
+	if s.PreDeleteHook != nil && s.PreDeleteHook.Image != "" {
+		return s.PreDeleteHook.Image
+	}
+	return s.Deployment.Image
+}
+
+// AutoRollback reports whether failed rollouts are reverted automatically.
+func (s AppSpec) AutoRollback() bool {
+	return s.Rollback != nil && s.Rollback.Auto
+}
+
+// RevisionHistoryLimit returns how many revisions of spec.deployment are kept.
+func (s AppSpec) RevisionHistoryLimit() int {
+	if s.Rollback == nil || s.Rollback.RevisionHistoryLimit == nil {
+		return DefaultRevisionHistoryLimit
+	}
+	return int(*s.Rollback.RevisionHistoryLimit)
+}
+
+// AutoscalingEnabled reports whether the App should have a HorizontalPodAutoscaler.
+func (s AppSpec) AutoscalingEnabled() bool {
+	if s.Workload.IsBatch() {
+		return false
+	}
+	return s.Autoscaling == nil || s.Autoscaling.Enabled == nil || *s.Autoscaling.Enabled
+}
+
+// HPAMinReplicas returns the minReplicas of the HorizontalPodAutoscaler.
+func (s AppSpec) HPAMinReplicas() int32 {
+	if s.Autoscaling != nil && s.Autoscaling.MinReplicas != nil {
+		return *s.Autoscaling.MinReplicas
+	}
+	if replicas := s.Deployment.DesiredReplicas(); replicas > 1 {
+		return replicas
+	}
+	return 1
+}
+
+// HPAMaxReplicas returns the maxReplicas of the HorizontalPodAutoscaler.
+func (s AppSpec) HPAMaxReplicas() int32 {
+	if s.Autoscaling != nil && s.Autoscaling.MaxReplicas != nil {
+		return *s.Autoscaling.MaxReplicas
+	}
+	if min := s.HPAMinReplicas(); min > DefaultMaxReplicas {
+		return min
+	}
+	return DefaultMaxReplicas
+}
+
+// HPAMetrics returns the metrics of the HorizontalPodAutoscaler, the CPU and memory
+// targets come first and a CPU target of 80% is used when nothing is configured.
+func (s AppSpec) HPAMetrics() []autoscalingv2.MetricSpec {
+	var cpu, memory *int32
+	var extra []autoscalingv2.MetricSpec
+	if a := s.Autoscaling; a != nil {
+		cpu, memory, extra = a.TargetCPUUtilization, a.TargetMemoryUtilization, a.Metrics
+	}
+	if cpu == nil && memory == nil && len(extra) == 0 {
+		target := DefaultTargetCPUUtilization
+		cpu = &target
+	}
+	var metrics []autoscalingv2.MetricSpec
+	if cpu != nil {
+		metrics = append(metrics, resourceUtilization(corev1.ResourceCPU, *cpu))
+	}
+	if memory != nil {
+		metrics = append(metrics, resourceUtilization(corev1.ResourceMemory, *memory))
+	}
+	return append(metrics, extra...)
+}
+
+func resourceUtilization(name corev1.ResourceName, utilization int32) autoscalingv2.MetricSpec {
+	return autoscalingv2.MetricSpec{
+		Type: autoscalingv2.ResourceMetricSourceType,
+		Resource: &autoscalingv2.ResourceMetricSource{
+			Name: name,
+			Target: autoscalingv2.MetricTarget{
+				Type:               autoscalingv2.UtilizationMetricType,
+				AverageUtilization: &utilization,
+			},
+		},
+	}
+}
+
+// AppPhase is a short, human-readable summary of the App lifecycle.
+// +kubebuilder:validation:Enum=Pending;Progressing;Running;Degraded;Terminating
+type AppPhase string
+
+const (
+	AppPhasePending     AppPhase = "Pending"
+	AppPhaseProgressing AppPhase = "Progressing"
+	AppPhaseRunning     AppPhase = "Running"
+	AppPhaseDegraded    AppPhase = "Degraded"
+	AppPhaseTerminating AppPhase = "Terminating"
+)
+
+// ReplicaController names who currently decides the replica count of the Deployment.
+// +kubebuilder:validation:Enum=App;HorizontalPodAutoscaler
+type ReplicaController string
+
+const (
+	// ReplicaControllerApp means the controller enforces the replica count from the App spec.
+	ReplicaControllerApp ReplicaController = "App"
+	// ReplicaControllerHPA means the HorizontalPodAutoscaler scales the Deployment,
+	// the App replica count is only used as the initial and minimum value.
+	ReplicaControllerHPA ReplicaController = "HorizontalPodAutoscaler"
+)
+
+// Condition types reported in AppStatus.Conditions.
+const (
+	// ConditionReady is True once every child resource of the App is ready.
+	// AutoscalerActive is reported on its own and does not gate it, the HPA may lack metrics.
+	ConditionReady = "Ready"
+	// ConditionProgressing is True while at least one child is still converging.
+	ConditionProgressing = "Progressing"
+	// ConditionDegraded is True when a child failed and will not recover on its own.
+	ConditionDegraded = "Degraded"
+	// ConditionSuspended is True while spec.suspend stops the controller from changing the children.
+	ConditionSuspended = "Suspended"
+	// ConditionRenderFailed is True when the templates cannot render a child from the spec,
+	// the App is not retried until the spec or the app-templates ConfigMap changes.
+	ConditionRenderFailed = "RenderFailed"
+	// ConditionOverridesApplied reports whether spec.overrides could be applied to the children.
+	ConditionOverridesApplied = "OverridesApplied"
+
+	ConditionDeploymentAvailable  = "DeploymentAvailable"
+	ConditionStatefulSetAvailable = "StatefulSetAvailable"
+	ConditionJobSucceeded         = "JobSucceeded"
+	ConditionCronJobScheduled     = "CronJobScheduled"
+	ConditionServiceReady         = "ServiceReady"
+	ConditionIngressAdmitted      = "IngressAdmitted"
+	ConditionRouteAccepted        = "RouteAccepted"
+	ConditionAutoscalerActive     = "AutoscalerActive"
+)
+
+// DeploymentSummary is a short summary of the Deployment owned by the App.
+type DeploymentSummary struct {
+	Name              string `json:"name,omitempty"`
+	Replicas          int32  `json:"replicas,omitempty"`
+	UpdatedReplicas   int32  `json:"updatedReplicas,omitempty"`
+	ReadyReplicas     int32  `json:"readyReplicas,omitempty"`
+	AvailableReplicas int32  `json:"availableReplicas,omitempty"`
+}
+
+// StatefulSetSummary is a short summary of the StatefulSet owned by the App.
+type StatefulSetSummary struct {
+	Name              string `json:"name,omitempty"`
+	Replicas          int32  `json:"replicas,omitempty"`
+	UpdatedReplicas   int32  `json:"updatedReplicas,omitempty"`
+	ReadyReplicas     int32  `json:"readyReplicas,omitempty"`
+	AvailableReplicas int32  `json:"availableReplicas,omitempty"`
+	CurrentRevision   string `json:"currentRevision,omitempty"`
+	UpdateRevision    string `json:"updateRevision,omitempty"`
+}
+
+// JobResult is the outcome of the last Job run.
+type JobResult string
+
+const (
+	JobResultRunning   JobResult = "Running"
+	JobResultSucceeded JobResult = "Succeeded"
+	JobResultFailed    JobResult = "Failed"
+)
+
+// JobSummary is a short summary of the Job or CronJob owned by the App.
+type JobSummary struct {
+	Name string `json:"name,omitempty"`
+	// LastJob is the name of the Job of the last run.
+	LastJob string `json:"lastJob,omitempty"`
+	// +optional
+	LastRunTime *metav1.Time `json:"lastRunTime,omitempty"`
+	// +optional
+	LastCompletionTime *metav1.Time `json:"lastCompletionTime,omitempty"`
+	// LastResult is Running, Succeeded or Failed.
+	LastResult JobResult `json:"lastResult,omitempty"`
+	// NextScheduleTime is only set for the CronJob kind.
+	// +optional
+	NextScheduleTime *metav1.Time `json:"nextScheduleTime,omitempty"`
+}
+
+// ServiceSummary is a short summary of the Service owned by the App.
+type ServiceSummary struct {
+	Name      string             `json:"name,omitempty"`
+	Type      corev1.ServiceType `json:"type,omitempty"`
+	ClusterIP string             `json:"clusterIP,omitempty"`
+	// +optional
+	Ports []int32 `json:"ports,omitempty"`
+}
+
+// IngressSummary is a short summary of the Ingress owned by the App.
+type IngressSummary struct {
+	Name string `json:"name,omitempty"`
+	// +optional
+	Hosts []string `json:"hosts,omitempty"`
+	// Addresses are the load balancer IPs or hostnames published by the ingress controller.
+	// +optional
+	Addresses []string `json:"addresses,omitempty"`
+}
+
+// RouteSummary is a short summary of a Gateway API route owned by the App.
+type RouteSummary struct {
+	Name string `json:"name,omitempty"`
+	// +optional
+	Hostnames []string `json:"hostnames,omitempty"`
+	// AcceptedBy are the parent Gateways that accepted the route.
+	// +optional
+	AcceptedBy []string `json:"acceptedBy,omitempty"`
+}
+
+// CanaryPhase is the state of a canary rollout.
+type CanaryPhase string
+
+const (
+	// CanaryProgressing waits for the canary pods of the current step to become available.
+	CanaryProgressing CanaryPhase = "Progressing"
+	// CanaryPaused waits for the pause of the current step or for a manual promotion.
+	CanaryPaused CanaryPhase = "Paused"
+	// CanaryPromoting updates the stable Deployment to the new pod template.
+	CanaryPromoting CanaryPhase = "Promoting"
+	// CanaryAborted keeps the stable pods until the pod template changes again or the rollout is promoted.
+	CanaryAborted CanaryPhase = "Aborted"
+)
+
+// CanaryStatus is the progress of the canary rollout in progress.
+type CanaryStatus struct {
+	// Revision is the hash of the pod template being rolled out.
+	Revision string `json:"revision,omitempty"`
+	// Step is the index of the current step in spec.strategy.canary.steps.
+	Step int32 `json:"step"`
+	// Weight is the percentage of the traffic currently sent to the canary.
+	Weight int32 `json:"weight"`
+	// +optional
+	Phase CanaryPhase `json:"phase,omitempty"`
+	// StepStartedTime is when the canary of the current step became available, the pause counts from it.
+	// +optional
+	StepStartedTime *metav1.Time `json:"stepStartedTime,omitempty"`
+	// +optional
+	Message string `json:"message,omitempty"`
+}
+
+// BlueGreenPhase is the state of a blue/green rollout.
+type BlueGreenPhase string
+
+const (
+	// BlueGreenPreviewing waits for the preview pods to become available.
+	BlueGreenPreviewing BlueGreenPhase = "Previewing"
+	// BlueGreenAwaitingPromotion waits for the promote annotation.
+	BlueGreenAwaitingPromotion BlueGreenPhase = "AwaitingPromotion"
+	// BlueGreenActive serves the active color only.
+	BlueGreenActive BlueGreenPhase = "Active"
+	// BlueGreenAborted removed the preview and keeps serving the active color.
+	BlueGreenAborted BlueGreenPhase = "Aborted"
+)
+
+// BlueGreenStatus is the state of the blue/green Deployments.
+type BlueGreenStatus struct {
+	// ActiveColor is blue or green, the Service selects its pods.
+	// +optional
+	ActiveColor string `json:"activeColor,omitempty"`
+	// ActiveRevision is the hash of the pod template served by the Service.
+	// +optional
+	ActiveRevision string `json:"activeRevision,omitempty"`
+	// PreviewRevision is the hash of the pod template served by the preview Service.
+	// +optional
+	PreviewRevision string `json:"previewRevision,omitempty"`
+	// +optional
+	Phase BlueGreenPhase `json:"phase,omitempty"`
+	// ScaleDownTime is when the previous color is removed after a promotion.
+	// +optional
+	ScaleDownTime *metav1.Time `json:"scaleDownTime,omitempty"`
+	// +optional
+	Message string `json:"message,omitempty"`
+}
+
+// RollbackStatus records the last pod template that rolled out successfully and the one that was reverted.
+type RollbackStatus struct {
+	// LastGoodRevision is the hash of the last pod template that became available.
+	// +optional
+	LastGoodRevision string `json:"lastGoodRevision,omitempty"`
+	// FailedRevision is the hash of the pod template that exceeded its progress deadline and was reverted.
+	// +optional
+	FailedRevision string `json:"failedRevision,omitempty"`
+	// FailedImage is the image of the reverted pod template.
+	// +optional
+	FailedImage string `json:"failedImage,omitempty"`
+	// RollbackTime is when the Deployment was reverted.
+	// +optional
+	RollbackTime *metav1.Time `json:"rollbackTime,omitempty"`
+}
+
+// RevisionOutcome is how the rollout of a spec revision ended.
+type RevisionOutcome string
+
+const (
+	// RevisionProgressing is still rolling out.
+	RevisionProgressing RevisionOutcome = "Progressing"
+	// RevisionSucceeded became available.
+	RevisionSucceeded RevisionOutcome = "Succeeded"
+	// RevisionFailed exceeded its progress deadline or failed to create pods.
+	RevisionFailed RevisionOutcome = "Failed"
+	// RevisionRolledBack failed and was reverted by the automatic rollback.
+	RevisionRolledBack RevisionOutcome = "RolledBack"
+	// RevisionAborted was aborted during a canary or blue/green rollout.
+	RevisionAborted RevisionOutcome = "Aborted"
+	// RevisionSuperseded was replaced by a newer revision before it finished.
+	RevisionSuperseded RevisionOutcome = "Superseded"
+)
+
+// RevisionRecord is one revision of spec.deployment rolled out by the App.
+type RevisionRecord struct {
+	// Revision increases with every new spec.deployment, it is the value of the rollback-to annotation.
+	Revision int64 `json:"revision"`
+	// Hash identifies spec.deployment, the spec itself is kept in the ControllerRevision <app>-<hash>.
+	Hash  string `json:"hash"`
+	Image string `json:"image,omitempty"`
+	// Generation is the App generation that introduced the revision.
+	Generation int64 `json:"generation,omitempty"`
+	// Time is when the revision started to roll out.
+	Time    metav1.Time     `json:"time,omitempty"`
+	Outcome RevisionOutcome `json:"outcome,omitempty"`
+}
+
+// DeletionPhase is the step the controller is at while the App is being deleted.
+type DeletionPhase string
+
+const (
+	// DeletionRunningHook waits for the pre-delete hook Job to finish.
+	DeletionRunningHook DeletionPhase = "RunningPreDeleteHook"
+	// DeletionHookFailed keeps the App until the hook succeeds or the hook Job is deleted to retry it.
+	DeletionHookFailed DeletionPhase = "PreDeleteHookFailed"
+	// DeletionRemovingChildren waits for the children to be deleted.
+	DeletionRemovingChildren DeletionPhase = "RemovingChildren"
+)
+
+// DeletionStatus shows the progress of the App deletion.
+type DeletionStatus struct {
+	// +optional
+	Phase DeletionPhase `json:"phase,omitempty"`
+	// HookJob is the name of the pre-delete hook Job.
+	// +optional
+	HookJob string `json:"hookJob,omitempty"`
+	// RemainingChildren lists the children that have not been deleted yet as Kind/name.
+	// +optional
+	RemainingChildren []string `json:"remainingChildren,omitempty"`
+	// RetainedChildren lists the children kept by the deletion policy as Kind/name.
+	// +optional
+	RetainedChildren []string `json:"retainedChildren,omitempty"`
+	// +optional
+	Message string `json:"message,omitempty"`
+}
+
+// AutoscalerSummary is a short summary of the HorizontalPodAutoscaler owned by the App.
+type AutoscalerSummary struct {
+	Name            string `json:"name,omitempty"`
+	MinReplicas     int32  `json:"minReplicas,omitempty"`
+	MaxReplicas     int32  `json:"maxReplicas,omitempty"`
+	CurrentReplicas int32  `json:"currentReplicas,omitempty"`
+	DesiredReplicas int32  `json:"desiredReplicas,omitempty"`
+}
+
+// AppStatus defines the observed state of App
+type AppStatus struct {
+	// ObservedGeneration is the most recent App generation the controller has acted on.
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+	// +optional
+	Phase AppPhase `json:"phase,omitempty"`
+	// Conditions holds Ready, Progressing, Degraded and one condition per child resource.
+	// +optional
+	// +patchMergeKey=type
+	// +patchStrategy=merge
+	// +listType=map
+	// +listMapKey=type
+	Conditions []metav1.Condition `json:"conditions,omitempty" patchStrategy:"merge" patchMergeKey:"type"`
+
+	// +optional
+	Deployment *DeploymentSummary `json:"deployment,omitempty"`
+	// +optional
+	StatefulSet *StatefulSetSummary `json:"statefulSet,omitempty"`
+	// +optional
+	Job *JobSummary `json:"job,omitempty"`
+	// +optional
+	Service *ServiceSummary `json:"service,omitempty"`
+	// +optional
+	Ingress *IngressSummary `json:"ingress,omitempty"`
+	// +optional
+	HTTPRoute *RouteSummary `json:"httpRoute,omitempty"`
+	// +optional
+	GRPCRoute *RouteSummary `json:"grpcRoute,omitempty"`
+	// +optional
+	Canary *CanaryStatus `json:"canary,omitempty"`
+	// +optional
+	BlueGreen *BlueGreenStatus `json:"blueGreen,omitempty"`
+	// +optional
+	Rollback *RollbackStatus `json:"rollback,omitempty"`
+	// History lists the revisions of spec.deployment, the newest first.
+	// +optional
+	History []RevisionRecord `json:"history,omitempty"`
+	// Adopted lists the existing children taken over with the adopt annotation as Kind/name.
+	// +optional
+	Adopted []string `json:"adopted,omitempty"`
+	// LastHandledReconcileAt is the last value of the reconcile.aloys.tech/requestedAt annotation the controller handled.
+	// +optional
+	LastHandledReconcileAt string `json:"lastHandledReconcileAt,omitempty"`
+	// TemplateVersion identifies the templates the children were last rendered with,
+	// "builtin" followed by the versions of the app-templates ConfigMaps that override them.
+	// +optional
+	TemplateVersion string `json:"templateVersion,omitempty"`
+	// Deletion shows the progress of the deletion once the App is being deleted.
+	// +optional
+	Deletion *DeletionStatus `json:"deletion,omitempty"`
+	// +optional
+	Autoscaler *AutoscalerSummary `json:"autoscaler,omitempty"`
+
+	// Replicas is the number of pods observed by the Deployment, it is the status path of the scale subresource.
+	// +optional
+	Replicas int32 `json:"replicas,omitempty"`
+	// ReplicasControlledBy tells whether the App or the HorizontalPodAutoscaler owns the replica count.
+	// +optional
+	ReplicasControlledBy ReplicaController `json:"replicasControlledBy,omitempty"`
+	// Selector is the label selector of the pods, it is the selector path of the scale subresource.
+	// It is empty for the Job and CronJob kinds, which cannot be scaled.
+	// +optional
+	Selector string `json:"selector,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:subresource:status
+// +kubebuilder:storageversion
+
+// App is the Schema for the apps API
+// +kubebuilder:printcolumn:name="Image",type="string",JSONPath=".spec.deployment.image",description="The Docker Image of MyAPP"
+// +kubebuilder:printcolumn:name="Size",type="integer",JSONPath=".status.deployment.readyReplicas",description="Replicas of deploy"
+// +kubebuilder:printcolumn:name="Ready",type="string",JSONPath=".status.conditions[?(@.type==\"Ready\")].status"
+// +kubebuilder:printcolumn:name="Phase",type="string",JSONPath=".status.phase"
+// +kubebuilder:printcolumn:name="Age",type="date",JSONPath=".metadata.creationTimestamp"
+// +kubebuilder:subresource:scale:specpath=.spec.deployment.replicas,statuspath=.status.replicas,selectorpath=.status.selector
+// +kubebuilder:resource:path=apps,categories=all,singular=aloys
+type App struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   AppSpec   `json:"spec,omitempty"`
+	Status AppStatus `json:"status,omitempty"`
+}
+
+// AdoptionEnabled reports whether existing children that are not owned by the App may be taken over.
+func (r *App) AdoptionEnabled() bool {
+	return r.Annotations[AdoptAnnotation] == "true"
+}
+
+// +kubebuilder:object:root=true
+
+// AppList contains a list of App
+type AppList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []App `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&App{}, &AppList{})
+}
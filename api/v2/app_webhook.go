@@ -0,0 +1,512 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v2
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/robfig/cron/v3"
+	autoscalingv2 "k8s.io/api/autoscaling/v2"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/runtime"
+	ctrl "sigs.k8s.io/controller-runtime"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+	"sigs.k8s.io/yaml"
+)
+
+// DefaultPortName is the name given to the port when only one port is declared.
+const DefaultPortName = "http"
+
+// log is for logging in this package.
+var applog = logf.Log.WithName("app-resource")
+
+// OverridesDryRun renders the children targeted by spec.overrides with the templates of the App namespace
+// and returns the first patch that cannot be applied.
+// +kubebuilder:object:generate=false
+type OverridesDryRun func(ctx context.Context, app *App) error
+
+// SetupWebhookWithManager will setup the manager to manage the webhooks
+// The templates live outside the API package, dryRun checks spec.overrides against them and is required.
+func (r *App) SetupWebhookWithManager(mgr ctrl.Manager, dryRun OverridesDryRun) error {
+	if dryRun == nil {
+		return fmt.Errorf("the overrides dry-run is required by the App webhook.")
+	}
+	return ctrl.NewWebhookManagedBy(mgr).
+		For(r).
+		WithValidator(&appValidator{dryRun: dryRun}).
+		Complete()
+}
+
+// 默认值和校验只注册在 v2 上，v1 的请求会按 matchPolicy=Equivalent 转换成 v2 之后再调用这里
+
+// +kubebuilder:webhook:path=/mutate-aloys-tech-aloys-tech-v2-app,mutating=true,failurePolicy=fail,sideEffects=None,groups=aloys.tech.aloys.tech,resources=apps,verbs=create;update,versions=v2,name=mapp.kb.io,admissionReviewVersions=v1
+
+var _ webhook.Defaulter = &App{}
+
+// Default implements webhook.Defaulter so a webhook will be registered for the type
+func (r *App) Default() {
+	applog.Info("default", "name", r.Name)
+
+	if r.Annotations == nil {
+		r.Annotations = map[string]string{}
+	}
+	r.Annotations["aloys"] = "aloys"
+	if r.Spec.Deployment.Replicas == nil {
+		replicas := r.Spec.Deployment.DesiredReplicas()
+		r.Spec.Deployment.Replicas = &replicas
+	}
+	// 只有一个端口的时候可以不写名字
+	if len(r.Spec.Service.Ports) == 1 && r.Spec.Service.Ports[0].Name == "" {
+		r.Spec.Service.Ports[0].Name = DefaultPortName
+	}
+}
+
+// +kubebuilder:webhook:path=/validate-aloys-tech-aloys-tech-v2-app,mutating=false,failurePolicy=fail,sideEffects=None,groups=aloys.tech.aloys.tech,resources=apps,verbs=create;update,versions=v2,name=vapp.kb.io,admissionReviewVersions=v1
+
+// appValidator 校验 App，dryRun 按 controller 使用的模板试着应用 spec.overrides
+type appValidator struct {
+	dryRun OverridesDryRun
+}
+
+var _ webhook.CustomValidator = &appValidator{}
+
+// ValidateCreate implements webhook.CustomValidator so a webhook will be registered for the type
+func (v *appValidator) ValidateCreate(ctx context.Context, obj runtime.Object) (admission.Warnings, error) {
+	r, ok := obj.(*App)
+	if !ok {
+		return nil, fmt.Errorf("expected an App, got %T.", obj)
+	}
+	applog.Info("validate create", "name", r.Name)
+
+	return v.validate(ctx, r)
+}
+
+// ValidateUpdate implements webhook.CustomValidator so a webhook will be registered for the type
+func (v *appValidator) ValidateUpdate(ctx context.Context, oldObj, newObj runtime.Object) (admission.Warnings, error) {
+	r, ok := newObj.(*App)
+	if !ok {
+		return nil, fmt.Errorf("expected an App, got %T.", newObj)
+	}
+	applog.Info("validate update", "name", r.Name)
+
+	// 删除过程中 controller 需要移除 finalizer，不能因为 spec 不符合后来加上的校验规则而卡住删除
+	if !r.DeletionTimestamp.IsZero() {
+		return nil, nil
+	}
+	if oldApp, ok := oldObj.(*App); ok {
+		if err := r.validateWorkloadUpdate(oldApp); err != nil {
+			return nil, err
+		}
+	}
+	return v.validate(ctx, r)
+}
+
+// ValidateDelete implements webhook.CustomValidator so a webhook will be registered for the type
+func (v *appValidator) ValidateDelete(ctx context.Context, obj runtime.Object) (admission.Warnings, error) {
+	if r, ok := obj.(*App); ok {
+		applog.Info("validate delete", "name", r.Name)
+	}
+
+	return nil, nil
+}
+
+// validate 先校验 spec 本身，通过之后再按模板试着应用 spec.overrides，没有 dryRun 时拒绝带 overrides 的 App
+func (v *appValidator) validate(ctx context.Context, r *App) (admission.Warnings, error) {
+	warnings, err := r.validateApp()
+	if err != nil || len(r.Spec.Overrides) == 0 {
+		return warnings, err
+	}
+	if v.dryRun == nil {
+		return nil, fmt.Errorf("overrides cannot be checked, the webhook has no templates to apply them to.")
+	}
+	if err := v.dryRun(ctx, r); err != nil {
+		return nil, fmt.Errorf("overrides cannot be applied: %v", err)
+	}
+	return warnings, nil
+}
+
+func (r *App) validateApp() (admission.Warnings, error) {
+	if err := r.validateService(); err != nil {
+		return nil, err
+	}
+	if r.Spec.Ingress.Enabled && r.Spec.Service.HasNodePort() {
+		return nil, fmt.Errorf("ingress enabled ,but service nodeport is set.")
+	}
+	if err := r.validateIngress(); err != nil {
+		return nil, err
+	}
+	if err := r.validateExposure(); err != nil {
+		return nil, err
+	}
+	if err := r.validateWorkload(); err != nil {
+		return nil, err
+	}
+	if err := r.validateStrategy(); err != nil {
+		return nil, err
+	}
+	if err := r.validateOverrides(); err != nil {
+		return nil, err
+	}
+	var warnings admission.Warnings
+	if r.Spec.Exposure.Mode == ExposureGatewayAPI && r.Spec.Ingress.Enabled {
+		warnings = append(warnings, "exposure mode is gatewayAPI, the ingress settings are ignored.")
+	}
+	if r.Spec.Workload.IsBatch() && (r.Spec.Ingress.Enabled || r.Spec.Autoscaling != nil) {
+		warnings = append(warnings, fmt.Sprintf("the %s kind has no Service, Ingress or HorizontalPodAutoscaler, the ingress and autoscaling settings are ignored.", r.Spec.Workload.Kind))
+	}
+	if r.Spec.AutoscalingEnabled() {
+		warnings = append(warnings, r.autoscalingWarnings()...)
+		if min, max := r.Spec.HPAMinReplicas(), r.Spec.HPAMaxReplicas(); min > max {
+			return nil, fmt.Errorf("autoscaling minReplicas %d is greater than maxReplicas %d.", min, max)
+		}
+		for i, m := range r.Spec.HPAMetrics() {
+			if err := validateMetric(m); err != nil {
+				return nil, fmt.Errorf("autoscaling metric %d is invalid: %v", i, err)
+			}
+		}
+	}
+	return warnings, nil
+}
+
+func (r *App) validateService() error {
+	svc := r.Spec.Service
+	if len(svc.Ports) == 0 && !r.Spec.Workload.IsBatch() {
+		return fmt.Errorf("service must declare at least one port.")
+	}
+	names := map[string]bool{}
+	ports := map[string]bool{}
+	for _, p := range svc.Ports {
+		if len(svc.Ports) > 1 && p.Name == "" {
+			return fmt.Errorf("service port %d has no name, every port must be named when more than one port is declared.", p.Port)
+		}
+		if names[p.Name] {
+			return fmt.Errorf("service port name %q is duplicated.", p.Name)
+		}
+		names[p.Name] = true
+		key := fmt.Sprintf("%d/%s", p.Port, p.PortProtocol())
+		if ports[key] {
+			return fmt.Errorf("service port %s is duplicated.", key)
+		}
+		ports[key] = true
+	}
+	t := svc.ServiceType()
+	exposed := t == ServiceTypeNodePort || t == ServiceTypeLoadBalancer
+	if svc.HasNodePort() && !exposed {
+		return fmt.Errorf("service nodePort is only supported by the NodePort and LoadBalancer types, but the type is %s.", t)
+	}
+	if svc.ExternalTrafficPolicy != "" && !exposed {
+		return fmt.Errorf("service externalTrafficPolicy is only supported by the NodePort and LoadBalancer types, but the type is %s.", t)
+	}
+	if svc.SessionAffinityConfig != nil && svc.SessionAffinity != corev1.ServiceAffinityClientIP {
+		return fmt.Errorf("service sessionAffinityConfig requires the ClientIP session affinity.")
+	}
+	return nil
+}
+
+func (r *App) validateIngress() error {
+	ing := r.Spec.Ingress
+	if !ing.Enabled {
+		return nil
+	}
+	if len(ing.Rules) > 0 && (ing.Host != "" || ing.Path != "") {
+		return fmt.Errorf("ingress host and path cannot be used together with ingress rules.")
+	}
+	ports := map[string]bool{}
+	for _, p := range r.Spec.Service.Ports {
+		ports[p.Name] = true
+	}
+	for _, rule := range ing.Rules {
+		for _, p := range rule.Paths {
+			if p.Port != "" && !ports[p.Port] {
+				return fmt.Errorf("ingress path %s of host %q routes to port %q, which is not a service port.", p.PathOrDefault(), rule.Host, p.Port)
+			}
+		}
+	}
+	if cm := ing.CertManager; cm != nil {
+		if (cm.Issuer == "") == (cm.ClusterIssuer == "") {
+			return fmt.Errorf("ingress certManager must set exactly one of issuer and clusterIssuer.")
+		}
+		if len(ing.TLS) == 0 {
+			return fmt.Errorf("ingress certManager requires at least one tls entry.")
+		}
+		for _, tls := range ing.TLS {
+			if tls.SecretName == "" {
+				return fmt.Errorf("ingress tls entries need a secretName for cert-manager to store the certificate.")
+			}
+		}
+	}
+	return nil
+}
+
+func (r *App) validateExposure() error {
+	e := r.Spec.Exposure
+	if e.Mode != ExposureGatewayAPI {
+		if e.Gateway != nil {
+			return fmt.Errorf("exposure gateway is only supported by the gatewayAPI mode.")
+		}
+		return nil
+	}
+	if e.Gateway == nil || len(e.Gateway.ParentRefs) == 0 {
+		return fmt.Errorf("exposure gateway.parentRefs is required by the gatewayAPI mode.")
+	}
+	ports := map[int32]bool{}
+	for _, p := range r.Spec.Service.Ports {
+		ports[p.Port] = true
+	}
+	// 指向 App 自己的 Service 时端口必须是声明过的端口，其他 Service 的端口无法校验
+	checkBackends := func(backends []RouteBackend) error {
+		for _, b := range backends {
+			if b.Name == "" && b.Port != 0 && !ports[b.Port] {
+				return fmt.Errorf("exposure gateway backend port %d is not a service port.", b.Port)
+			}
+		}
+		return nil
+	}
+	for _, rule := range e.Gateway.Rules {
+		if err := checkBackends(rule.Backends); err != nil {
+			return err
+		}
+	}
+	for _, rule := range e.Gateway.GRPCRules {
+		if err := checkBackends(rule.Backends); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateStrategy canary 通过 Ingress 或 HTTPRoute 分流，没有这两者时流量无法按比例切换；
+// blue/green 通过切换 Service 的 selector 发布，只需要工作负载是 Deployment；
+// 自动回滚只改写 -deploy，blue/green 失败的 preview 本来就不会接收流量
+func (r *App) validateStrategy() error {
+	st := r.Spec.Strategy
+	if st.Type != StrategyBlueGreen && st.BlueGreen != nil {
+		return fmt.Errorf("strategy blueGreen is only supported by the BlueGreen type.")
+	}
+	if st.Type == StrategyBlueGreen && r.Spec.Workload.Kind != "" && r.Spec.Workload.Kind != WorkloadDeployment {
+		return fmt.Errorf("the BlueGreen strategy is only supported by the Deployment kind.")
+	}
+	if st.BlueGreen != nil && st.BlueGreen.ScaleDownDelay != nil && st.BlueGreen.ScaleDownDelay.Duration < 0 {
+		return fmt.Errorf("strategy blueGreen.scaleDownDelay must not be negative.")
+	}
+	if r.Spec.AutoRollback() && (r.Spec.Workload.Kind != "" && r.Spec.Workload.Kind != WorkloadDeployment || st.Type == StrategyBlueGreen) {
+		return fmt.Errorf("rollback.auto is only supported by the Deployment kind with the RollingUpdate or Canary strategy.")
+	}
+	if st.Type != StrategyCanary {
+		if st.Canary != nil {
+			return fmt.Errorf("strategy canary is only supported by the Canary type.")
+		}
+		return nil
+	}
+	if st.Canary == nil || len(st.Canary.Steps) == 0 {
+		return fmt.Errorf("strategy canary.steps is required by the Canary type.")
+	}
+	if r.Spec.Workload.Kind != "" && r.Spec.Workload.Kind != WorkloadDeployment {
+		return fmt.Errorf("the Canary strategy is only supported by the Deployment kind.")
+	}
+	if !(r.Spec.Ingress.Enabled && r.Spec.Exposure.Mode != ExposureGatewayAPI) && !r.Spec.Exposure.GatewayAPIEnabled() {
+		return fmt.Errorf("the Canary strategy shifts traffic through the Ingress or the Gateway API routes, enable one of them.")
+	}
+	var last int32
+	for i, step := range st.Canary.Steps {
+		if step.Weight <= last {
+			return fmt.Errorf("strategy canary step %d weight %d must be greater than the previous step.", i+1, step.Weight)
+		}
+		last = step.Weight
+	}
+	return nil
+}
+
+// validateMetric 检查 metric 的 type 和对应的 source 是否匹配，其余字段交给 apiserver 校验 HPA 时处理
+func validateMetric(m autoscalingv2.MetricSpec) error {
+	var set bool
+	switch m.Type {
+	case autoscalingv2.ResourceMetricSourceType:
+		set = m.Resource != nil
+	case autoscalingv2.ContainerResourceMetricSourceType:
+		set = m.ContainerResource != nil
+	case autoscalingv2.PodsMetricSourceType:
+		set = m.Pods != nil
+	case autoscalingv2.ObjectMetricSourceType:
+		set = m.Object != nil
+	case autoscalingv2.ExternalMetricSourceType:
+		set = m.External != nil
+	default:
+		return fmt.Errorf("unknown metric type %q", m.Type)
+	}
+	if !set {
+		return fmt.Errorf("metric type %s requires the matching source to be set", m.Type)
+	}
+	return nil
+}
+
+// autoscalingWarnings 按资源利用率扩缩容需要容器设置对应的 requests，否则 HPA 永远算不出指标
+func (r *App) autoscalingWarnings() admission.Warnings {
+	var warnings admission.Warnings
+	for _, m := range r.Spec.HPAMetrics() {
+		if m.Type != autoscalingv2.ResourceMetricSourceType || m.Resource == nil ||
+			m.Resource.Target.Type != autoscalingv2.UtilizationMetricType {
+			continue
+		}
+		if _, ok := r.Spec.Deployment.Resources.Requests[m.Resource.Name]; !ok {
+			warnings = append(warnings, fmt.Sprintf("autoscaling targets %s utilization but deployment.resources.requests.%s is not set, the HPA cannot compute this metric.", m.Resource.Name, m.Resource.Name))
+		}
+	}
+	return warnings
+}
+
+func (r *App) validateWorkload() error {
+	w := r.Spec.Workload
+	if w.Kind == WorkloadCronJob {
+		if w.Schedule == "" {
+			return fmt.Errorf("workload schedule is required by the CronJob kind.")
+		}
+		if _, err := cron.ParseStandard(w.Schedule); err != nil {
+			return fmt.Errorf("workload schedule %q is invalid: %v", w.Schedule, err)
+		}
+	} else if w.Schedule != "" || w.TimeZone != nil || w.ConcurrencyPolicy != "" || w.SuccessfulJobsHistoryLimit != nil || w.FailedJobsHistoryLimit != nil {
+		return fmt.Errorf("workload schedule, timeZone, concurrencyPolicy and history limits are only supported by the CronJob kind.")
+	}
+	if w.BackoffLimit != nil && !w.IsBatch() {
+		return fmt.Errorf("workload backoffLimit is only supported by the Job and CronJob kinds.")
+	}
+	if !w.IsStatefulSet() {
+		if len(w.VolumeClaimTemplates) > 0 || w.PodManagementPolicy != "" || w.Partition != nil {
+			return fmt.Errorf("workload volumeClaimTemplates, podManagementPolicy and partition are only supported by the StatefulSet kind.")
+		}
+		return nil
+	}
+	names := map[string]bool{}
+	for _, v := range w.VolumeClaimTemplates {
+		if names[v.Name] {
+			return fmt.Errorf("volumeClaimTemplate name %q is duplicated.", v.Name)
+		}
+		names[v.Name] = true
+	}
+	return nil
+}
+
+// validateOverrides 检查 patch 的格式，能不能应用到渲染出来的子资源上由 appValidator 的 dryRun 检查
+func (r *App) validateOverrides() error {
+	for i, o := range r.Spec.Overrides {
+		var patch interface{}
+		if err := yaml.Unmarshal([]byte(o.Patch), &patch); err != nil {
+			return fmt.Errorf("overrides[%d] patch is not valid YAML: %v", i, err)
+		}
+		switch o.TypeOrDefault() {
+		case OverrideStrategicMerge:
+			if _, ok := patch.(map[string]interface{}); !ok {
+				return fmt.Errorf("overrides[%d] patch must be an object for the StrategicMerge type.", i)
+			}
+		case OverrideJSON6902:
+			if _, ok := patch.([]interface{}); !ok {
+				return fmt.Errorf("overrides[%d] patch must be a list of operations for the JSON6902 type.", i)
+			}
+		default:
+			return fmt.Errorf("overrides[%d] type %q is not supported.", i, o.Type)
+		}
+		if f := o.ForbiddenField(); f != "" {
+			return fmt.Errorf("overrides[%d] patch must not set %s, overrides cannot give the pods access to the node.", i, f)
+		}
+	}
+	return nil
+}
+
+// forbiddenOverrideFields are the pod settings that give the pods access to the node.
+// The App cannot set them and neither can its overrides, capabilities may still be dropped.
+var forbiddenOverrideFields = map[string]bool{
+	"privileged":  true,
+	"hostPath":    true,
+	"hostNetwork": true,
+	"hostPID":     true,
+	"hostIPC":     true,
+}
+
+// ForbiddenField returns the first field set by the patch that overrides must not set, or an empty string.
+// The controller checks it again before applying the patch, a patch that cannot be parsed has no forbidden field.
+func (o ChildOverride) ForbiddenField() string {
+	var patch interface{}
+	if err := yaml.Unmarshal([]byte(o.Patch), &patch); err != nil {
+		return ""
+	}
+	if o.TypeOrDefault() != OverrideJSON6902 {
+		return forbiddenField(nil, patch)
+	}
+	ops, _ := patch.([]interface{})
+	for _, op := range ops {
+		opMap, _ := op.(map[string]interface{})
+		pointer, _ := opMap["path"].(string)
+		var path []string
+		for _, segment := range strings.Split(strings.TrimPrefix(pointer, "/"), "/") {
+			path = append(path, strings.NewReplacer("~1", "/", "~0", "~").Replace(segment))
+			if f := forbiddenField(path, nil); f != "" {
+				return f
+			}
+		}
+		if f := forbiddenField(path, opMap["value"]); f != "" {
+			return f
+		}
+	}
+	return ""
+}
+
+// forbiddenField 检查 path 的最后一个字段和 v 里面的所有字段，返回第一个禁止的字段
+func forbiddenField(path []string, v interface{}) string {
+	if n := len(path); n > 0 && (forbiddenOverrideFields[path[n-1]] || n > 1 && path[n-2] == "capabilities" && path[n-1] == "add") {
+		return strings.Join(path, ".")
+	}
+	switch v := v.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if f := forbiddenField(append(path[:len(path):len(path)], key), v[key]); f != "" {
+				return f
+			}
+		}
+	case []interface{}:
+		for _, item := range v {
+			if f := forbiddenField(path, item); f != "" {
+				return f
+			}
+		}
+	}
+	return ""
+}
+
+// validateWorkloadUpdate StatefulSet 的 volumeClaimTemplates 和 podManagementPolicy 创建后不能修改，提前拒绝，避免协调时一直失败
+func (r *App) validateWorkloadUpdate(old *App) error {
+	if !r.Spec.Workload.IsStatefulSet() || !old.Spec.Workload.IsStatefulSet() {
+		return nil
+	}
+	if !equality.Semantic.DeepEqual(r.Spec.Workload.VolumeClaimTemplates, old.Spec.Workload.VolumeClaimTemplates) {
+		return fmt.Errorf("workload volumeClaimTemplates cannot be changed once the StatefulSet is created.")
+	}
+	if r.Spec.Workload.PodManagementPolicy != old.Spec.Workload.PodManagementPolicy {
+		return fmt.Errorf("workload podManagementPolicy cannot be changed once the StatefulSet is created.")
+	}
+	return nil
+}
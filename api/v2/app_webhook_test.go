@@ -0,0 +1,367 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v2
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	netv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var _ = Describe("App Webhook", func() {
+	ctx := context.Background()
+	validator := &appValidator{dryRun: func(context.Context, *App) error { return nil }}
+
+	Context("When creating App under Defaulting Webhook", func() {
+		It("Should fill in the default value if a required field is empty", func() {
+			app := &App{Spec: AppSpec{
+				Deployment: AppDeploymentSpec{Image: "nginx"},
+				Service:    AppServiceSpec{Ports: []ServicePort{{Port: 80}}},
+			}}
+			app.Default()
+			Expect(app.Spec.Deployment.Replicas).NotTo(BeNil())
+			Expect(*app.Spec.Deployment.Replicas).To(Equal(int32(1)))
+			Expect(app.Spec.Service.Ports[0].Name).To(Equal(DefaultPortName))
+		})
+
+		It("Should keep existing annotations", func() {
+			app := &App{}
+			app.Annotations = map[string]string{"team": "web"}
+			app.Default()
+			Expect(app.Annotations).To(HaveKeyWithValue("team", "web"))
+		})
+	})
+
+	Context("When creating App under Validating Webhook", func() {
+		It("Should deny if a required field is empty", func() {
+			app := &App{Spec: AppSpec{Deployment: AppDeploymentSpec{Image: "nginx"}}}
+			_, err := validator.ValidateCreate(ctx, app)
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("Should deny duplicated or unnamed ports", func() {
+			app := &App{Spec: AppSpec{Service: AppServiceSpec{Ports: []ServicePort{{Name: "http", Port: 80}, {Port: 9090}}}}}
+			_, err := validator.ValidateCreate(ctx, app)
+			Expect(err).To(HaveOccurred())
+
+			app.Spec.Service.Ports[1].Name = "http"
+			_, err = validator.ValidateCreate(ctx, app)
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("Should deny ingress together with a node port", func() {
+			app := &App{Spec: AppSpec{
+				Service: AppServiceSpec{Ports: []ServicePort{{Port: 80, NodePort: 30080}}},
+				Ingress: AppIngressSpec{Enabled: true},
+			}}
+			_, err := validator.ValidateCreate(ctx, app)
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("Should deny service settings the type does not support", func() {
+			disabled := false
+			app := &App{Spec: AppSpec{
+				Deployment:  AppDeploymentSpec{Image: "dns"},
+				Service:     AppServiceSpec{Type: ServiceTypeClusterIP, Ports: []ServicePort{{Name: "dns", Port: 53, Protocol: corev1.ProtocolUDP, NodePort: 30053}}},
+				Autoscaling: &AppAutoscalingSpec{Enabled: &disabled},
+			}}
+			_, err := validator.ValidateCreate(ctx, app)
+			Expect(err).To(HaveOccurred())
+
+			app.Spec.Service.Type = ServiceTypeLoadBalancer
+			app.Spec.Service.ExternalTrafficPolicy = corev1.ServiceExternalTrafficPolicyLocal
+			_, err = validator.ValidateCreate(ctx, app)
+			Expect(err).NotTo(HaveOccurred())
+
+			// 同一个端口号可以同时暴露 TCP 和 UDP
+			app.Spec.Service.Ports = append(app.Spec.Service.Ports, ServicePort{Name: "dns-tcp", Port: 53})
+			_, err = validator.ValidateCreate(ctx, app)
+			Expect(err).NotTo(HaveOccurred())
+
+			app.Spec.Service.Type = ServiceTypeHeadless
+			app.Spec.Service.Ports[0].NodePort = 0
+			_, err = validator.ValidateCreate(ctx, app)
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("Should deny ingress rules that route to an unknown port", func() {
+			app := &App{Spec: AppSpec{
+				Deployment: AppDeploymentSpec{Image: "nginx", Resources: corev1.ResourceRequirements{Requests: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("100m")}}},
+				Service:    AppServiceSpec{Ports: []ServicePort{{Name: "http", Port: 80}, {Name: "metrics", Port: 9090}}},
+				Ingress: AppIngressSpec{Enabled: true, Rules: []IngressRule{
+					{Host: "aloys.tech", Paths: []IngressPath{{Path: "/"}, {Path: "/metrics", Port: "prometheus"}}},
+				}},
+			}}
+			_, err := validator.ValidateCreate(ctx, app)
+			Expect(err).To(HaveOccurred())
+
+			app.Spec.Ingress.Rules[0].Paths[1].Port = "metrics"
+			_, err = validator.ValidateCreate(ctx, app)
+			Expect(err).NotTo(HaveOccurred())
+
+			app.Spec.Ingress.CertManager = &IngressCertManager{ClusterIssuer: "letsencrypt"}
+			_, err = validator.ValidateCreate(ctx, app)
+			Expect(err).To(HaveOccurred())
+
+			app.Spec.Ingress.TLS = []netv1.IngressTLS{{Hosts: []string{"aloys.tech"}, SecretName: "aloys-tech-tls"}}
+			_, err = validator.ValidateCreate(ctx, app)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("Should require a parent gateway in the gatewayAPI mode", func() {
+			disabled := false
+			app := &App{Spec: AppSpec{
+				Deployment:  AppDeploymentSpec{Image: "nginx"},
+				Service:     AppServiceSpec{Ports: []ServicePort{{Name: "http", Port: 80}}},
+				Autoscaling: &AppAutoscalingSpec{Enabled: &disabled},
+				Exposure:    AppExposureSpec{Mode: ExposureGatewayAPI},
+			}}
+			_, err := validator.ValidateCreate(ctx, app)
+			Expect(err).To(HaveOccurred())
+
+			app.Spec.Exposure.Gateway = &AppGatewaySpec{
+				ParentRefs: []GatewayParentRef{{Name: "public", Namespace: "gateway"}},
+				Rules:      []HTTPRouteRule{{Backends: []RouteBackend{{Port: 8080}}}},
+			}
+			_, err = validator.ValidateCreate(ctx, app)
+			Expect(err).To(HaveOccurred())
+
+			app.Spec.Exposure.Gateway.Rules[0].Backends[0].Port = 80
+			app.Spec.Ingress.Enabled = true
+			warnings, err := validator.ValidateCreate(ctx, app)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(warnings).To(HaveLen(1))
+		})
+
+		It("Should require increasing canary weights and a way to shift traffic", func() {
+			disabled := false
+			app := &App{Spec: AppSpec{
+				Deployment:  AppDeploymentSpec{Image: "nginx"},
+				Service:     AppServiceSpec{Ports: []ServicePort{{Name: "http", Port: 80}}},
+				Autoscaling: &AppAutoscalingSpec{Enabled: &disabled},
+				Strategy: AppStrategySpec{Type: StrategyCanary, Canary: &CanaryStrategy{Steps: []CanaryStep{
+					{Weight: 10, Pause: &metav1.Duration{Duration: time.Minute}}, {Weight: 50},
+				}}},
+			}}
+			_, err := validator.ValidateCreate(ctx, app)
+			Expect(err).To(HaveOccurred())
+
+			app.Spec.Ingress.Enabled = true
+			_, err = validator.ValidateCreate(ctx, app)
+			Expect(err).NotTo(HaveOccurred())
+
+			app.Spec.Strategy.Canary.Steps[1].Weight = 10
+			_, err = validator.ValidateCreate(ctx, app)
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("Should limit the blue/green strategy to Deployments", func() {
+			disabled := false
+			app := &App{Spec: AppSpec{
+				Deployment:  AppDeploymentSpec{Image: "nginx"},
+				Service:     AppServiceSpec{Ports: []ServicePort{{Name: "http", Port: 80}}},
+				Autoscaling: &AppAutoscalingSpec{Enabled: &disabled},
+				Strategy:    AppStrategySpec{Type: StrategyBlueGreen, BlueGreen: &BlueGreenStrategy{AutoPromotion: true}},
+			}}
+			_, err := validator.ValidateCreate(ctx, app)
+			Expect(err).NotTo(HaveOccurred())
+
+			app.Spec.Workload.Kind = WorkloadStatefulSet
+			_, err = validator.ValidateCreate(ctx, app)
+			Expect(err).To(HaveOccurred())
+
+			app.Spec.Workload.Kind = WorkloadDeployment
+			app.Spec.Strategy.Type = StrategyRollingUpdate
+			_, err = validator.ValidateCreate(ctx, app)
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("Should limit automatic rollback to rolling Deployments", func() {
+			disabled := false
+			app := &App{Spec: AppSpec{
+				Deployment:  AppDeploymentSpec{Image: "nginx"},
+				Service:     AppServiceSpec{Ports: []ServicePort{{Name: "http", Port: 80}}},
+				Autoscaling: &AppAutoscalingSpec{Enabled: &disabled},
+				Rollback:    &AppRollbackSpec{Auto: true},
+			}}
+			_, err := validator.ValidateCreate(ctx, app)
+			Expect(err).NotTo(HaveOccurred())
+
+			app.Spec.Strategy.Type = StrategyBlueGreen
+			_, err = validator.ValidateCreate(ctx, app)
+			Expect(err).To(HaveOccurred())
+
+			app.Spec.Strategy.Type = StrategyRollingUpdate
+			app.Spec.Workload.Kind = WorkloadStatefulSet
+			_, err = validator.ValidateCreate(ctx, app)
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("Should not block updates of an App that is being deleted", func() {
+			old := &App{Spec: AppSpec{Deployment: AppDeploymentSpec{Image: "nginx"}}}
+			app := old.DeepCopy()
+			app.Spec.Service.Ports = []ServicePort{{Name: "http", Port: 80}, {Name: "http", Port: 81}}
+			_, err := validator.ValidateUpdate(ctx, old, app)
+			Expect(err).To(HaveOccurred())
+
+			now := metav1.Now()
+			app.DeletionTimestamp = &now
+			_, err = validator.ValidateUpdate(ctx, old, app)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("Should deny autoscaling with minReplicas greater than maxReplicas", func() {
+			min, max := int32(5), int32(3)
+			app := &App{Spec: AppSpec{
+				Service:     AppServiceSpec{Ports: []ServicePort{{Port: 80}}},
+				Autoscaling: &AppAutoscalingSpec{MinReplicas: &min, MaxReplicas: &max},
+			}}
+			_, err := validator.ValidateCreate(ctx, app)
+			Expect(err).To(HaveOccurred())
+
+			disabled := false
+			app.Spec.Autoscaling.Enabled = &disabled
+			_, err = validator.ValidateCreate(ctx, app)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("Should warn when autoscaling is on without CPU requests", func() {
+			app := &App{Spec: AppSpec{
+				Deployment: AppDeploymentSpec{Image: "nginx"},
+				Service:    AppServiceSpec{Ports: []ServicePort{{Port: 80}}},
+			}}
+			warnings, err := validator.ValidateCreate(ctx, app)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(warnings).To(HaveLen(1))
+
+			app.Spec.Deployment.Resources.Requests = corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("100m")}
+			warnings, err = validator.ValidateCreate(ctx, app)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(warnings).To(BeEmpty())
+		})
+
+		It("Should deny volume claims on a Deployment and changes to them on a StatefulSet", func() {
+			claim := VolumeClaimTemplate{Name: "data", MountPath: "/data"}
+			app := &App{Spec: AppSpec{
+				Deployment: AppDeploymentSpec{Image: "nginx", Resources: corev1.ResourceRequirements{Requests: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("100m")}}},
+				Service:    AppServiceSpec{Ports: []ServicePort{{Port: 80}}},
+				Workload:   AppWorkloadSpec{VolumeClaimTemplates: []VolumeClaimTemplate{claim}},
+			}}
+			_, err := validator.ValidateCreate(ctx, app)
+			Expect(err).To(HaveOccurred())
+
+			app.Spec.Workload.Kind = WorkloadStatefulSet
+			_, err = validator.ValidateCreate(ctx, app)
+			Expect(err).NotTo(HaveOccurred())
+
+			updated := app.DeepCopy()
+			updated.Spec.Workload.VolumeClaimTemplates[0].MountPath = "/var/data"
+			_, err = validator.ValidateUpdate(ctx, app, updated)
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("Should require a valid schedule for the CronJob kind", func() {
+			app := &App{Spec: AppSpec{
+				Deployment: AppDeploymentSpec{Image: "busybox"},
+				Workload:   AppWorkloadSpec{Kind: WorkloadCronJob},
+			}}
+			_, err := validator.ValidateCreate(ctx, app)
+			Expect(err).To(HaveOccurred())
+
+			app.Spec.Workload.Schedule = "every night"
+			_, err = validator.ValidateCreate(ctx, app)
+			Expect(err).To(HaveOccurred())
+
+			app.Spec.Workload.Schedule = "0 2 * * *"
+			_, err = validator.ValidateCreate(ctx, app)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("Should deny overrides that are not a patch of their type", func() {
+			app := &App{Spec: AppSpec{
+				Deployment: AppDeploymentSpec{Image: "nginx"},
+				Overrides:  []ChildOverride{{Kind: "Deployment", Patch: "- op: add"}},
+			}}
+			_, err := validator.ValidateCreate(ctx, app)
+			Expect(err).To(HaveOccurred())
+
+			app.Spec.Overrides[0].Type = OverrideJSON6902
+			_, err = validator.ValidateCreate(ctx, app)
+			Expect(err).NotTo(HaveOccurred())
+
+			app.Spec.Overrides[0].Patch = "metadata: ["
+			_, err = validator.ValidateCreate(ctx, app)
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("Should deny overrides that give the pods access to the node", func() {
+			app := &App{Spec: AppSpec{Deployment: AppDeploymentSpec{Image: "nginx"}}}
+			for _, o := range []ChildOverride{
+				{Kind: "Deployment", Patch: "spec:\n  template:\n    spec:\n      containers:\n      - name: app\n        securityContext:\n          privileged: true\n"},
+				{Kind: "Deployment", Type: OverrideJSON6902, Patch: `[{"op": "add", "path": "/spec/template/spec/hostNetwork", "value": true}]`},
+				{Kind: "StatefulSet", Type: OverrideJSON6902, Patch: `[{"op": "add", "path": "/spec/template/spec/volumes/-", "value": {"name": "root", "hostPath": {"path": "/"}}}]`},
+				{Kind: "Job", Type: OverrideJSON6902, Patch: `[{"op": "add", "path": "/spec/template/spec/containers/0/securityContext/capabilities/add", "value": ["SYS_ADMIN"]}]`},
+			} {
+				app.Spec.Overrides = []ChildOverride{o}
+				_, err := validator.ValidateCreate(ctx, app)
+				Expect(err).To(MatchError(ContainSubstring("overrides cannot give the pods access to the node")), o.Patch)
+			}
+
+			By("allowing capabilities to be dropped")
+			app.Spec.Overrides = []ChildOverride{{Kind: "Deployment", Patch: "spec:\n  template:\n    spec:\n      containers:\n      - name: app\n        securityContext:\n          capabilities:\n            drop: [ALL]\n"}}
+			_, err := validator.ValidateCreate(ctx, app)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("Should deny overrides the dry-run cannot apply", func() {
+			validator := &appValidator{dryRun: func(context.Context, *App) error {
+				return fmt.Errorf("spec.overrides[0] cannot be applied to the Service")
+			}}
+			app := &App{Spec: AppSpec{
+				Deployment: AppDeploymentSpec{Image: "nginx"},
+				Overrides:  []ChildOverride{{Kind: "Service", Patch: "metadata:\n  name: other\n"}},
+			}}
+			_, err := validator.ValidateCreate(ctx, app)
+			Expect(err).To(MatchError(ContainSubstring("overrides cannot be applied")))
+
+			By("denying the overrides when there is no dry-run")
+			_, err = (&appValidator{}).ValidateCreate(ctx, app)
+			Expect(err).To(MatchError(ContainSubstring("overrides cannot be checked")))
+			app.Spec.Overrides = nil
+			_, err = (&appValidator{}).ValidateCreate(ctx, app)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("Should admit if all required fields are provided", func() {
+			app := &App{Spec: AppSpec{
+				Deployment: AppDeploymentSpec{Image: "nginx"},
+				Service:    AppServiceSpec{Ports: []ServicePort{{Name: "http", Port: 80}, {Name: "metrics", Port: 9090}}},
+				Ingress:    AppIngressSpec{Enabled: true, Host: "aloys.tech", Path: "/"},
+			}}
+			_, err := validator.ValidateCreate(ctx, app)
+			Expect(err).NotTo(HaveOccurred())
+		})
+	})
+
+})
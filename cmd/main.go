@@ -35,6 +35,7 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/webhook"
 
 	aloystechv1 "aloys.tech/api/v1"
+	aloystechv2 "aloys.tech/api/v2"
 	"aloys.tech/internal/controller"
 	// +kubebuilder:scaffold:imports
 )
@@ -51,6 +52,7 @@ func init() {
 	utilruntime.Must(clientgoscheme.AddToScheme(scheme))
 	// Scheme 绑定自建 CRD
 	utilruntime.Must(aloystechv1.AddToScheme(scheme))
+	utilruntime.Must(aloystechv2.AddToScheme(scheme))
 	// +kubebuilder:scaffold:scheme
 }
 
@@ -60,6 +62,8 @@ func main() {
 	var probeAddr string
 	var secureMetrics bool
 	var enableHTTP2 bool
+	var templateNamespace string
+	var defaultTopologySpread bool
 	flag.StringVar(&metricsAddr, "metrics-bind-address", ":8080", "The address the metric endpoint binds to.")
 	flag.StringVar(&probeAddr, "health-probe-bind-address", ":8081", "The address the probe endpoint binds to.")
 	flag.BoolVar(&enableLeaderElection, "leader-elect", false,
@@ -69,6 +73,13 @@ func main() {
 		"If set the metrics endpoint is served securely")
 	flag.BoolVar(&enableHTTP2, "enable-http2", false,
 		"If set, HTTP/2 will be enabled for the metrics and webhook servers")
+	flag.StringVar(&templateNamespace, "template-namespace", os.Getenv("POD_NAMESPACE"),
+		"The namespace whose app-templates ConfigMap overrides the templates for the whole cluster. "+
+			"Its aloys.tech/template-namespaces annotation lists the namespaces allowed to override them with their own app-templates ConfigMap. "+
+			"If empty, the builtin templates are used and the app-templates ConfigMaps of the namespaces are ignored.")
+	flag.BoolVar(&defaultTopologySpread, "default-topology-spread", false,
+		"If set, the replicas of Apps without topologySpreadConstraints are spread across zones and hostnames. "+
+			"An App overrides it with spec.deployment.defaultTopologySpread.")
 
 	opts := zap.Options{
 		Development: true,
@@ -138,16 +149,26 @@ func main() {
 		Scheme: mgr.GetScheme(),
 		// 初始化事件方法
 		Eventer: mgr.GetEventRecorderFor("app-controller"),
+		// 集群级别的 app-templates ConfigMap 所在的命名空间，ConfigMap 通过 manager 的缓存读取
+		Templates: &controller.TemplateLoader{Reader: mgr.GetClient(), Namespace: templateNamespace},
+		// 没有配置 topology spread 的 App 默认按可用区和节点打散副本
+		DefaultTopologySpread: defaultTopologySpread,
 		// 并且调用 SetupWithManager 方法传入 Manager 进行 Controller 的初始化
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "App")
 		os.Exit(1)
 	}
 	if os.Getenv("ENABLE_WEBHOOKS") != "false" {
+		// webhook 用自己的 loader 读取模板试着应用 spec.overrides，不依赖 controller 是否已经协调过，应用不了的 App 直接拒绝
+		templates := &controller.TemplateLoader{Reader: mgr.GetClient(), Namespace: templateNamespace}
 		if err = (&aloystechv1.App{}).SetupWebhookWithManager(mgr); err != nil {
 			setupLog.Error(err, "unable to create webhook", "webhook", "App")
 			os.Exit(1)
 		}
+		if err = (&aloystechv2.App{}).SetupWebhookWithManager(mgr, templates.DryRunOverrides); err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", "App")
+			os.Exit(1)
+		}
 	}
 	// +kubebuilder:scaffold:builder
 
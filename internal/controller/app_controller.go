@@ -22,19 +22,23 @@ import (
 	"reflect"
 	"time"
 
-	aloystechv1 "aloys.tech/api/v1"
+	aloystechv2 "aloys.tech/api/v2"
 	appsv1 "k8s.io/api/apps/v1"
 	autoscalingv2 "k8s.io/api/autoscaling/v2"
+	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
 	netv1 "k8s.io/api/networking/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/types"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/controller"
 	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/log"
 	"sigs.k8s.io/controller-runtime/pkg/predicate"
 )
@@ -53,6 +57,16 @@ type AppReconciler struct {
 	client.Client
 	Eventer record.EventRecorder
 	Scheme  *runtime.Scheme
+
+	// Templates 加载渲染子资源的模板，为 nil 时只使用内置模板
+	Templates *TemplateLoader
+	// DefaultTopologySpread 为没有配置 topologySpreadConstraints 的 Deployment 和 StatefulSet 默认按可用区和节点打散副本，
+	// App 设置了 spec.deployment.defaultTopologySpread 时以 App 的为准
+	DefaultTopologySpread bool
+
+	// 集群里发现的 Gateway API 路由版本，为 nil 表示没有安装对应的 CRD
+	httpRouteGVK *schema.GroupVersionKind
+	grpcRouteGVK *schema.GroupVersionKind
 }
 
 // +kubebuilder:rbac:groups=aloys.tech.aloys.tech,resources=apps,verbs=get;list;watch;create;update;patch;delete
@@ -60,13 +74,21 @@ type AppReconciler struct {
 // +kubebuilder:rbac:groups=aloys.tech.aloys.tech,resources=apps/finalizers,verbs=update
 // +kubebuilder:rbac:groups=apps,resources=deployments,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=apps,resources=deployments/status,verbs=get;update
+// +kubebuilder:rbac:groups=apps,resources=replicasets,verbs=get;list;watch
+// +kubebuilder:rbac:groups=apps,resources=controllerrevisions,verbs=get;list;watch;create;delete
+// +kubebuilder:rbac:groups=apps,resources=statefulsets,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=batch,resources=jobs,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=batch,resources=cronjobs,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=core,resources=services,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=core,resources=services/status,verbs=get;update
 // +kubebuilder:rbac:groups=networking.k8s.io,resources=ingresses,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=networking.k8s.io,resources=ingresses/status,verbs=get;update
+// +kubebuilder:rbac:groups=gateway.networking.k8s.io,resources=httproutes;grpcroutes,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=autoscaling,resources=horizontalpodautoscalers,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=autoscaling,resources=horizontalpodautoscalers/status,verbs=get;update
 // +kubebuilder:rbac:groups=core,resources=events,verbs=create;patch
+// +kubebuilder:rbac:groups=core,resources=configmaps,verbs=get;list;watch
+// +kubebuilder:rbac:groups=core,resources=secrets,verbs=get;list;watch
 
 // Reconcile is part of the main kubernetes reconciliation loop which aims to
 // move the current state of the cluster closer to the desired state.
@@ -88,7 +110,7 @@ func (r *AppReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.R
 	logger := log.FromContext(ctx)
 
 	// 声明一个app实例来接受cr
-	app := &aloystechv1.App{}
+	app := &aloystechv2.App{}
 	if err := r.Get(ctx, req.NamespacedName, app); err != nil {
 		// 找不到的错误不需要特殊处理，cr被删除，直接结束本次调用
 		if errors.IsNotFound(err) {
@@ -101,33 +123,150 @@ func (r *AppReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.R
 		return ctrl.Result{RequeueAfter: GenericRequeueDuration}, err
 	}
 
+	// 子资源和 pre-delete hook 都按 app-templates 覆盖之后的模板渲染
+	if err := r.loadTemplates(ctx, app); err != nil {
+		logger.Error(err, "Failed to load the templates,will requeue after a short time.")
+		return ctrl.Result{RequeueAfter: GenericRequeueDuration}, err
+	}
+
+	// App 正在被删除，运行 hook 并按 deletionPolicy 处理子资源，不再协调
+	if !app.DeletionTimestamp.IsZero() {
+		return r.finalize(ctx, app)
+	}
+	if err := r.ensureFinalizer(ctx, app); err != nil {
+		logger.Error(err, "Failed to add the finalizer,will requeue after a short time.")
+		return ctrl.Result{RequeueAfter: GenericRequeueDuration}, err
+	}
+
+	// rollback-to 注解会修改 spec，先处理它再按新的 spec 协调子资源
+	if err := r.restoreRevision(ctx, app); err != nil {
+		logger.Error(err, "Failed to restore the revision,will requeue after a short time.")
+		return ctrl.Result{RequeueAfter: GenericRequeueDuration}, err
+	}
+
+	// 记录协调前的 status，四个子资源协调完之后统一汇总，只写回一次
+	oldStatus := app.Status.DeepCopy()
 	var result ctrl.Result
 	var err error
-	result, err = r.reconcileDeployment(ctx, app)
+	var renderFailed bool
+	if app.Spec.Suspend {
+		// 暂停期间不创建、修改或删除任何子资源，只把子资源的当前状态刷新到 status
+		if err = r.observeChildren(ctx, app); err != nil {
+			logger.Error(err, "Failed to observe the children of the suspended app,will requeue after a short time.")
+			result = ctrl.Result{RequeueAfter: GenericRequeueDuration}
+		}
+	} else {
+		result, err = r.reconcileChildren(ctx, app)
+		renderFailed = r.observeRenderFailed(app, err)
+		observeOverrides(app, err)
+	}
+	observeSuspended(app)
+	// requestedAt 注解的值处理完之后回写到 status，用户据此判断这次协调是否已经完成
+	if value, ok := app.Annotations[aloystechv2.RequestedAtAnnotation]; ok && err == nil {
+		app.Status.LastHandledReconcileAt = value
+	}
+	// 渲染失败已经记录在 condition 和事件上，不返回错误，避免按指数退避反复重试，spec 或模板修改之后会重新协调
+	if renderFailed {
+		err = nil
+	}
+	if statusErr := r.updateStatus(ctx, app, oldStatus); statusErr != nil {
+		logger.Error(statusErr, "Failed to update the app status,will requeue after a short time.")
+		if err == nil {
+			return ctrl.Result{RequeueAfter: GenericRequeueDuration}, statusErr
+		}
+	}
+	if err != nil {
+		return result, err
+	}
+	if renderFailed {
+		return ctrl.Result{}, nil
+	}
+	if app.Spec.Suspend {
+		logger.Info("The app is suspended, only the status has been refreshed.")
+		return ctrl.Result{RequeueAfter: GenericRequeueDuration * 5}, nil
+	}
+	r.Eventer.Eventf(app, corev1.EventTypeNormal, "App", "%s All reconcile have been reconciled. namespace: %s", app.Name, app.Namespace)
+	logger.Info("All reconcile have been reconciled.")
+	// 设置一个定时同步，子资源要求更早重新协调的时候以子资源为准
+	if result.RequeueAfter > 0 && result.RequeueAfter < GenericRequeueDuration*5 {
+		return result, nil
+	}
+	return ctrl.Result{RequeueAfter: GenericRequeueDuration * 5}, nil
+	// return ctrl.Result{}, nil
+}
+
+// reconcileChildren 依次协调各个子资源，失败的子资源会在对应的 condition 上记录原因
+func (r *AppReconciler) reconcileChildren(ctx context.Context, app *aloystechv2.App) (ctrl.Result, error) {
+	logger := log.FromContext(ctx)
+
+	result, err := r.reconcileDeployment(ctx, app)
 	if err != nil {
 		logger.Error(err, "Failed to reconcile Deployment.")
+		setReconcileFailed(app, aloystechv2.ConditionDeploymentAvailable, err)
+		return result, err
+	}
+	// canary 需要在暂停结束时继续推进
+	requeue := result
+	result, err = r.reconcileStatefulSet(ctx, app)
+	if err != nil {
+		logger.Error(err, "Failed to reconcile StatefulSet.")
+		setReconcileFailed(app, aloystechv2.ConditionStatefulSetAvailable, err)
+		return result, err
+	}
+	result, err = r.reconcileJob(ctx, app)
+	if err != nil {
+		logger.Error(err, "Failed to reconcile Job.")
+		setReconcileFailed(app, aloystechv2.ConditionJobSucceeded, err)
 		return result, err
 	}
+	// Job 删除旧的之后需要等一会儿再重建，CronJob 需要在下次调度时间刷新 status
+	requeue = earlierRequeue(requeue, result)
+	result, err = r.reconcileCronJob(ctx, app)
+	if err != nil {
+		logger.Error(err, "Failed to reconcile CronJob.")
+		setReconcileFailed(app, aloystechv2.ConditionCronJobScheduled, err)
+		return result, err
+	}
+	requeue = earlierRequeue(requeue, result)
+	// 工作负载的 condition 都更新之后再记录版本和发布结果
+	if err := r.recordRevision(ctx, app); err != nil {
+		logger.Error(err, "Failed to record the revision.")
+		setReconcileFailed(app, workloadConditionType(app), err)
+		return ctrl.Result{RequeueAfter: GenericRequeueDuration}, err
+	}
 	result, err = r.reconcileHorizontalPodAutoscaler(ctx, app)
 	if err != nil {
 		logger.Error(err, "Failed to reconcile HorizontalPodAutoscaler.")
+		setReconcileFailed(app, aloystechv2.ConditionAutoscalerActive, err)
 		return result, err
 	}
 	result, err = r.reconcileService(ctx, app)
 	if err != nil {
 		logger.Error(err, "Failed to reconcile Service.")
+		setReconcileFailed(app, aloystechv2.ConditionServiceReady, err)
 		return result, err
 	}
 	result, err = r.reconcileIngress(ctx, app)
 	if err != nil {
 		logger.Error(err, "Failed to reconcile Ingress.")
+		setReconcileFailed(app, aloystechv2.ConditionIngressAdmitted, err)
 		return result, err
 	}
-	r.Eventer.Eventf(app, corev1.EventTypeNormal, "App", "%s All reconcile have been reconciled. namespace: %s", app.Name, app.Namespace)
-	logger.Info("All reconcile have been reconciled.")
-	// 设置一个定时同步
-	return ctrl.Result{RequeueAfter: GenericRequeueDuration * 5}, nil
-	// return ctrl.Result{}, nil
+	result, err = r.reconcileGatewayRoutes(ctx, app)
+	if err != nil {
+		logger.Error(err, "Failed to reconcile Gateway API routes.")
+		setReconcileFailed(app, aloystechv2.ConditionRouteAccepted, err)
+		return result, err
+	}
+	return requeue, nil
+}
+
+// earlierRequeue 返回更早需要重新协调的那个结果，RequeueAfter 为 0 表示不需要
+func earlierRequeue(a, b ctrl.Result) ctrl.Result {
+	if a.RequeueAfter == 0 || (b.RequeueAfter > 0 && b.RequeueAfter < a.RequeueAfter) {
+		return b
+	}
+	return a
 }
 
 // SetupWithManager sets up the controller with the Manager.
@@ -135,11 +274,27 @@ func (r *AppReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.R
 // 在 Controller 初始化的过程中，借助了 Options 参数对象中设计的 Reconciler 对象，并将 其传递给了 Controller 对象的 do 字段。所以当我们调用 SetupWithManager 方法的时候， 不仅完成了 Controller 的初始化，还完成了 Controller 监听资源的注册与发现过程，同时 将 CRD 的必要实现方法(Reconcile 方法)进行了再现
 func (r *AppReconciler) SetupWithManager(mgr ctrl.Manager) error {
 	setupLog := ctrl.Log.WithName("setup")
+	// 建立 ConfigMap/Secret 名字到 App 的索引，配置变化时只需要协调引用了它的 App
+	if err := mgr.GetFieldIndexer().IndexField(context.Background(), &aloystechv2.App{}, configMapIndexKey, func(obj client.Object) []string {
+		return referencedConfigMaps(obj.(*aloystechv2.App))
+	}); err != nil {
+		return err
+	}
+	if err := mgr.GetFieldIndexer().IndexField(context.Background(), &aloystechv2.App{}, secretIndexKey, func(obj client.Object) []string {
+		return referencedSecrets(obj.(*aloystechv2.App))
+	}); err != nil {
+		return err
+	}
+	// Gateway API 的 CRD 是可选的，没有安装的时候不能 watch，否则 controller 启动失败
+	if err := r.discoverGatewayAPI(mgr.GetRESTMapper()); err != nil {
+		return err
+	}
+	recoverPanic := true
 	// NewControllerManagedBy 初始化 Builder 对象 mgr 字段。
-	return ctrl.NewControllerManagedBy(mgr).
+	bldr := ctrl.NewControllerManagedBy(mgr).
 		// Builder 关联 CRD API 定义的 Scheme 信息，从而得知 CRD 的 Controller 需要监听的 CRD 类型、版本等信息
 		// Controller需要监听资源在这里配置 Owns().
-		For(&aloystechv1.App{}, builder.WithPredicates(predicate.Funcs{
+		For(&aloystechv2.App{}, builder.WithPredicates(predicate.Funcs{
 			CreateFunc: func(createEvent event.CreateEvent) bool {
 				return true
 			},
@@ -151,7 +306,17 @@ func (r *AppReconciler) SetupWithManager(mgr ctrl.Manager) error {
 				if updateEvent.ObjectNew.GetResourceVersion() == updateEvent.ObjectOld.GetResourceVersion() {
 					return false
 				}
-				if reflect.DeepEqual(updateEvent.ObjectNew.(*aloystechv1.App).Spec, updateEvent.ObjectOld.(*aloystechv1.App).Spec) {
+				// 有 finalizer 时删除 App 只会设置 deletionTimestamp，需要协调来完成清理
+				if !updateEvent.ObjectNew.GetDeletionTimestamp().IsZero() {
+					return true
+				}
+				// promote/abort、rollback-to、adopt 和 requestedAt 注解只改 metadata，也需要触发协调
+				for _, key := range []string{aloystechv2.RolloutActionAnnotation, aloystechv2.RollbackToAnnotation, aloystechv2.AdoptAnnotation, aloystechv2.RequestedAtAnnotation} {
+					if updateEvent.ObjectNew.GetAnnotations()[key] != updateEvent.ObjectOld.GetAnnotations()[key] {
+						return true
+					}
+				}
+				if reflect.DeepEqual(updateEvent.ObjectNew.(*aloystechv2.App).Spec, updateEvent.ObjectOld.(*aloystechv2.App).Spec) {
 					return false
 				}
 				return true
@@ -169,7 +334,69 @@ func (r *AppReconciler) SetupWithManager(mgr ctrl.Manager) error {
 				if updateEvent.ObjectNew.GetResourceVersion() == updateEvent.ObjectOld.GetResourceVersion() {
 					return false
 				}
-				if reflect.DeepEqual(updateEvent.ObjectNew.(*appsv1.Deployment).Spec, updateEvent.ObjectOld.(*appsv1.Deployment).Spec) {
+				// status 的变化也要触发协调，App 的 condition 依赖子资源的 status
+				oldObj, newObj := updateEvent.ObjectOld.(*appsv1.Deployment), updateEvent.ObjectNew.(*appsv1.Deployment)
+				if reflect.DeepEqual(newObj.Spec, oldObj.Spec) && reflect.DeepEqual(newObj.Status, oldObj.Status) {
+					return false
+				}
+				return true
+			},
+		})).
+		Owns(&appsv1.StatefulSet{}, builder.WithPredicates(predicate.Funcs{
+			CreateFunc: func(createEvent event.CreateEvent) bool {
+				return false
+			},
+			DeleteFunc: func(deleteEvent event.DeleteEvent) bool {
+				setupLog.Info("The StatefulSet has been deleted,", "StatefulSetName", deleteEvent.Object.GetName(), "namespace", deleteEvent.Object.GetNamespace())
+				return true
+			},
+			UpdateFunc: func(updateEvent event.UpdateEvent) bool {
+				if updateEvent.ObjectNew.GetResourceVersion() == updateEvent.ObjectOld.GetResourceVersion() {
+					return false
+				}
+				// status 的变化也要触发协调，App 的 condition 依赖子资源的 status
+				oldObj, newObj := updateEvent.ObjectOld.(*appsv1.StatefulSet), updateEvent.ObjectNew.(*appsv1.StatefulSet)
+				if reflect.DeepEqual(newObj.Spec, oldObj.Spec) && reflect.DeepEqual(newObj.Status, oldObj.Status) {
+					return false
+				}
+				return true
+			},
+		})).
+		Owns(&batchv1.Job{}, builder.WithPredicates(predicate.Funcs{
+			CreateFunc: func(createEvent event.CreateEvent) bool {
+				return false
+			},
+			DeleteFunc: func(deleteEvent event.DeleteEvent) bool {
+				setupLog.Info("The Job has been deleted,", "JobName", deleteEvent.Object.GetName(), "namespace", deleteEvent.Object.GetNamespace())
+				return true
+			},
+			UpdateFunc: func(updateEvent event.UpdateEvent) bool {
+				if updateEvent.ObjectNew.GetResourceVersion() == updateEvent.ObjectOld.GetResourceVersion() {
+					return false
+				}
+				// status 的变化也要触发协调，App 的 condition 依赖子资源的 status
+				oldObj, newObj := updateEvent.ObjectOld.(*batchv1.Job), updateEvent.ObjectNew.(*batchv1.Job)
+				if reflect.DeepEqual(newObj.Spec, oldObj.Spec) && reflect.DeepEqual(newObj.Status, oldObj.Status) {
+					return false
+				}
+				return true
+			},
+		})).
+		Owns(&batchv1.CronJob{}, builder.WithPredicates(predicate.Funcs{
+			CreateFunc: func(createEvent event.CreateEvent) bool {
+				return false
+			},
+			DeleteFunc: func(deleteEvent event.DeleteEvent) bool {
+				setupLog.Info("The CronJob has been deleted,", "CronJobName", deleteEvent.Object.GetName(), "namespace", deleteEvent.Object.GetNamespace())
+				return true
+			},
+			UpdateFunc: func(updateEvent event.UpdateEvent) bool {
+				if updateEvent.ObjectNew.GetResourceVersion() == updateEvent.ObjectOld.GetResourceVersion() {
+					return false
+				}
+				// status 的变化也要触发协调，App 的 condition 依赖子资源的 status
+				oldObj, newObj := updateEvent.ObjectOld.(*batchv1.CronJob), updateEvent.ObjectNew.(*batchv1.CronJob)
+				if reflect.DeepEqual(newObj.Spec, oldObj.Spec) && reflect.DeepEqual(newObj.Status, oldObj.Status) {
 					return false
 				}
 				return true
@@ -187,7 +414,9 @@ func (r *AppReconciler) SetupWithManager(mgr ctrl.Manager) error {
 				if updateEvent.ObjectNew.GetResourceVersion() == updateEvent.ObjectOld.GetResourceVersion() {
 					return false
 				}
-				if reflect.DeepEqual(updateEvent.ObjectNew.(*autoscalingv2.HorizontalPodAutoscaler).Spec, updateEvent.ObjectOld.(*autoscalingv2.HorizontalPodAutoscaler).Spec) {
+				// status 的变化也要触发协调，App 的 condition 依赖子资源的 status
+				oldObj, newObj := updateEvent.ObjectOld.(*autoscalingv2.HorizontalPodAutoscaler), updateEvent.ObjectNew.(*autoscalingv2.HorizontalPodAutoscaler)
+				if reflect.DeepEqual(newObj.Spec, oldObj.Spec) && reflect.DeepEqual(newObj.Status, oldObj.Status) {
 					return false
 				}
 				return true
@@ -205,7 +434,9 @@ func (r *AppReconciler) SetupWithManager(mgr ctrl.Manager) error {
 				if updateEvent.ObjectNew.GetResourceVersion() == updateEvent.ObjectOld.GetResourceVersion() {
 					return false
 				}
-				if reflect.DeepEqual(updateEvent.ObjectNew.(*corev1.Service).Spec, updateEvent.ObjectOld.(*corev1.Service).Spec) {
+				// status 的变化也要触发协调，App 的 condition 依赖子资源的 status
+				oldObj, newObj := updateEvent.ObjectOld.(*corev1.Service), updateEvent.ObjectNew.(*corev1.Service)
+				if reflect.DeepEqual(newObj.Spec, oldObj.Spec) && reflect.DeepEqual(newObj.Status, oldObj.Status) {
 					return false
 				}
 				return true
@@ -223,13 +454,50 @@ func (r *AppReconciler) SetupWithManager(mgr ctrl.Manager) error {
 				if updateEvent.ObjectNew.GetResourceVersion() == updateEvent.ObjectOld.GetResourceVersion() {
 					return false
 				}
-				if reflect.DeepEqual(updateEvent.ObjectNew.(*netv1.Ingress).Spec, updateEvent.ObjectOld.(*netv1.Ingress).Spec) {
+				// status 的变化也要触发协调，App 的 condition 依赖子资源的 status
+				oldObj, newObj := updateEvent.ObjectOld.(*netv1.Ingress), updateEvent.ObjectNew.(*netv1.Ingress)
+				if reflect.DeepEqual(newObj.Spec, oldObj.Spec) && reflect.DeepEqual(newObj.Status, oldObj.Status) {
 					return false
 				}
 				return true
 			},
 		})).
-		WithOptions(controller.Options{MaxConcurrentReconciles: 5}).
+		// ConfigMap/Secret 不归 App 所有，通过索引找到引用它们的 App
+		Watches(&corev1.ConfigMap{}, handler.EnqueueRequestsFromMapFunc(r.appsForConfigMap),
+			builder.WithPredicates(predicate.ResourceVersionChangedPredicate{})).
+		Watches(&corev1.Secret{}, handler.EnqueueRequestsFromMapFunc(r.appsForSecret),
+			builder.WithPredicates(predicate.ResourceVersionChangedPredicate{})).
+		// 协调中的 panic 转成错误重试，不能让一个 App 的问题让整个 manager 退出
+		WithOptions(controller.Options{MaxConcurrentReconciles: 5, RecoverPanic: &recoverPanic})
+	for _, gvk := range []*schema.GroupVersionKind{r.httpRouteGVK, r.grpcRouteGVK} {
+		if gvk == nil {
+			continue
+		}
+		setupLog.Info("Gateway API is installed, watching the routes.", "kind", gvk.Kind, "version", gvk.Version)
+		route := &unstructured.Unstructured{}
+		route.SetGroupVersionKind(*gvk)
+		bldr = bldr.Owns(route, builder.WithPredicates(predicate.Funcs{
+			CreateFunc: func(createEvent event.CreateEvent) bool {
+				return false
+			},
+			DeleteFunc: func(deleteEvent event.DeleteEvent) bool {
+				setupLog.Info("The route has been deleted,", "routeName", deleteEvent.Object.GetName(), "namespace", deleteEvent.Object.GetNamespace())
+				return true
+			},
+			UpdateFunc: func(updateEvent event.UpdateEvent) bool {
+				if updateEvent.ObjectNew.GetResourceVersion() == updateEvent.ObjectOld.GetResourceVersion() {
+					return false
+				}
+				// status 的变化也要触发协调，App 的 condition 依赖子资源的 status
+				oldObj, newObj := updateEvent.ObjectOld.(*unstructured.Unstructured), updateEvent.ObjectNew.(*unstructured.Unstructured)
+				if reflect.DeepEqual(newObj.Object["spec"], oldObj.Object["spec"]) && reflect.DeepEqual(newObj.Object["status"], oldObj.Object["status"]) {
+					return false
+				}
+				return true
+			},
+		}))
+	}
+	return bldr.
 		// WithOptions(controller.Options{ 可以传入Controller初始化参数
 		// 	MaxConcurrentReconciles: 0, // Reconciles 最大并发数
 		// 	CacheSyncTimeout:        0, // 是指设置等待同步缓存的时间限制。默认2分钟
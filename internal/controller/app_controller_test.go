@@ -18,16 +18,29 @@ package controller
 
 import (
 	"context"
+	"io/fs"
+	"strings"
 
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
+	appsv1 "k8s.io/api/apps/v1"
+	autoscalingv2 "k8s.io/api/autoscaling/v2"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	netv1 "k8s.io/api/networking/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
-	aloystechv1 "aloys.tech/api/v1"
+	aloystechv2 "aloys.tech/api/v2"
+	templates "aloys.tech/internal/template"
+	"aloys.tech/internal/utils"
 )
 
 var _ = Describe("App Controller", func() {
@@ -40,18 +53,46 @@ var _ = Describe("App Controller", func() {
 			Name:      resourceName,
 			Namespace: "default", // TODO(user):Modify as needed
 		}
-		app := &aloystechv1.App{}
+		app := &aloystechv2.App{}
+
+		// envtest 里没有 deployment controller，手动把 Deployment 的 status 改成已经滚动完成
+		markRolledOut := func(suffix string) {
+			dp := &appsv1.Deployment{}
+			Expect(k8sClient.Get(ctx, GetNamespacedName(resourceName, suffix, "default"), dp)).To(Succeed())
+			replicas := deploymentReplicas(dp)
+			dp.Status = appsv1.DeploymentStatus{
+				ObservedGeneration: dp.Generation,
+				Replicas:           replicas,
+				UpdatedReplicas:    replicas,
+				ReadyReplicas:      replicas,
+				AvailableReplicas:  replicas,
+			}
+			Expect(k8sClient.Status().Update(ctx, dp)).To(Succeed())
+		}
+		imageOf := func(suffix string) string {
+			dp := &appsv1.Deployment{}
+			Expect(k8sClient.Get(ctx, GetNamespacedName(resourceName, suffix, "default"), dp)).To(Succeed())
+			return dp.Spec.Template.Spec.Containers[0].Image
+		}
+		updateApp := func(mutate func(app *aloystechv2.App)) {
+			Expect(k8sClient.Get(ctx, typeNamespacedName, app)).To(Succeed())
+			mutate(app)
+			Expect(k8sClient.Update(ctx, app)).To(Succeed())
+		}
 
 		BeforeEach(func() {
 			By("creating the custom resource for the Kind App")
 			err := k8sClient.Get(ctx, typeNamespacedName, app)
 			if err != nil && errors.IsNotFound(err) {
-				resource := &aloystechv1.App{
+				resource := &aloystechv2.App{
 					ObjectMeta: metav1.ObjectMeta{
 						Name:      resourceName,
 						Namespace: "default",
 					},
-					// TODO(user): Specify other spec details if needed.
+					Spec: aloystechv2.AppSpec{
+						Deployment: aloystechv2.AppDeploymentSpec{Image: "nginx"},
+						Service:    aloystechv2.AppServiceSpec{Ports: []aloystechv2.ServicePort{{Name: "http", Port: 80}}},
+					},
 				}
 				Expect(k8sClient.Create(ctx, resource)).To(Succeed())
 			}
@@ -59,26 +100,919 @@ var _ = Describe("App Controller", func() {
 
 		AfterEach(func() {
 			// TODO(user): Cleanup logic after each test, like removing the resource instance.
-			resource := &aloystechv1.App{}
+			resource := &aloystechv2.App{}
 			err := k8sClient.Get(ctx, typeNamespacedName, resource)
+			// 测试删除流程的用例自己已经删除了 App
+			if errors.IsNotFound(err) {
+				return
+			}
 			Expect(err).NotTo(HaveOccurred())
 
 			By("Cleanup the specific resource instance App")
 			Expect(k8sClient.Delete(ctx, resource)).To(Succeed())
+
+			// App 带有 finalizer，需要协调几次删除子资源之后才会真正删除
+			controllerReconciler := &AppReconciler{
+				Client:  k8sClient,
+				Scheme:  k8sClient.Scheme(),
+				Eventer: record.NewFakeRecorder(100),
+			}
+			Eventually(func() bool {
+				_, err := controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: typeNamespacedName})
+				Expect(err).NotTo(HaveOccurred())
+				return errors.IsNotFound(k8sClient.Get(ctx, typeNamespacedName, &aloystechv2.App{}))
+			}).Should(BeTrue())
 		})
 		It("should successfully reconcile the resource", func() {
 			By("Reconciling the created resource")
 			controllerReconciler := &AppReconciler{
-				Client: k8sClient,
-				Scheme: k8sClient.Scheme(),
+				Client:  k8sClient,
+				Scheme:  k8sClient.Scheme(),
+				Eventer: record.NewFakeRecorder(100),
 			}
 
 			_, err := controllerReconciler.Reconcile(ctx, reconcile.Request{
 				NamespacedName: typeNamespacedName,
 			})
 			Expect(err).NotTo(HaveOccurred())
-			// TODO(user): Add more specific assertions depending on your controller's reconciliation logic.
-			// Example: If you expect a certain status condition after reconciliation, verify it here.
+
+			By("Checking the computed status")
+			Expect(k8sClient.Get(ctx, typeNamespacedName, app)).To(Succeed())
+			Expect(app.Status.ObservedGeneration).To(Equal(app.Generation))
+			Expect(app.Status.Deployment).NotTo(BeNil())
+			Expect(app.Status.ReplicasControlledBy).To(Equal(aloystechv2.ReplicaControllerHPA))
+			Expect(app.Status.TemplateVersion).To(Equal(utils.BuiltinTemplateVersion))
+			// envtest 里没有 deployment controller，副本永远不会 ready
+			ready := meta.FindStatusCondition(app.Status.Conditions, aloystechv2.ConditionReady)
+			Expect(ready).NotTo(BeNil())
+			Expect(ready.Status).To(Equal(metav1.ConditionFalse))
+			Expect(meta.FindStatusCondition(app.Status.Conditions, aloystechv2.ConditionDeploymentAvailable)).NotTo(BeNil())
+			Expect(meta.FindStatusCondition(app.Status.Conditions, aloystechv2.ConditionServiceReady)).NotTo(BeNil())
+
+			By("Reconciling again without changes")
+			dp := &appsv1.Deployment{}
+			Expect(k8sClient.Get(ctx, GetNamespacedName(resourceName, "-deploy", "default"), dp)).To(Succeed())
+			Expect(dp.ManagedFields).To(ContainElement(HaveField("Manager", FieldManager)))
+			svc := &corev1.Service{}
+			Expect(k8sClient.Get(ctx, GetNamespacedName(resourceName, "-svc", "default"), svc)).To(Succeed())
+
+			_, err = controllerReconciler.Reconcile(ctx, reconcile.Request{
+				NamespacedName: typeNamespacedName,
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			// apiserver 填充的默认值不应该再触发更新
+			applied := &appsv1.Deployment{}
+			Expect(k8sClient.Get(ctx, GetNamespacedName(resourceName, "-deploy", "default"), applied)).To(Succeed())
+			Expect(applied.ResourceVersion).To(Equal(dp.ResourceVersion))
+			appliedSvc := &corev1.Service{}
+			Expect(k8sClient.Get(ctx, GetNamespacedName(resourceName, "-svc", "default"), appliedSvc)).To(Succeed())
+			Expect(appliedSvc.ResourceVersion).To(Equal(svc.ResourceVersion))
+		})
+
+		It("should only adopt an existing Service with the adopt annotation", func() {
+			controllerReconciler := &AppReconciler{
+				Client:  k8sClient,
+				Scheme:  k8sClient.Scheme(),
+				Eventer: record.NewFakeRecorder(100),
+			}
+			legacy := &corev1.Service{
+				ObjectMeta: metav1.ObjectMeta{Name: resourceName + "-svc", Namespace: "default"},
+				Spec: corev1.ServiceSpec{
+					Selector: map[string]string{"app": resourceName},
+					Ports:    []corev1.ServicePort{{Name: "http", Port: 80}},
+				},
+			}
+			Expect(k8sClient.Create(ctx, legacy)).To(Succeed())
+
+			By("Refusing to modify the Service without the annotation")
+			_, err := controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: typeNamespacedName})
+			Expect(err).To(HaveOccurred())
+			Expect(k8sClient.Get(ctx, typeNamespacedName, app)).To(Succeed())
+			cond := meta.FindStatusCondition(app.Status.Conditions, aloystechv2.ConditionServiceReady)
+			Expect(cond).NotTo(BeNil())
+			Expect(cond.Reason).To(Equal(ReasonNotOwned))
+
+			By("Adopting the Service with the annotation")
+			app.Annotations = map[string]string{aloystechv2.AdoptAnnotation: "true"}
+			Expect(k8sClient.Update(ctx, app)).To(Succeed())
+			_, err = controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: typeNamespacedName})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(k8sClient.Get(ctx, client.ObjectKeyFromObject(legacy), legacy)).To(Succeed())
+			Expect(metav1.IsControlledBy(legacy, app)).To(BeTrue())
+			Expect(k8sClient.Get(ctx, typeNamespacedName, app)).To(Succeed())
+			Expect(app.Status.Adopted).To(ContainElement("Service/" + legacy.Name))
+		})
+
+		It("should delete only the owned HPA when autoscaling is disabled", func() {
+			controllerReconciler := &AppReconciler{
+				Client:  k8sClient,
+				Scheme:  k8sClient.Scheme(),
+				Eventer: record.NewFakeRecorder(100),
+			}
+			hpaKey := GetNamespacedName(resourceName, "-hpa", "default")
+			_, err := controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: typeNamespacedName})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(k8sClient.Get(ctx, hpaKey, &autoscalingv2.HorizontalPodAutoscaler{})).To(Succeed())
+
+			By("Deleting the owned HPA")
+			Expect(k8sClient.Get(ctx, typeNamespacedName, app)).To(Succeed())
+			disabled := false
+			app.Spec.Autoscaling = &aloystechv2.AppAutoscalingSpec{Enabled: &disabled}
+			Expect(k8sClient.Update(ctx, app)).To(Succeed())
+			_, err = controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: typeNamespacedName})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(errors.IsNotFound(k8sClient.Get(ctx, hpaKey, &autoscalingv2.HorizontalPodAutoscaler{}))).To(BeTrue())
+
+			By("Leaving an HPA the app does not own alone")
+			maxReplicas := int32(3)
+			unowned := &autoscalingv2.HorizontalPodAutoscaler{
+				ObjectMeta: metav1.ObjectMeta{Name: hpaKey.Name, Namespace: "default"},
+				Spec: autoscalingv2.HorizontalPodAutoscalerSpec{
+					ScaleTargetRef: autoscalingv2.CrossVersionObjectReference{APIVersion: "apps/v1", Kind: "Deployment", Name: "legacy"},
+					MaxReplicas:    maxReplicas,
+				},
+			}
+			Expect(k8sClient.Create(ctx, unowned)).To(Succeed())
+			defer func() { Expect(k8sClient.Delete(ctx, unowned)).To(Succeed()) }()
+			_, err = controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: typeNamespacedName})
+			Expect(err).To(HaveOccurred())
+			Expect(k8sClient.Get(ctx, hpaKey, &autoscalingv2.HorizontalPodAutoscaler{})).To(Succeed())
+			Expect(k8sClient.Get(ctx, typeNamespacedName, app)).To(Succeed())
+			cond := meta.FindStatusCondition(app.Status.Conditions, aloystechv2.ConditionAutoscalerActive)
+			Expect(cond).NotTo(BeNil())
+			Expect(cond.Reason).To(Equal(ReasonNotOwned))
+		})
+
+		It("should not delete an unowned object with the name of a child the app does not need", func() {
+			controllerReconciler := &AppReconciler{
+				Client:  k8sClient,
+				Scheme:  k8sClient.Scheme(),
+				Eventer: record.NewFakeRecorder(100),
+			}
+			pathType := netv1.PathTypePrefix
+			legacy := &netv1.Ingress{
+				ObjectMeta: metav1.ObjectMeta{Name: resourceName + "-ingress", Namespace: "default"},
+				Spec: netv1.IngressSpec{Rules: []netv1.IngressRule{{
+					Host: "legacy.example.com",
+					IngressRuleValue: netv1.IngressRuleValue{HTTP: &netv1.HTTPIngressRuleValue{Paths: []netv1.HTTPIngressPath{{
+						Path:     "/",
+						PathType: &pathType,
+						Backend:  netv1.IngressBackend{Service: &netv1.IngressServiceBackend{Name: "legacy", Port: netv1.ServiceBackendPort{Number: 80}}},
+					}}}},
+				}}},
+			}
+			Expect(k8sClient.Create(ctx, legacy)).To(Succeed())
+			defer func() { Expect(k8sClient.Delete(ctx, legacy)).To(Succeed()) }()
+
+			// App 没有开启 ingress，同名的 Ingress 不属于 App，不能删除
+			_, err := controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: typeNamespacedName})
+			Expect(err).To(HaveOccurred())
+			Expect(k8sClient.Get(ctx, client.ObjectKeyFromObject(legacy), &netv1.Ingress{})).To(Succeed())
+			Expect(k8sClient.Get(ctx, typeNamespacedName, app)).To(Succeed())
+			cond := meta.FindStatusCondition(app.Status.Conditions, aloystechv2.ConditionIngressAdmitted)
+			Expect(cond).NotTo(BeNil())
+			Expect(cond.Reason).To(Equal(ReasonNotOwned))
+		})
+
+		It("should not touch the children while the app is suspended", func() {
+			controllerReconciler := &AppReconciler{
+				Client:  k8sClient,
+				Scheme:  k8sClient.Scheme(),
+				Eventer: record.NewFakeRecorder(100),
+			}
+			Expect(k8sClient.Get(ctx, typeNamespacedName, app)).To(Succeed())
+			app.Spec.Suspend = true
+			app.Annotations = map[string]string{aloystechv2.RequestedAtAnnotation: "2024-05-01T10:00:00Z"}
+			Expect(k8sClient.Update(ctx, app)).To(Succeed())
+
+			By("Refreshing only the status")
+			_, err := controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: typeNamespacedName})
+			Expect(err).NotTo(HaveOccurred())
+			err = k8sClient.Get(ctx, GetNamespacedName(resourceName, "-deploy", "default"), &appsv1.Deployment{})
+			Expect(errors.IsNotFound(err)).To(BeTrue())
+			Expect(k8sClient.Get(ctx, typeNamespacedName, app)).To(Succeed())
+			Expect(meta.IsStatusConditionTrue(app.Status.Conditions, aloystechv2.ConditionSuspended)).To(BeTrue())
+			Expect(app.Status.LastHandledReconcileAt).To(Equal("2024-05-01T10:00:00Z"))
+
+			By("Creating the children once the app is resumed")
+			app.Spec.Suspend = false
+			Expect(k8sClient.Update(ctx, app)).To(Succeed())
+			_, err = controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: typeNamespacedName})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(k8sClient.Get(ctx, GetNamespacedName(resourceName, "-deploy", "default"), &appsv1.Deployment{})).To(Succeed())
+			Expect(k8sClient.Get(ctx, typeNamespacedName, app)).To(Succeed())
+			Expect(meta.FindStatusCondition(app.Status.Conditions, aloystechv2.ConditionSuspended)).To(BeNil())
+		})
+
+		It("should spread the replicas by default only when the app has no constraints", func() {
+			controllerReconciler := &AppReconciler{
+				Client:                k8sClient,
+				Scheme:                k8sClient.Scheme(),
+				Eventer:               record.NewFakeRecorder(100),
+				DefaultTopologySpread: true,
+			}
+			spreadKeys := func() []string {
+				_, err := controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: typeNamespacedName})
+				Expect(err).NotTo(HaveOccurred())
+				dp := &appsv1.Deployment{}
+				Expect(k8sClient.Get(ctx, GetNamespacedName(resourceName, "-deploy", "default"), dp)).To(Succeed())
+				var keys []string
+				for _, c := range dp.Spec.Template.Spec.TopologySpreadConstraints {
+					Expect(c.LabelSelector.MatchLabels).To(HaveKeyWithValue("app", resourceName))
+					keys = append(keys, c.TopologyKey)
+				}
+				return keys
+			}
+			Expect(spreadKeys()).To(Equal([]string{corev1.LabelTopologyZone, corev1.LabelHostname}))
+
+			By("letting the app opt out of the default spread")
+			disabled := false
+			updateApp(func(app *aloystechv2.App) { app.Spec.Deployment.DefaultTopologySpread = &disabled })
+			Expect(spreadKeys()).To(BeEmpty())
+
+			By("letting the app opt in when the default spread is off")
+			enabled := true
+			controllerReconciler.DefaultTopologySpread = false
+			updateApp(func(app *aloystechv2.App) { app.Spec.Deployment.DefaultTopologySpread = &enabled })
+			Expect(spreadKeys()).To(Equal([]string{corev1.LabelTopologyZone, corev1.LabelHostname}))
+
+			Expect(k8sClient.Get(ctx, typeNamespacedName, app)).To(Succeed())
+			app.Spec.Deployment.TopologySpreadConstraints = []corev1.TopologySpreadConstraint{{
+				MaxSkew:           2,
+				TopologyKey:       corev1.LabelHostname,
+				WhenUnsatisfiable: corev1.DoNotSchedule,
+				LabelSelector:     &metav1.LabelSelector{MatchLabels: map[string]string{"app": resourceName}},
+			}}
+			Expect(k8sClient.Update(ctx, app)).To(Succeed())
+			Expect(spreadKeys()).To(Equal([]string{corev1.LabelHostname}))
+		})
+
+		It("should roll the pods when a referenced ConfigMap changes", func() {
+			controllerReconciler := &AppReconciler{
+				Client:  k8sClient,
+				Scheme:  k8sClient.Scheme(),
+				Eventer: record.NewFakeRecorder(100),
+			}
+			cm := &corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{Name: "test-config", Namespace: "default"},
+				Data:       map[string]string{"LEVEL": "info"},
+			}
+			Expect(k8sClient.Create(ctx, cm)).To(Succeed())
+			defer func() { Expect(k8sClient.Delete(ctx, cm)).To(Succeed()) }()
+
+			Expect(k8sClient.Get(ctx, typeNamespacedName, app)).To(Succeed())
+			app.Spec.Deployment.EnvFrom = []corev1.EnvFromSource{{ConfigMapRef: &corev1.ConfigMapEnvSource{
+				LocalObjectReference: corev1.LocalObjectReference{Name: cm.Name},
+			}}}
+			Expect(k8sClient.Update(ctx, app)).To(Succeed())
+
+			hashOf := func() string {
+				_, err := controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: typeNamespacedName})
+				Expect(err).NotTo(HaveOccurred())
+				dp := &appsv1.Deployment{}
+				Expect(k8sClient.Get(ctx, GetNamespacedName(resourceName, "-deploy", "default"), dp)).To(Succeed())
+				return dp.Spec.Template.Annotations[ConfigHashAnnotation]
+			}
+			before := hashOf()
+			Expect(before).NotTo(BeEmpty())
+
+			cm.Data["LEVEL"] = "debug"
+			Expect(k8sClient.Update(ctx, cm)).To(Succeed())
+			Expect(hashOf()).NotTo(Equal(before))
+		})
+
+		It("should recreate a changed Job only after the running Job has finished", func() {
+			controllerReconciler := &AppReconciler{
+				Client:  k8sClient,
+				Scheme:  k8sClient.Scheme(),
+				Eventer: record.NewFakeRecorder(100),
+			}
+			reconcileOnce := func() {
+				_, err := controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: typeNamespacedName})
+				Expect(err).NotTo(HaveOccurred())
+			}
+			Expect(k8sClient.Get(ctx, typeNamespacedName, app)).To(Succeed())
+			app.Spec.Workload.Kind = aloystechv2.WorkloadJob
+			Expect(k8sClient.Update(ctx, app)).To(Succeed())
+			reconcileOnce()
+			job := &batchv1.Job{}
+			Expect(k8sClient.Get(ctx, GetNamespacedName(resourceName, "-job", "default"), job)).To(Succeed())
+			uid := job.UID
+
+			By("changing the image while the Job is running")
+			Expect(k8sClient.Get(ctx, typeNamespacedName, app)).To(Succeed())
+			app.Spec.Deployment.Image = "nginx:alpine"
+			Expect(k8sClient.Update(ctx, app)).To(Succeed())
+			reconcileOnce()
+			Expect(k8sClient.Get(ctx, GetNamespacedName(resourceName, "-job", "default"), job)).To(Succeed())
+			Expect(job.UID).To(Equal(uid))
+			Expect(k8sClient.Get(ctx, typeNamespacedName, app)).To(Succeed())
+			cond := meta.FindStatusCondition(app.Status.Conditions, aloystechv2.ConditionJobSucceeded)
+			Expect(cond).NotTo(BeNil())
+			Expect(cond.Reason).To(Equal(ReasonJobSpecPending))
+
+			By("finishing the running Job")
+			now := metav1.Now()
+			job.Status.StartTime = &now
+			job.Status.CompletionTime = &now
+			job.Status.Succeeded = 1
+			job.Status.Conditions = []batchv1.JobCondition{{Type: batchv1.JobComplete, Status: corev1.ConditionTrue}}
+			Expect(k8sClient.Status().Update(ctx, job)).To(Succeed())
+			reconcileOnce()
+			err := k8sClient.Get(ctx, GetNamespacedName(resourceName, "-job", "default"), job)
+			Expect(errors.IsNotFound(err) || job.DeletionTimestamp != nil).To(BeTrue())
+		})
+
+		It("should shift the traffic to a canary step by step and promote it", func() {
+			controllerReconciler := &AppReconciler{
+				Client:  k8sClient,
+				Scheme:  k8sClient.Scheme(),
+				Eventer: record.NewFakeRecorder(100),
+			}
+			reconcileOnce := func() {
+				_, err := controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: typeNamespacedName})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(k8sClient.Get(ctx, typeNamespacedName, app)).To(Succeed())
+			}
+			updateApp(func(app *aloystechv2.App) {
+				app.Spec.Strategy = aloystechv2.AppStrategySpec{
+					Type:   aloystechv2.StrategyCanary,
+					Canary: &aloystechv2.CanaryStrategy{Steps: []aloystechv2.CanaryStep{{Weight: 20}}},
+				}
+			})
+			reconcileOnce()
+			Expect(app.Status.Canary).To(BeNil())
+			markRolledOut("-deploy")
+
+			By("changing the image")
+			updateApp(func(app *aloystechv2.App) { app.Spec.Deployment.Image = "nginx:alpine" })
+			reconcileOnce()
+			Expect(imageOf("-deploy")).To(Equal("nginx"))
+			Expect(imageOf("-canary")).To(Equal("nginx:alpine"))
+			Expect(app.Status.Canary).NotTo(BeNil())
+			Expect(app.Status.Canary.Phase).To(Equal(aloystechv2.CanaryProgressing))
+			Expect(app.Status.Canary.Weight).To(Equal(int32(20)))
+			Expect(k8sClient.Get(ctx, GetNamespacedName(resourceName, "-canary-svc", "default"), &corev1.Service{})).To(Succeed())
+
+			By("waiting for the promote annotation once the canary pods are available")
+			markRolledOut("-canary")
+			reconcileOnce()
+			Expect(app.Status.Canary.Phase).To(Equal(aloystechv2.CanaryPaused))
+			Expect(imageOf("-deploy")).To(Equal("nginx"))
+
+			By("promoting the last step")
+			updateApp(func(app *aloystechv2.App) {
+				app.Annotations = map[string]string{aloystechv2.RolloutActionAnnotation: aloystechv2.RolloutActionPromote}
+			})
+			reconcileOnce()
+			Expect(app.Annotations).NotTo(HaveKey(aloystechv2.RolloutActionAnnotation))
+			Expect(app.Status.Canary.Phase).To(Equal(aloystechv2.CanaryPromoting))
+			Expect(imageOf("-deploy")).To(Equal("nginx:alpine"))
+
+			By("removing the canary once the stable Deployment has rolled out")
+			reconcileOnce()
+			Expect(app.Status.Canary).NotTo(BeNil())
+			markRolledOut("-deploy")
+			reconcileOnce()
+			Expect(app.Status.Canary).To(BeNil())
+			Expect(errors.IsNotFound(k8sClient.Get(ctx, GetNamespacedName(resourceName, "-canary", "default"), &appsv1.Deployment{}))).To(BeTrue())
+			Expect(errors.IsNotFound(k8sClient.Get(ctx, GetNamespacedName(resourceName, "-canary-svc", "default"), &corev1.Service{}))).To(BeTrue())
+		})
+
+		It("should compare the pod template when the stable Deployment has no template hash", func() {
+			controllerReconciler := &AppReconciler{
+				Client:  k8sClient,
+				Scheme:  k8sClient.Scheme(),
+				Eventer: record.NewFakeRecorder(100),
+			}
+			reconcileOnce := func() {
+				_, err := controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: typeNamespacedName})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(k8sClient.Get(ctx, typeNamespacedName, app)).To(Succeed())
+			}
+			dropTemplateHash := func() {
+				dp := &appsv1.Deployment{}
+				Expect(k8sClient.Get(ctx, GetNamespacedName(resourceName, "-deploy", "default"), dp)).To(Succeed())
+				delete(dp.Annotations, TemplateHashAnnotation)
+				Expect(k8sClient.Update(ctx, dp)).To(Succeed())
+			}
+			updateApp(func(app *aloystechv2.App) {
+				app.Spec.Strategy = aloystechv2.AppStrategySpec{
+					Type:   aloystechv2.StrategyCanary,
+					Canary: &aloystechv2.CanaryStrategy{Steps: []aloystechv2.CanaryStep{{Weight: 50}}},
+				}
+			})
+			reconcileOnce()
+
+			By("keeping the unchanged pod template without a canary")
+			dropTemplateHash()
+			reconcileOnce()
+			Expect(app.Status.Canary).To(BeNil())
+			Expect(errors.IsNotFound(k8sClient.Get(ctx, GetNamespacedName(resourceName, "-canary", "default"), &appsv1.Deployment{}))).To(BeTrue())
+
+			By("starting a canary for a changed pod template")
+			dropTemplateHash()
+			updateApp(func(app *aloystechv2.App) { app.Spec.Deployment.Image = "nginx:alpine" })
+			reconcileOnce()
+			Expect(app.Status.Canary).NotTo(BeNil())
+			Expect(imageOf("-deploy")).To(Equal("nginx"))
+			Expect(imageOf("-canary")).To(Equal("nginx:alpine"))
+		})
+
+		It("should run the new pod template on the preview color and switch the Service on promotion", func() {
+			controllerReconciler := &AppReconciler{
+				Client:  k8sClient,
+				Scheme:  k8sClient.Scheme(),
+				Eventer: record.NewFakeRecorder(100),
+			}
+			reconcileOnce := func() {
+				_, err := controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: typeNamespacedName})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(k8sClient.Get(ctx, typeNamespacedName, app)).To(Succeed())
+			}
+			serviceColor := func() string {
+				svc := &corev1.Service{}
+				Expect(k8sClient.Get(ctx, GetNamespacedName(resourceName, "-svc", "default"), svc)).To(Succeed())
+				return svc.Spec.Selector[utils.ColorLabel]
+			}
+			reconcileOnce()
+			markRolledOut("-deploy")
+
+			By("switching to blue/green")
+			updateApp(func(app *aloystechv2.App) {
+				app.Spec.Strategy = aloystechv2.AppStrategySpec{
+					Type:      aloystechv2.StrategyBlueGreen,
+					BlueGreen: &aloystechv2.BlueGreenStrategy{ScaleDownDelay: &metav1.Duration{}},
+				}
+			})
+			reconcileOnce()
+			Expect(app.Status.BlueGreen.Phase).To(Equal(aloystechv2.BlueGreenPreviewing))
+			Expect(k8sClient.Get(ctx, GetNamespacedName(resourceName, "-deploy", "default"), &appsv1.Deployment{})).To(Succeed())
+			Expect(serviceColor()).To(BeEmpty())
+
+			By("making blue active once it is available")
+			markRolledOut("-blue")
+			reconcileOnce()
+			Expect(app.Status.BlueGreen.ActiveColor).To(Equal(ColorBlue))
+			Expect(app.Status.BlueGreen.Phase).To(Equal(aloystechv2.BlueGreenActive))
+			Expect(errors.IsNotFound(k8sClient.Get(ctx, GetNamespacedName(resourceName, "-deploy", "default"), &appsv1.Deployment{}))).To(BeTrue())
+			Expect(serviceColor()).To(Equal(ColorBlue))
+
+			By("previewing a new image on green")
+			updateApp(func(app *aloystechv2.App) { app.Spec.Deployment.Image = "nginx:alpine" })
+			reconcileOnce()
+			Expect(app.Status.BlueGreen.Phase).To(Equal(aloystechv2.BlueGreenPreviewing))
+			Expect(imageOf("-blue")).To(Equal("nginx"))
+			Expect(imageOf("-green")).To(Equal("nginx:alpine"))
+			markRolledOut("-green")
+			reconcileOnce()
+			Expect(app.Status.BlueGreen.Phase).To(Equal(aloystechv2.BlueGreenAwaitingPromotion))
+			Expect(serviceColor()).To(Equal(ColorBlue))
+
+			By("promoting green and removing blue after the scale down delay")
+			updateApp(func(app *aloystechv2.App) {
+				app.Annotations = map[string]string{aloystechv2.RolloutActionAnnotation: aloystechv2.RolloutActionPromote}
+			})
+			reconcileOnce()
+			Expect(app.Status.BlueGreen.ActiveColor).To(Equal(ColorGreen))
+			Expect(serviceColor()).To(Equal(ColorGreen))
+			reconcileOnce()
+			Expect(app.Status.BlueGreen.ScaleDownTime).To(BeNil())
+			Expect(errors.IsNotFound(k8sClient.Get(ctx, GetNamespacedName(resourceName, "-blue", "default"), &appsv1.Deployment{}))).To(BeTrue())
+			Expect(imageOf("-green")).To(Equal("nginx:alpine"))
+		})
+
+		It("should roll back an image that exceeds the progress deadline", func() {
+			controllerReconciler := &AppReconciler{
+				Client:  k8sClient,
+				Scheme:  k8sClient.Scheme(),
+				Eventer: record.NewFakeRecorder(100),
+			}
+			reconcileOnce := func() {
+				_, err := controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: typeNamespacedName})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(k8sClient.Get(ctx, typeNamespacedName, app)).To(Succeed())
+			}
+			updateApp(func(app *aloystechv2.App) { app.Spec.Rollback = &aloystechv2.AppRollbackSpec{Auto: true} })
+			reconcileOnce()
+			markRolledOut("-deploy")
+			reconcileOnce()
+			Expect(app.Status.Rollback).NotTo(BeNil())
+			goodRevision := app.Status.Rollback.LastGoodRevision
+			Expect(goodRevision).NotTo(BeEmpty())
+
+			By("keeping the ReplicaSet of the good revision like the deployment controller does")
+			dp := &appsv1.Deployment{}
+			Expect(k8sClient.Get(ctx, GetNamespacedName(resourceName, "-deploy", "default"), dp)).To(Succeed())
+			rs := &appsv1.ReplicaSet{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:            dp.Name + "-good",
+					Namespace:       "default",
+					Labels:          dp.Spec.Template.Labels,
+					Annotations:     map[string]string{TemplateHashAnnotation: goodRevision},
+					OwnerReferences: []metav1.OwnerReference{*metav1.NewControllerRef(dp, appsv1.SchemeGroupVersion.WithKind("Deployment"))},
+				},
+				Spec: appsv1.ReplicaSetSpec{Selector: dp.Spec.Selector, Template: dp.Spec.Template},
+			}
+			Expect(k8sClient.Create(ctx, rs)).To(Succeed())
+			defer func() { Expect(client.IgnoreNotFound(k8sClient.Delete(ctx, rs))).To(Succeed()) }()
+
+			By("rolling out an image that never becomes available")
+			updateApp(func(app *aloystechv2.App) { app.Spec.Deployment.Image = "nginx:broken" })
+			reconcileOnce()
+			Expect(imageOf("-deploy")).To(Equal("nginx:broken"))
+			Expect(k8sClient.Get(ctx, GetNamespacedName(resourceName, "-deploy", "default"), dp)).To(Succeed())
+			dp.Status = appsv1.DeploymentStatus{
+				ObservedGeneration: dp.Generation,
+				Replicas:           deploymentReplicas(dp),
+				Conditions: []appsv1.DeploymentCondition{{
+					Type:   appsv1.DeploymentProgressing,
+					Status: corev1.ConditionFalse,
+					Reason: ReasonProgressDeadlineExceeded,
+				}},
+			}
+			Expect(k8sClient.Status().Update(ctx, dp)).To(Succeed())
+
+			By("restoring the pod template of the good revision")
+			reconcileOnce()
+			Expect(imageOf("-deploy")).To(Equal("nginx"))
+			Expect(app.Status.Rollback.FailedImage).To(Equal("nginx:broken"))
+			Expect(app.Status.Rollback.RollbackTime).NotTo(BeNil())
+			degraded := meta.FindStatusCondition(app.Status.Conditions, aloystechv2.ConditionDegraded)
+			Expect(degraded).NotTo(BeNil())
+			Expect(degraded.Reason).To(Equal(ReasonRolledBack))
+
+			By("trying again once the spec changes the image")
+			updateApp(func(app *aloystechv2.App) { app.Spec.Deployment.Image = "nginx:alpine" })
+			reconcileOnce()
+			Expect(imageOf("-deploy")).To(Equal("nginx:alpine"))
+			Expect(app.Status.Rollback.FailedRevision).To(BeEmpty())
+		})
+
+		It("should keep a bounded revision history and restore a revision", func() {
+			controllerReconciler := &AppReconciler{
+				Client:  k8sClient,
+				Scheme:  k8sClient.Scheme(),
+				Eventer: record.NewFakeRecorder(100),
+			}
+			reconcileOnce := func() {
+				_, err := controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: typeNamespacedName})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(k8sClient.Get(ctx, typeNamespacedName, app)).To(Succeed())
+			}
+			revisionExists := func(hash string) bool {
+				err := k8sClient.Get(ctx, GetNamespacedName(resourceName, "-"+hash, "default"), &appsv1.ControllerRevision{})
+				Expect(client.IgnoreNotFound(err)).To(Succeed())
+				return err == nil
+			}
+			limit := int32(2)
+			updateApp(func(app *aloystechv2.App) {
+				app.Spec.Rollback = &aloystechv2.AppRollbackSpec{RevisionHistoryLimit: &limit}
+			})
+			reconcileOnce()
+			Expect(app.Status.History).To(HaveLen(1))
+			first := app.Status.History[0]
+			Expect(first.Revision).To(Equal(int64(1)))
+			Expect(revisionExists(first.Hash)).To(BeTrue())
+
+			By("recording a new revision for every changed image")
+			updateApp(func(app *aloystechv2.App) { app.Spec.Deployment.Image = "nginx:alpine" })
+			reconcileOnce()
+			Expect(app.Status.History).To(HaveLen(2))
+			Expect(app.Status.History[0].Image).To(Equal("nginx:alpine"))
+			Expect(app.Status.History[1].Outcome).To(Equal(aloystechv2.RevisionSuperseded))
+			second := app.Status.History[0]
+
+			By("pruning the revisions over the limit")
+			updateApp(func(app *aloystechv2.App) { app.Spec.Deployment.Image = "nginx:perl" })
+			reconcileOnce()
+			Expect(app.Status.History).To(HaveLen(2))
+			Expect(app.Status.History[0].Revision).To(Equal(int64(3)))
+			Expect(revisionExists(first.Hash)).To(BeFalse())
+
+			By("restoring the spec of a revision from the rollback-to annotation")
+			updateApp(func(app *aloystechv2.App) {
+				app.Annotations = map[string]string{aloystechv2.RollbackToAnnotation: "2"}
+			})
+			reconcileOnce()
+			Expect(app.Annotations).NotTo(HaveKey(aloystechv2.RollbackToAnnotation))
+			Expect(app.Spec.Deployment.Image).To(Equal("nginx:alpine"))
+			Expect(imageOf("-deploy")).To(Equal("nginx:alpine"))
+			Expect(app.Status.History[0].Revision).To(Equal(int64(4)))
+			Expect(app.Status.History[0].Hash).To(Equal(second.Hash))
+			// 被修剪掉的第 2 个版本和第 4 个版本是同一份 spec，ControllerRevision 要保留
+			Expect(revisionExists(second.Hash)).To(BeTrue())
+
+			By("ignoring a revision that is no longer in the history")
+			updateApp(func(app *aloystechv2.App) {
+				app.Annotations = map[string]string{aloystechv2.RollbackToAnnotation: "1"}
+			})
+			reconcileOnce()
+			Expect(app.Annotations).NotTo(HaveKey(aloystechv2.RollbackToAnnotation))
+			Expect(app.Spec.Deployment.Image).To(Equal("nginx:alpine"))
+		})
+
+		It("should run the pre-delete hook and keep the Service with the RetainIngressAndService policy", func() {
+			controllerReconciler := &AppReconciler{
+				Client:  k8sClient,
+				Scheme:  k8sClient.Scheme(),
+				Eventer: record.NewFakeRecorder(100),
+			}
+			reconcileOnce := func() {
+				_, err := controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: typeNamespacedName})
+				Expect(err).NotTo(HaveOccurred())
+			}
+			finishHook := func(condition batchv1.JobConditionType) {
+				job := &batchv1.Job{}
+				Expect(k8sClient.Get(ctx, GetNamespacedName(resourceName, "-predelete", "default"), job)).To(Succeed())
+				now := metav1.Now()
+				job.Status.StartTime = &now
+				if condition == batchv1.JobComplete {
+					job.Status.CompletionTime = &now
+				}
+				job.Status.Conditions = []batchv1.JobCondition{{Type: condition, Status: corev1.ConditionTrue, Reason: "Test"}}
+				Expect(k8sClient.Status().Update(ctx, job)).To(Succeed())
+			}
+			updateApp(func(app *aloystechv2.App) {
+				app.Spec.DeletionPolicy = aloystechv2.DeletionPolicyRetainIngressAndService
+				app.Spec.PreDeleteHook = &aloystechv2.PreDeleteHook{Command: []string{"sh", "-c", "echo bye"}}
+			})
+			reconcileOnce()
+			Expect(k8sClient.Get(ctx, typeNamespacedName, app)).To(Succeed())
+			Expect(app.Finalizers).To(ContainElement(aloystechv2.AppFinalizer))
+
+			By("running the hook before touching the children")
+			Expect(k8sClient.Delete(ctx, app)).To(Succeed())
+			reconcileOnce()
+			Expect(k8sClient.Get(ctx, typeNamespacedName, app)).To(Succeed())
+			Expect(app.Status.Deletion).NotTo(BeNil())
+			Expect(app.Status.Deletion.Phase).To(Equal(aloystechv2.DeletionRunningHook))
+			Expect(k8sClient.Get(ctx, GetNamespacedName(resourceName, "-deploy", "default"), &appsv1.Deployment{})).To(Succeed())
+
+			By("waiting on a failed hook until its Job is deleted")
+			finishHook(batchv1.JobFailed)
+			reconcileOnce()
+			Expect(k8sClient.Get(ctx, typeNamespacedName, app)).To(Succeed())
+			Expect(app.Status.Deletion.Phase).To(Equal(aloystechv2.DeletionHookFailed))
+			Expect(k8sClient.Get(ctx, GetNamespacedName(resourceName, "-deploy", "default"), &appsv1.Deployment{})).To(Succeed())
+			hook := &batchv1.Job{}
+			Expect(k8sClient.Get(ctx, GetNamespacedName(resourceName, "-predelete", "default"), hook)).To(Succeed())
+			Expect(k8sClient.Delete(ctx, hook, client.PropagationPolicy(metav1.DeletePropagationBackground))).To(Succeed())
+			reconcileOnce()
+			Expect(k8sClient.Get(ctx, typeNamespacedName, app)).To(Succeed())
+			Expect(app.Status.Deletion.Phase).To(Equal(aloystechv2.DeletionRunningHook))
+
+			By("removing the children once the hook completes")
+			finishHook(batchv1.JobComplete)
+			Eventually(func() bool {
+				reconcileOnce()
+				return errors.IsNotFound(k8sClient.Get(ctx, typeNamespacedName, &aloystechv2.App{}))
+			}).Should(BeTrue())
+			Expect(errors.IsNotFound(k8sClient.Get(ctx, GetNamespacedName(resourceName, "-deploy", "default"), &appsv1.Deployment{}))).To(BeTrue())
+			Expect(errors.IsNotFound(k8sClient.Get(ctx, GetNamespacedName(resourceName, "-predelete", "default"), &batchv1.Job{}))).To(BeTrue())
+			svc := &corev1.Service{}
+			Expect(k8sClient.Get(ctx, GetNamespacedName(resourceName, "-svc", "default"), svc)).To(Succeed())
+			Expect(svc.OwnerReferences).To(BeEmpty())
+			Expect(k8sClient.Delete(ctx, svc)).To(Succeed())
+		})
+
+		It("should only load the namespace templates the cluster templates allow and warn once", func() {
+			recorder := record.NewFakeRecorder(100)
+			controllerReconciler := &AppReconciler{
+				Client:    k8sClient,
+				Scheme:    k8sClient.Scheme(),
+				Eventer:   recorder,
+				Templates: &TemplateLoader{Reader: k8sClient, Namespace: "kube-system"},
+			}
+			reconcileOnce := func() []string {
+				_, err := controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: typeNamespacedName})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(k8sClient.Get(ctx, typeNamespacedName, app)).To(Succeed())
+				var events []string
+				for {
+					select {
+					case e := <-recorder.Events:
+						events = append(events, e)
+					default:
+						return events
+					}
+				}
+			}
+			deployment, err := fs.ReadFile(templates.FS, "deployment.yml")
+			Expect(err).NotTo(HaveOccurred())
+			namespaced := &corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{Name: TemplateConfigMapName, Namespace: "default"},
+				Data:       map[string]string{"deployment.yml": string(deployment) + "\n# team templates\n"},
+			}
+			Expect(k8sClient.Create(ctx, namespaced)).To(Succeed())
+			defer func() { Expect(k8sClient.Delete(ctx, namespaced)).To(Succeed()) }()
+
+			By("ignoring the namespace templates without the allow-list")
+			Expect(reconcileOnce()).To(ContainElement(ContainSubstring(ReasonTemplatesNotAllowed)))
+			Expect(app.Status.TemplateVersion).To(Equal(utils.BuiltinTemplateVersion))
+			Expect(reconcileOnce()).NotTo(ContainElement(ContainSubstring(ReasonTemplatesNotAllowed)))
+
+			By("loading them once the cluster templates list the namespace")
+			cluster := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{
+				Name:        TemplateConfigMapName,
+				Namespace:   "kube-system",
+				Annotations: map[string]string{TemplateNamespacesAnnotation: "team-a, default"},
+			}}
+			Expect(k8sClient.Create(ctx, cluster)).To(Succeed())
+			defer func() { Expect(k8sClient.Delete(ctx, cluster)).To(Succeed()) }()
+			reconcileOnce()
+			Expect(app.Status.TemplateVersion).To(HavePrefix(utils.BuiltinTemplateVersion + "+cluster:"))
+			Expect(app.Status.TemplateVersion).To(ContainSubstring("+namespace:"))
+			loaded := app.Status.TemplateVersion
+
+			By("keeping the last valid templates and warning once about invalid ones")
+			namespaced.Data["deployment.yml"] = "{{ .Spec"
+			Expect(k8sClient.Update(ctx, namespaced)).To(Succeed())
+			Expect(reconcileOnce()).To(ContainElement(ContainSubstring(ReasonInvalidTemplates)))
+			Expect(app.Status.TemplateVersion).To(Equal(loaded))
+			Expect(reconcileOnce()).NotTo(ContainElement(ContainSubstring(ReasonInvalidTemplates)))
+		})
+
+		It("should ignore the namespace templates when no cluster template namespace is configured", func() {
+			recorder := record.NewFakeRecorder(100)
+			controllerReconciler := &AppReconciler{
+				Client:    k8sClient,
+				Scheme:    k8sClient.Scheme(),
+				Eventer:   recorder,
+				Templates: &TemplateLoader{Reader: k8sClient},
+			}
+			deployment, err := fs.ReadFile(templates.FS, "deployment.yml")
+			Expect(err).NotTo(HaveOccurred())
+			namespaced := &corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{Name: TemplateConfigMapName, Namespace: "default"},
+				Data:       map[string]string{"deployment.yml": string(deployment) + "\n# team templates\n"},
+			}
+			Expect(k8sClient.Create(ctx, namespaced)).To(Succeed())
+			defer func() { Expect(k8sClient.Delete(ctx, namespaced)).To(Succeed()) }()
+
+			_, err = controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: typeNamespacedName})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(k8sClient.Get(ctx, typeNamespacedName, app)).To(Succeed())
+			Expect(app.Status.TemplateVersion).To(Equal(utils.BuiltinTemplateVersion))
+			Eventually(recorder.Events).Should(Receive(ContainSubstring(ReasonTemplatesNotAllowed)))
+		})
+
+		It("should dry-run the overrides against the ConfigMap templates without a reconcile", func() {
+			deployment, err := fs.ReadFile(templates.FS, "deployment.yml")
+			Expect(err).NotTo(HaveOccurred())
+			cluster := &corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{Name: TemplateConfigMapName, Namespace: "kube-system"},
+				Data:       map[string]string{"deployment.yml": strings.Replace(string(deployment), "  labels:\n", "  labels:\n    team: platform\n", 1)},
+			}
+			Expect(k8sClient.Create(ctx, cluster)).To(Succeed())
+			defer func() { Expect(k8sClient.Delete(ctx, cluster)).To(Succeed()) }()
+
+			// 只有集群级别的模板里有 team 标签，删除它的 patch 在内置模板上应用不了
+			app := &aloystechv2.App{
+				ObjectMeta: metav1.ObjectMeta{Name: resourceName, Namespace: "default"},
+				Spec: aloystechv2.AppSpec{Deployment: aloystechv2.AppDeploymentSpec{Image: "nginx"}, Overrides: []aloystechv2.ChildOverride{{
+					Kind:  "Deployment",
+					Type:  aloystechv2.OverrideJSON6902,
+					Patch: "- op: remove\n  path: /metadata/labels/team\n",
+				}}},
+			}
+			Expect((&TemplateLoader{Reader: k8sClient, Namespace: "kube-system"}).DryRunOverrides(ctx, app)).To(Succeed())
+			Expect((&TemplateLoader{Reader: k8sClient}).DryRunOverrides(ctx, app)).To(HaveOccurred())
+		})
+
+		It("should spread the pods of each Deployment on their own when a constraint has no labelSelector", func() {
+			controllerReconciler := &AppReconciler{
+				Client:  k8sClient,
+				Scheme:  k8sClient.Scheme(),
+				Eventer: record.NewFakeRecorder(100),
+			}
+			reconcileOnce := func() {
+				_, err := controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: typeNamespacedName})
+				Expect(err).NotTo(HaveOccurred())
+			}
+			spreadSelector := func(suffix string) (*metav1.LabelSelector, *metav1.LabelSelector) {
+				dp := &appsv1.Deployment{}
+				Expect(k8sClient.Get(ctx, GetNamespacedName(resourceName, suffix, "default"), dp)).To(Succeed())
+				Expect(dp.Spec.Template.Spec.TopologySpreadConstraints).To(HaveLen(1))
+				return dp.Spec.Template.Spec.TopologySpreadConstraints[0].LabelSelector, dp.Spec.Selector
+			}
+			updateApp(func(app *aloystechv2.App) {
+				app.Spec.Deployment.TopologySpreadConstraints = []corev1.TopologySpreadConstraint{{
+					MaxSkew:           1,
+					TopologyKey:       corev1.LabelHostname,
+					WhenUnsatisfiable: corev1.ScheduleAnyway,
+				}}
+				app.Spec.Strategy = aloystechv2.AppStrategySpec{
+					Type:   aloystechv2.StrategyCanary,
+					Canary: &aloystechv2.CanaryStrategy{Steps: []aloystechv2.CanaryStep{{Weight: 50}}},
+				}
+			})
+			reconcileOnce()
+			spread, selector := spreadSelector("-deploy")
+			Expect(spread).To(Equal(selector))
+			Expect(spread.MatchLabels).To(Equal(map[string]string{"app": resourceName}))
+
+			By("selecting the canary pods for the canary Deployment")
+			markRolledOut("-deploy")
+			updateApp(func(app *aloystechv2.App) { app.Spec.Deployment.Image = "nginx:alpine" })
+			reconcileOnce()
+			spread, selector = spreadSelector("-canary")
+			Expect(spread).To(Equal(selector))
+			Expect(spread.MatchLabels).NotTo(Equal(map[string]string{"app": resourceName}))
+		})
+
+		It("should become Ready without resources while the autoscaler has no metrics", func() {
+			controllerReconciler := &AppReconciler{
+				Client:  k8sClient,
+				Scheme:  k8sClient.Scheme(),
+				Eventer: record.NewFakeRecorder(100),
+			}
+			reconcileOnce := func() {
+				_, err := controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: typeNamespacedName})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(k8sClient.Get(ctx, typeNamespacedName, app)).To(Succeed())
+			}
+			reconcileOnce()
+			Expect(app.Spec.Deployment.Resources.Requests).To(BeEmpty())
+			markRolledOut("-deploy")
+			reconcileOnce()
+
+			autoscaler := meta.FindStatusCondition(app.Status.Conditions, aloystechv2.ConditionAutoscalerActive)
+			Expect(autoscaler).NotTo(BeNil())
+			Expect(autoscaler.Status).NotTo(Equal(metav1.ConditionTrue))
+			ready := meta.FindStatusCondition(app.Status.Conditions, aloystechv2.ConditionReady)
+			Expect(ready).NotTo(BeNil())
+			Expect(ready.Status).To(Equal(metav1.ConditionTrue))
+			Expect(meta.IsStatusConditionFalse(app.Status.Conditions, aloystechv2.ConditionDegraded)).To(BeTrue())
+		})
+
+		It("should leave the replicas to the HPA once the Deployment exists", func() {
+			controllerReconciler := &AppReconciler{
+				Client:  k8sClient,
+				Scheme:  k8sClient.Scheme(),
+				Eventer: record.NewFakeRecorder(100),
+			}
+			reconcileOnce := func() *appsv1.Deployment {
+				_, err := controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: typeNamespacedName})
+				Expect(err).NotTo(HaveOccurred())
+				dp := &appsv1.Deployment{}
+				Expect(k8sClient.Get(ctx, GetNamespacedName(resourceName, "-deploy", "default"), dp)).To(Succeed())
+				return dp
+			}
+			dp := reconcileOnce()
+			Expect(*dp.Spec.Replicas).To(Equal(int32(1)))
+
+			By("handing the replicas over without resetting them")
+			dp = reconcileOnce()
+			Expect(managesReplicas(dp, FieldManager)).To(BeFalse())
+			Expect(*dp.Spec.Replicas).To(Equal(int32(1)))
+
+			By("keeping the replicas the HPA scaled to")
+			patch := client.RawPatch(types.MergePatchType, []byte(`{"spec":{"replicas":3}}`))
+			Expect(k8sClient.Patch(ctx, dp, patch, client.FieldOwner("horizontal-pod-autoscaler"))).To(Succeed())
+			dp = reconcileOnce()
+			Expect(*dp.Spec.Replicas).To(Equal(int32(3)))
+			Expect(managesReplicas(dp, FieldManager)).To(BeFalse())
+		})
+
+		It("should keep the backend weights of the user when splitting the canary", func() {
+			app := &aloystechv2.App{ObjectMeta: metav1.ObjectMeta{Name: resourceName, Namespace: "default"}}
+			route := &unstructured.Unstructured{Object: map[string]interface{}{
+				"spec": map[string]interface{}{
+					"rules": []interface{}{
+						map[string]interface{}{"backendRefs": []interface{}{
+							map[string]interface{}{"name": resourceName + "-svc", "port": int64(80), "weight": int64(3)},
+							map[string]interface{}{"name": "legacy-svc", "port": int64(80), "weight": int64(1)},
+						}},
+						map[string]interface{}{"backendRefs": []interface{}{
+							map[string]interface{}{"name": resourceName + "-svc", "port": int64(80)},
+						}},
+					},
+				},
+			}}
+			splitCanaryBackends(route, app, 20)
+
+			rules, _, _ := unstructured.NestedSlice(route.Object, "spec", "rules")
+			weights := func(rule interface{}) map[string]int64 {
+				refs, _, _ := unstructured.NestedSlice(rule.(map[string]interface{}), "backendRefs")
+				out := map[string]int64{}
+				for _, ref := range refs {
+					refMap := ref.(map[string]interface{})
+					out[refMap["name"].(string)] = refMap["weight"].(int64)
+				}
+				return out
+			}
+			// 原来 App Service 占 3/4，canary 拿走其中的 20%，legacy-svc 仍然占 1/4
+			Expect(weights(rules[0])).To(Equal(map[string]int64{
+				resourceName + "-svc":        240,
+				resourceName + "-canary-svc": 60,
+				"legacy-svc":                 100,
+			}))
+			Expect(weights(rules[1])).To(Equal(map[string]int64{
+				resourceName + "-svc":        80,
+				resourceName + "-canary-svc": 20,
+			}))
 		})
 	})
 })
@@ -0,0 +1,124 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+
+	aloystechv2 "aloys.tech/api/v2"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// FieldManager 是 controller 做 server-side apply 时使用的 field manager，
+// 只有这个 manager 拥有的字段才会被 controller 覆盖，其他人（kubectl、HPA 等）改的字段不受影响
+const FieldManager = "app-controller"
+
+// notOwnedError 同名的子资源已经存在但不属于这个 App，controller 拒绝修改它
+type notOwnedError struct {
+	name   string
+	reason string
+}
+
+func (e *notOwnedError) Error() string {
+	return fmt.Sprintf("%s already exists and is not owned by the app, %s", e.name, e.reason)
+}
+
+// applyChild 用 server-side apply 提交渲染好的子资源，obj 会被替换成 apiserver 返回的对象。
+// 返回值 changed 表示这次 apply 是否真的修改了子资源，apiserver 对没有变化的 apply 不会写 etcd，resourceVersion 也不变。
+// 不强制抢占字段，别的 manager 占有的字段发生冲突时直接返回冲突错误，由调用方记录到 condition 上。
+// 同名的子资源已经存在但不属于 App 时，只有 App 带上 adopt 注解才会接管它
+func (r *AppReconciler) applyChild(ctx context.Context, owner *aloystechv2.App, obj client.Object) (changed bool, err error) {
+	before := ""
+	adopting := false
+	opts := []client.PatchOption{client.FieldOwner(FieldManager)}
+	live := obj.DeepCopyObject().(client.Object)
+	if err := r.Get(ctx, client.ObjectKeyFromObject(obj), live); err == nil {
+		before = live.GetResourceVersion()
+		if !metav1.IsControlledBy(live, owner) {
+			if err := r.checkAdoption(owner, live, obj); err != nil {
+				r.Eventer.Eventf(owner, corev1.EventTypeWarning, ReasonNotOwned, "Refused to modify the existing child: %v", err)
+				return false, err
+			}
+			// 接管时原来的 manager（kubectl 等）还占有这些字段，强制拿过来，之后按 App 的 spec 管理
+			adopting = true
+			opts = append(opts, client.ForceOwnership)
+		}
+	} else if !errors.IsNotFound(err) {
+		return false, err
+	}
+
+	if err := r.Patch(ctx, obj, client.Apply, opts...); err != nil {
+		if errors.IsConflict(err) {
+			r.Eventer.Eventf(owner, corev1.EventTypeWarning, ReasonFieldConflict,
+				"Failed to apply %s %s, fields are owned by another manager: %v", obj.GetObjectKind().GroupVersionKind().Kind, obj.GetName(), err)
+			return false, fmt.Errorf("field ownership conflict on %s: %w", obj.GetName(), err)
+		}
+		return false, err
+	}
+	if adopting {
+		name, err := r.childName(obj)
+		if err != nil {
+			return false, err
+		}
+		log.FromContext(ctx).Info("Adopted the existing child.", "child", name)
+		r.Eventer.Eventf(owner, corev1.EventTypeNormal, "Adopted", "The existing %s has been adopted by the app.", name)
+		owner.Status.Adopted = appendUnique(owner.Status.Adopted, name)
+	}
+	return before != obj.GetResourceVersion(), nil
+}
+
+// deleteChild 删除不再需要的子资源。只删除受 App 控制的对象，同名但不属于 App 的对象（例如没有接管的旧资源）不删除，
+// 和 applyChild 拒绝修改时一样返回 notOwnedError，由调用方记录到对应的 condition 上
+func (r *AppReconciler) deleteChild(ctx context.Context, owner *aloystechv2.App, obj client.Object, opts ...client.DeleteOption) error {
+	if !metav1.IsControlledBy(obj, owner) {
+		name, err := r.childName(obj)
+		if err != nil {
+			return err
+		}
+		reason := "the app only deletes the children it controls, delete it manually if it is no longer needed"
+		if ref := metav1.GetControllerOf(obj); ref != nil {
+			reason = fmt.Sprintf("it is controlled by %s %s", ref.Kind, ref.Name)
+		}
+		err = &notOwnedError{name: name, reason: reason}
+		r.Eventer.Eventf(owner, corev1.EventTypeWarning, ReasonNotOwned, "Refused to delete the existing child: %v", err)
+		return err
+	}
+	if err := r.Delete(ctx, obj, opts...); err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+// checkAdoption 判断不属于 App 的同名子资源能不能接管：需要 adopt 注解，不能属于别的 controller，
+// Deployment 和 StatefulSet 的 selector 不可修改，必须和 App 渲染出来的一致
+func (r *AppReconciler) checkAdoption(owner *aloystechv2.App, live, desired client.Object) error {
+	name, err := r.childName(live)
+	if err != nil {
+		return err
+	}
+	if ref := metav1.GetControllerOf(live); ref != nil {
+		return &notOwnedError{name: name, reason: fmt.Sprintf("it is controlled by %s %s", ref.Kind, ref.Name)}
+	}
+	if !owner.AdoptionEnabled() {
+		return &notOwnedError{name: name, reason: fmt.Sprintf("set the %s=true annotation on the app to adopt it", aloystechv2.AdoptAnnotation)}
+	}
+	var liveSelector, desiredSelector *metav1.LabelSelector
+	switch l := live.(type) {
+	case *appsv1.Deployment:
+		liveSelector, desiredSelector = l.Spec.Selector, desired.(*appsv1.Deployment).Spec.Selector
+	case *appsv1.StatefulSet:
+		liveSelector, desiredSelector = l.Spec.Selector, desired.(*appsv1.StatefulSet).Spec.Selector
+	default:
+		return nil
+	}
+	if !equality.Semantic.DeepEqual(liveSelector, desiredSelector) {
+		return &notOwnedError{name: name, reason: fmt.Sprintf("its selector %s is immutable and does not match the app selector %s",
+			metav1.FormatLabelSelector(liveSelector), metav1.FormatLabelSelector(desiredSelector))}
+	}
+	return nil
+}
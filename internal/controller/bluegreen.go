@@ -0,0 +1,251 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	aloystechv2 "aloys.tech/api/v2"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	ColorBlue  = "blue"
+	ColorGreen = "green"
+)
+
+func otherColor(color string) string {
+	if color == ColorBlue {
+		return ColorGreen
+	}
+	return ColorBlue
+}
+
+// activeColor 返回 Service 应该选择的颜色，为空表示 Service 按 app 标签选择所有 pod
+func activeColor(app *aloystechv2.App) string {
+	if !app.Spec.Strategy.IsBlueGreen() || app.Status.BlueGreen == nil {
+		return ""
+	}
+	return app.Status.BlueGreen.ActiveColor
+}
+
+func autoPromotion(app *aloystechv2.App) bool {
+	return app.Spec.Strategy.BlueGreen != nil && app.Spec.Strategy.BlueGreen.AutoPromotion
+}
+
+// activeDeploymentName 返回当前对外提供服务的 Deployment，HPA 跟着它走
+func activeDeploymentName(app *aloystechv2.App) string {
+	if color := activeColor(app); color != "" {
+		return app.Name + "-" + color
+	}
+	return app.Name + "-deploy"
+}
+
+// reconcileBlueGreen 维护 active 和 preview 两个颜色的 Deployment，只有 promote 的时候才切换 Service。
+// legacy 为切换到 blue/green 之前的 -deploy，desired 为按当前 spec 渲染的 Deployment，revision 是它的 template hash
+func (r *AppReconciler) reconcileBlueGreen(ctx context.Context, app *aloystechv2.App, legacy, desired *appsv1.Deployment, revision string) (ctrl.Result, error) {
+	logger := log.FromContext(ctx).WithName("reconcileBlueGreen").WithName(app.Name)
+	st := app.Status.BlueGreen
+	if st == nil {
+		st = &aloystechv2.BlueGreenStatus{}
+		app.Status.BlueGreen = st
+	}
+	action, err := r.takeRolloutAction(ctx, app)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	// 第一次使用 blue/green，先把 blue 作为 active 跑起来，ready 之后再让 Service 只选择 blue，然后删除原来的 -deploy
+	if st.ActiveColor == "" {
+		replicas, err := r.desiredReplicas(ctx, app, nil, nil, desired.Spec.Replicas)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		// HPA 扩出来的副本数跟着原来的 -deploy 走，切换之后不会一下子缩回去
+		if autoscalingEnabled(app) && legacy != nil && legacy.Spec.Replicas != nil {
+			replicas = legacy.Spec.Replicas
+		}
+		blue, err := r.applyColor(ctx, app, desired, ColorBlue, revision, replicas)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		if !deploymentRolledOut(blue) {
+			st.Phase, st.PreviewRevision = aloystechv2.BlueGreenPreviewing, revision
+			st.Message = "waiting for the blue Deployment to become available"
+			if legacy != nil {
+				observeDeployment(app, legacy)
+			} else {
+				observeDeployment(app, blue)
+			}
+			return ctrl.Result{RequeueAfter: canaryCheckInterval}, nil
+		}
+		st.ActiveColor, st.ActiveRevision, st.PreviewRevision = ColorBlue, revision, ""
+		st.Phase, st.Message = aloystechv2.BlueGreenActive, ""
+		if legacy != nil {
+			logger.Info("The blue Deployment is available, delete the Deployment used before blue/green.")
+			if err := r.deleteChild(ctx, app, legacy); err != nil {
+				return ctrl.Result{}, err
+			}
+		}
+		observeDeployment(app, blue)
+		return ctrl.Result{}, nil
+	}
+
+	activeName := app.Name + "-" + st.ActiveColor
+	previewColor := otherColor(st.ActiveColor)
+	active := &appsv1.Deployment{}
+	err = r.Get(ctx, GetNamespacedName(activeName, "", app.Namespace), active)
+	if err != nil && !errors.IsNotFound(err) {
+		return ctrl.Result{}, err
+	}
+	activeExists := err == nil
+
+	// 没有新的 pod template，只更新 active，并在延迟之后删除上一个颜色
+	if revision == st.ActiveRevision || !activeExists {
+		var live client.Object
+		var liveReplicas *int32
+		if activeExists {
+			live, liveReplicas = active, active.Spec.Replicas
+		}
+		replicas, err := r.desiredReplicas(ctx, app, live, liveReplicas, desired.Spec.Replicas)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		applied, err := r.applyColor(ctx, app, desired, st.ActiveColor, revision, replicas)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		st.ActiveRevision, st.PreviewRevision = revision, ""
+		st.Phase, st.Message = aloystechv2.BlueGreenActive, ""
+		observeDeployment(app, applied)
+		return r.scaleDownPreviousColor(ctx, app, previewColor)
+	}
+
+	// active 保持原来的 pod template，新的 pod template 跑在 preview 颜色上
+	observeDeployment(app, active)
+	if st.Phase == aloystechv2.BlueGreenAborted && st.PreviewRevision == revision {
+		if action != aloystechv2.RolloutActionPromote {
+			return ctrl.Result{}, nil
+		}
+		// 放弃之后再次 promote 相当于重新部署 preview
+		action = ""
+	}
+	if action == aloystechv2.RolloutActionAbort {
+		if err := r.deleteIfExists(ctx, app, &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: app.Name + "-" + previewColor, Namespace: app.Namespace}}); err != nil {
+			return ctrl.Result{}, err
+		}
+		st.Phase, st.PreviewRevision = aloystechv2.BlueGreenAborted, revision
+		st.Message = "aborted through the " + aloystechv2.RolloutActionAnnotation + " annotation"
+		r.Eventer.Eventf(app, corev1.EventTypeWarning, "BlueGreenAborted", "The preview revision %s has been aborted, the %s Deployment keeps serving.", revision, activeName)
+		return ctrl.Result{}, nil
+	}
+
+	// preview 按 active 的副本数部署，promote 之后可以直接承接全部流量
+	st.ScaleDownTime = nil
+	preview, err := r.applyColor(ctx, app, desired, previewColor, revision, active.Spec.Replicas)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	if st.PreviewRevision != revision {
+		r.Eventer.Eventf(app, corev1.EventTypeNormal, "BlueGreenPreview", "The revision %s is deployed to the %s preview Deployment.", revision, preview.Name)
+	}
+	st.PreviewRevision = revision
+	if !deploymentRolledOut(preview) {
+		st.Phase = aloystechv2.BlueGreenPreviewing
+		st.Message = fmt.Sprintf("waiting for the %s Deployment to become available", preview.Name)
+		return ctrl.Result{RequeueAfter: canaryCheckInterval}, nil
+	}
+	if action != aloystechv2.RolloutActionPromote && !autoPromotion(app) {
+		st.Phase = aloystechv2.BlueGreenAwaitingPromotion
+		st.Message = fmt.Sprintf("the preview is available, waiting for the %s=%s annotation", aloystechv2.RolloutActionAnnotation, aloystechv2.RolloutActionPromote)
+		return ctrl.Result{}, nil
+	}
+
+	// promote：Service 改为选择 preview 的颜色，上一个颜色在延迟之后删除
+	scaleDownTime := metav1.NewTime(time.Now().Add(app.Spec.Strategy.BlueGreen.ScaleDownDelayOrDefault()))
+	st.ActiveColor, st.ActiveRevision, st.PreviewRevision = previewColor, revision, ""
+	st.Phase, st.Message, st.ScaleDownTime = aloystechv2.BlueGreenActive, "", &scaleDownTime
+	logger.Info("Promote the preview Deployment.", "color", previewColor, "revision", revision)
+	r.Eventer.Eventf(app, corev1.EventTypeNormal, "BlueGreenPromoted", "The %s Deployment with revision %s is now active.", preview.Name, revision)
+	observeDeployment(app, preview)
+	return ctrl.Result{RequeueAfter: app.Spec.Strategy.BlueGreen.ScaleDownDelayOrDefault()}, nil
+}
+
+// applyColor 用 desired 的 pod template 部署指定颜色的 Deployment
+func (r *AppReconciler) applyColor(ctx context.Context, app *aloystechv2.App, desired *appsv1.Deployment, color, revision string, replicas *int32) (*appsv1.Deployment, error) {
+	dp, err := r.templates(app).NewColorDeployment(app, color)
+	if err != nil {
+		return nil, err
+	}
+	if err := ctrl.SetControllerReference(app, dp, r.Scheme); err != nil {
+		return nil, err
+	}
+	// 使用 desired 的 pod template，它已经带上了配置的 hash
+	template := desired.Spec.Template.DeepCopy()
+	template.Labels = dp.Spec.Template.Labels
+	dp.Spec.Template = *template
+	setTopologySpreadSelector(&dp.Spec.Template.Spec, dp.Spec.Selector)
+	dp.Spec.Replicas = replicas
+	setTemplateHash(dp, revision)
+	changed, err := r.applyChild(ctx, app, dp)
+	if err != nil {
+		return nil, err
+	}
+	if changed {
+		log.FromContext(ctx).Info("The Deployment has been applied.", "deployment", dp.Name)
+	}
+	return dp, nil
+}
+
+// scaleDownPreviousColor promote 之后等 ScaleDownTime 到了再删除上一个颜色的 Deployment，期间可以快速切回
+func (r *AppReconciler) scaleDownPreviousColor(ctx context.Context, app *aloystechv2.App, color string) (ctrl.Result, error) {
+	st := app.Status.BlueGreen
+	if st.ScaleDownTime != nil {
+		if remaining := time.Until(st.ScaleDownTime.Time); remaining > 0 {
+			st.Message = fmt.Sprintf("the %s Deployment is removed in %s", color, remaining.Round(time.Second))
+			return ctrl.Result{RequeueAfter: remaining}, nil
+		}
+	}
+	if err := r.deleteIfExists(ctx, app, &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: app.Name + "-" + color, Namespace: app.Namespace}}); err != nil {
+		return ctrl.Result{}, err
+	}
+	st.ScaleDownTime = nil
+	return ctrl.Result{}, nil
+}
+
+// cleanupBlueGreen 不再使用 blue/green 之后删除两个颜色的 Deployment 和 preview Service
+func (r *AppReconciler) cleanupBlueGreen(ctx context.Context, app *aloystechv2.App) error {
+	for _, obj := range []client.Object{
+		&corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: app.Name + "-preview-svc", Namespace: app.Namespace}},
+		&appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: app.Name + "-" + ColorBlue, Namespace: app.Namespace}},
+		&appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: app.Name + "-" + ColorGreen, Namespace: app.Namespace}},
+	} {
+		if err := r.deleteIfExists(ctx, app, obj); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reconcilePreviewService blue/green 有了 active 颜色之后创建 preview Service，否则删除它
+func (r *AppReconciler) reconcilePreviewService(ctx context.Context, app *aloystechv2.App) error {
+	color := activeColor(app)
+	if color == "" {
+		return r.deleteIfExists(ctx, app, &corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: app.Name + "-preview-svc", Namespace: app.Namespace}})
+	}
+	svc, err := r.templates(app).NewPreviewService(app, otherColor(color))
+	if err != nil {
+		return err
+	}
+	if err := ctrl.SetControllerReference(app, svc, r.Scheme); err != nil {
+		return err
+	}
+	_, err = r.applyChild(ctx, app, svc)
+	return err
+}
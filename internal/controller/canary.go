@@ -0,0 +1,324 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	aloystechv2 "aloys.tech/api/v2"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	netv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// canaryCheckInterval canary 的 pod 还没有 ready 或者刚进入下一步时，隔一会儿再检查
+const canaryCheckInterval = 10 * time.Second
+
+// reconcileCanary 按 canary 的步骤推进发布，返回 promote 表示 stable 的 Deployment 可以更新成新的 pod template。
+// stable 为集群里现有的 Deployment，desired 为按当前 spec 渲染的 Deployment，revision 是它的 template hash
+func (r *AppReconciler) reconcileCanary(ctx context.Context, app *aloystechv2.App, stable, desired *appsv1.Deployment, revision string) (promote bool, result ctrl.Result, err error) {
+	logger := log.FromContext(ctx).WithName("reconcileCanary").WithName(app.Name)
+	st := app.Status.Canary
+
+	// stable 已经是新的 pod template，等它滚动完成之后再撤掉 canary
+	if runsRevision(stable, desired, revision) {
+		if st != nil && st.Phase == aloystechv2.CanaryPromoting && st.Revision == revision && !deploymentRolledOut(stable) {
+			st.Message = "waiting for the stable Deployment to roll out the new pod template"
+			return true, ctrl.Result{RequeueAfter: canaryCheckInterval}, nil
+		}
+		if err := r.cleanupCanary(ctx, app); err != nil {
+			return false, ctrl.Result{}, err
+		}
+		// 没有进行中的发布时注解没有意义，直接移除，免得下一次发布一开始就被 promote 或 abort
+		if _, err := r.takeRolloutAction(ctx, app); err != nil {
+			return false, ctrl.Result{}, err
+		}
+		if st != nil && st.Phase == aloystechv2.CanaryPromoting {
+			r.Eventer.Eventf(app, corev1.EventTypeNormal, "CanaryPromoted", "The canary revision %s has been promoted to stable.", st.Revision)
+		}
+		app.Status.Canary = nil
+		return true, ctrl.Result{}, nil
+	}
+
+	if st == nil || st.Revision != revision {
+		st = &aloystechv2.CanaryStatus{Revision: revision, Phase: aloystechv2.CanaryProgressing}
+		app.Status.Canary = st
+		logger.Info("The pod template changed, start a canary rollout.", "revision", revision)
+		r.Eventer.Eventf(app, corev1.EventTypeNormal, "CanaryStarted", "The canary rollout of revision %s started.", revision)
+	}
+	action, err := r.takeRolloutAction(ctx, app)
+	if err != nil {
+		return false, ctrl.Result{}, err
+	}
+	if st.Phase == aloystechv2.CanaryAborted {
+		if action != aloystechv2.RolloutActionPromote {
+			return false, ctrl.Result{}, nil
+		}
+		// 放弃之后再次 promote 相当于从第一步重新开始
+		st.Step, st.Phase, st.StepStartedTime, st.Message = 0, aloystechv2.CanaryProgressing, nil, ""
+		action = ""
+	}
+	if action == aloystechv2.RolloutActionAbort {
+		if err := r.cleanupCanary(ctx, app); err != nil {
+			return false, ctrl.Result{}, err
+		}
+		st.Phase, st.Weight, st.StepStartedTime = aloystechv2.CanaryAborted, 0, nil
+		st.Message = "aborted through the " + aloystechv2.RolloutActionAnnotation + " annotation"
+		r.Eventer.Eventf(app, corev1.EventTypeWarning, "CanaryAborted", "The canary rollout of revision %s has been aborted, all traffic is back on the stable pods.", revision)
+		return false, ctrl.Result{}, nil
+	}
+
+	steps := app.Spec.Strategy.Canary.Steps
+	if st.Phase == aloystechv2.CanaryPromoting || int(st.Step) >= len(steps) {
+		st.Phase, st.Message = aloystechv2.CanaryPromoting, "updating the stable Deployment"
+		return true, ctrl.Result{RequeueAfter: canaryCheckInterval}, nil
+	}
+	step := steps[st.Step]
+	st.Weight = step.Weight
+
+	canary, err := r.templates(app).NewCanaryDeployment(app)
+	if err != nil {
+		return false, ctrl.Result{}, err
+	}
+	if err := ctrl.SetControllerReference(app, canary, r.Scheme); err != nil {
+		return false, ctrl.Result{}, err
+	}
+	// 使用 desired 的 pod template，它已经带上了配置的 hash
+	template := desired.Spec.Template.DeepCopy()
+	template.Labels = canary.Spec.Template.Labels
+	canary.Spec.Template = *template
+	setTopologySpreadSelector(&canary.Spec.Template.Spec, canary.Spec.Selector)
+	replicas := canaryReplicas(deploymentReplicas(stable), step.Weight)
+	canary.Spec.Replicas = &replicas
+	setTemplateHash(canary, revision)
+	if _, err := r.applyChild(ctx, app, canary); err != nil {
+		return false, ctrl.Result{}, err
+	}
+	svc, err := r.templates(app).NewCanaryService(app)
+	if err != nil {
+		return false, ctrl.Result{}, err
+	}
+	if err := ctrl.SetControllerReference(app, svc, r.Scheme); err != nil {
+		return false, ctrl.Result{}, err
+	}
+	if _, err := r.applyChild(ctx, app, svc); err != nil {
+		return false, ctrl.Result{}, err
+	}
+
+	if !deploymentRolledOut(canary) {
+		st.Phase, st.StepStartedTime = aloystechv2.CanaryProgressing, nil
+		st.Message = fmt.Sprintf("waiting for %d canary pods of step %d to become available", replicas, st.Step+1)
+		return false, ctrl.Result{RequeueAfter: canaryCheckInterval}, nil
+	}
+	now := metav1.Now()
+	if st.StepStartedTime == nil {
+		st.StepStartedTime = &now
+	}
+	if action != aloystechv2.RolloutActionPromote {
+		if step.Pause == nil {
+			st.Phase = aloystechv2.CanaryPaused
+			st.Message = fmt.Sprintf("step %d is healthy, waiting for the %s=%s annotation", st.Step+1, aloystechv2.RolloutActionAnnotation, aloystechv2.RolloutActionPromote)
+			return false, ctrl.Result{}, nil
+		}
+		if remaining := st.StepStartedTime.Add(step.Pause.Duration).Sub(now.Time); remaining > 0 {
+			st.Phase = aloystechv2.CanaryPaused
+			st.Message = fmt.Sprintf("step %d is healthy, pausing for %s", st.Step+1, remaining.Round(time.Second))
+			return false, ctrl.Result{RequeueAfter: remaining}, nil
+		}
+	}
+
+	// 当前步骤已经健康并且暂停结束，进入下一步
+	r.Eventer.Eventf(app, corev1.EventTypeNormal, "CanaryStepPromoted", "The canary step %d with %d%% of the traffic has been promoted.", st.Step+1, step.Weight)
+	st.Step++
+	st.StepStartedTime = nil
+	if int(st.Step) >= len(steps) {
+		st.Phase, st.Message = aloystechv2.CanaryPromoting, "updating the stable Deployment"
+		return true, ctrl.Result{RequeueAfter: canaryCheckInterval}, nil
+	}
+	st.Phase, st.Message = aloystechv2.CanaryProgressing, ""
+	return false, ctrl.Result{RequeueAfter: time.Second}, nil
+}
+
+// takeRolloutAction 读取并移除 App 上的 promote/abort 注解，每个注解只生效一次
+func (r *AppReconciler) takeRolloutAction(ctx context.Context, app *aloystechv2.App) (string, error) {
+	action, ok := app.Annotations[aloystechv2.RolloutActionAnnotation]
+	if !ok {
+		return "", nil
+	}
+	// 在副本上 patch，避免 apiserver 返回的 status 覆盖这次协调已经算好的 status
+	patched := app.DeepCopy()
+	delete(patched.Annotations, aloystechv2.RolloutActionAnnotation)
+	if err := r.Patch(ctx, patched, client.MergeFrom(app)); err != nil {
+		return "", err
+	}
+	app.Annotations = patched.Annotations
+	app.ResourceVersion = patched.ResourceVersion
+	switch action {
+	case aloystechv2.RolloutActionPromote, aloystechv2.RolloutActionAbort:
+		log.FromContext(ctx).Info("Taking the rollout action from the annotation.", "action", action)
+		return action, nil
+	default:
+		r.Eventer.Eventf(app, corev1.EventTypeWarning, "UnknownRolloutAction", "The %s annotation %q is ignored, it must be %s or %s.",
+			aloystechv2.RolloutActionAnnotation, action, aloystechv2.RolloutActionPromote, aloystechv2.RolloutActionAbort)
+		return "", nil
+	}
+}
+
+// cleanupCanary 先撤掉 canary 的流量，再删除 canary 的 Service 和 Deployment
+func (r *AppReconciler) cleanupCanary(ctx context.Context, app *aloystechv2.App) error {
+	for _, obj := range []client.Object{
+		&netv1.Ingress{ObjectMeta: metav1.ObjectMeta{Name: app.Name + "-canary-ingress", Namespace: app.Namespace}},
+		&corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: app.Name + "-canary-svc", Namespace: app.Namespace}},
+		&appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: app.Name + "-canary", Namespace: app.Namespace}},
+	} {
+		if err := r.deleteIfExists(ctx, app, obj); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteIfExists 先从缓存里确认子资源存在再删除，没有进行中的 canary 时不会每次协调都请求 apiserver。
+// 不属于 App 的同名对象不删除，见 deleteChild
+func (r *AppReconciler) deleteIfExists(ctx context.Context, owner *aloystechv2.App, obj client.Object) error {
+	err := r.Get(ctx, client.ObjectKeyFromObject(obj), obj)
+	if errors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return r.deleteChild(ctx, owner, obj)
+}
+
+// canaryWeight 返回当前应该分给 canary 的流量比例，没有进行中的 canary 时返回 false
+func canaryWeight(app *aloystechv2.App) (int32, bool) {
+	st := app.Status.Canary
+	if st == nil || st.Phase == aloystechv2.CanaryAborted || st.Weight == 0 {
+		return 0, false
+	}
+	return st.Weight, true
+}
+
+// canaryReplicas canary 的副本数按流量比例从 stable 的副本数折算，至少一个
+func canaryReplicas(stable, weight int32) int32 {
+	replicas := (stable*weight + 99) / 100
+	if replicas < 1 {
+		return 1
+	}
+	return replicas
+}
+
+// deploymentRolledOut Deployment 的最新 pod template 已经全部更新并且可用
+func deploymentRolledOut(dp *appsv1.Deployment) bool {
+	replicas := deploymentReplicas(dp)
+	return dp.Status.ObservedGeneration >= dp.Generation &&
+		dp.Status.UpdatedReplicas >= replicas &&
+		dp.Status.AvailableReplicas >= replicas &&
+		dp.Status.Replicas == dp.Status.UpdatedReplicas
+}
+
+// reconcileCanaryIngress 有进行中的 canary 时创建带 canary-weight 注解的 Ingress，否则删除它
+func (r *AppReconciler) reconcileCanaryIngress(ctx context.Context, app *aloystechv2.App) error {
+	weight, ok := canaryWeight(app)
+	if !ok || !ingressEnabled(app) {
+		return r.deleteIfExists(ctx, app, &netv1.Ingress{ObjectMeta: metav1.ObjectMeta{Name: app.Name + "-canary-ingress", Namespace: app.Namespace}})
+	}
+	ing, err := r.templates(app).NewCanaryIngress(app, weight)
+	if err != nil {
+		return err
+	}
+	if err := ctrl.SetControllerReference(app, ing, r.Scheme); err != nil {
+		return err
+	}
+	_, err = r.applyChild(ctx, app, ing)
+	return err
+}
+
+// splitCanaryBackends 把路由里指向 App Service 的 backend 拆成 stable 和 canary 两个，按 weight 分流。
+// 用户给 backend 配置的权重会保留：App Service 的权重按 weight 拆开，其余 backend 同比放大，各 backend 之间的比例不变
+func splitCanaryBackends(route *unstructured.Unstructured, app *aloystechv2.App, weight int32) {
+	rules, _, _ := unstructured.NestedSlice(route.Object, "spec", "rules")
+	for i, rule := range rules {
+		ruleMap, ok := rule.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		refs, _, _ := unstructured.NestedSlice(ruleMap, "backendRefs")
+		var split []map[string]interface{}
+		var weights []int64
+		found := false
+		for _, ref := range refs {
+			refMap, ok := ref.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			// Gateway API 里没写 weight 的 backend 权重是 1
+			w := backendWeight(refMap)
+			if refMap["name"] != app.Name+"-svc" {
+				split = append(split, refMap)
+				weights = append(weights, w*100)
+				continue
+			}
+			found = true
+			canary := runtime.DeepCopyJSON(refMap)
+			canary["name"] = app.Name + "-canary-svc"
+			split = append(split, refMap, canary)
+			weights = append(weights, w*int64(100-weight), w*int64(weight))
+		}
+		if !found {
+			continue
+		}
+		weights = reduceWeights(weights)
+		backendRefs := make([]interface{}, 0, len(split))
+		for j, refMap := range split {
+			refMap["weight"] = weights[j]
+			backendRefs = append(backendRefs, refMap)
+		}
+		ruleMap["backendRefs"] = backendRefs
+		rules[i] = ruleMap
+	}
+	_ = unstructured.SetNestedSlice(route.Object, rules, "spec", "rules")
+}
+
+// backendWeight 读取 backendRef 的 weight，没有设置时按 Gateway API 的默认值 1 处理
+func backendWeight(ref map[string]interface{}) int64 {
+	switch w := ref["weight"].(type) {
+	case int64:
+		return w
+	case int32:
+		return int64(w)
+	case int:
+		return int64(w)
+	case float64:
+		return int64(w)
+	}
+	return 1
+}
+
+// maxBackendWeight Gateway API 允许的 backend 最大权重
+const maxBackendWeight = 1000000
+
+// reduceWeights 超过 Gateway API 的权重上限时等比缩小，非 0 的权重至少保留 1
+func reduceWeights(weights []int64) []int64 {
+	var top int64
+	for _, w := range weights {
+		top = max(top, w)
+	}
+	if top <= maxBackendWeight {
+		return weights
+	}
+	for i, w := range weights {
+		if w > 0 {
+			weights[i] = max(w*maxBackendWeight/top, 1)
+		}
+	}
+	return weights
+}
@@ -0,0 +1,152 @@
+package controller
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+
+	aloystechv2 "aloys.tech/api/v2"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+const (
+	// ConfigHashAnnotation 写在 pod template 上，引用的 ConfigMap/Secret 内容变化时 hash 跟着变，Deployment 就会滚动更新
+	ConfigHashAnnotation = "aloys.tech/config-hash"
+
+	// configMapIndexKey/secretIndexKey 是 App 上的索引，用来从 ConfigMap/Secret 反查引用它的 App
+	configMapIndexKey = ".spec.deployment.configMapRefs"
+	secretIndexKey    = ".spec.deployment.secretRefs"
+)
+
+// referencedConfigMaps 返回 App 通过 env、envFrom 和挂载引用的所有 ConfigMap，已排序去重
+func referencedConfigMaps(app *aloystechv2.App) []string {
+	d := app.Spec.Deployment
+	names := map[string]bool{}
+	for _, e := range d.Env {
+		if e.ValueFrom != nil && e.ValueFrom.ConfigMapKeyRef != nil {
+			names[e.ValueFrom.ConfigMapKeyRef.Name] = true
+		}
+	}
+	for _, e := range d.EnvFrom {
+		if e.ConfigMapRef != nil {
+			names[e.ConfigMapRef.Name] = true
+		}
+	}
+	for _, m := range d.ConfigMaps {
+		names[m.Name] = true
+	}
+	return sortedKeys(names)
+}
+
+// referencedSecrets 返回 App 通过 env、envFrom 和挂载引用的所有 Secret，已排序去重
+func referencedSecrets(app *aloystechv2.App) []string {
+	d := app.Spec.Deployment
+	names := map[string]bool{}
+	for _, e := range d.Env {
+		if e.ValueFrom != nil && e.ValueFrom.SecretKeyRef != nil {
+			names[e.ValueFrom.SecretKeyRef.Name] = true
+		}
+	}
+	for _, e := range d.EnvFrom {
+		if e.SecretRef != nil {
+			names[e.SecretRef.Name] = true
+		}
+	}
+	for _, m := range d.Secrets {
+		names[m.Name] = true
+	}
+	return sortedKeys(names)
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		if k != "" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// configHash 计算 App 引用的 ConfigMap/Secret 内容的 hash，不存在的对象也参与计算，创建出来之后同样会触发滚动更新。
+// 没有引用任何配置时返回空字符串，pod template 上也就不写这个注解
+func (r *AppReconciler) configHash(ctx context.Context, app *aloystechv2.App) (string, error) {
+	configMaps, secrets := referencedConfigMaps(app), referencedSecrets(app)
+	if len(configMaps) == 0 && len(secrets) == 0 {
+		return "", nil
+	}
+	h := sha256.New()
+	for _, name := range configMaps {
+		cm := &corev1.ConfigMap{}
+		err := r.Get(ctx, types.NamespacedName{Namespace: app.Namespace, Name: name}, cm)
+		if err != nil && !errors.IsNotFound(err) {
+			return "", err
+		}
+		writeHashEntry(h, "configmap/"+name, cm.Data, cm.BinaryData)
+	}
+	for _, name := range secrets {
+		secret := &corev1.Secret{}
+		err := r.Get(ctx, types.NamespacedName{Namespace: app.Namespace, Name: name}, secret)
+		if err != nil && !errors.IsNotFound(err) {
+			return "", err
+		}
+		writeHashEntry(h, "secret/"+name, nil, secret.Data)
+	}
+	return hex.EncodeToString(h.Sum(nil))[:16], nil
+}
+
+func writeHashEntry(h interface{ Write([]byte) (int, error) }, name string, data map[string]string, binaryData map[string][]byte) {
+	h.Write([]byte(name))
+	h.Write([]byte{0})
+	keys := make([]string, 0, len(data)+len(binaryData))
+	for k := range data {
+		keys = append(keys, k)
+	}
+	for k := range binaryData {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		h.Write([]byte(k))
+		h.Write([]byte{0})
+		if v, ok := data[k]; ok {
+			h.Write([]byte(v))
+		} else {
+			h.Write(binaryData[k])
+		}
+		h.Write([]byte{0})
+	}
+}
+
+// appsForConfigMap 通过索引找到引用这个 ConfigMap 的 App 并加入队列，app-templates 变化时加入使用这些模板的 App
+func (r *AppReconciler) appsForConfigMap(ctx context.Context, obj client.Object) []reconcile.Request {
+	if obj.GetName() == TemplateConfigMapName {
+		return append(r.appsForTemplates(ctx, obj), r.appsReferencing(ctx, configMapIndexKey, obj)...)
+	}
+	return r.appsReferencing(ctx, configMapIndexKey, obj)
+}
+
+// appsForSecret 通过索引找到引用这个 Secret 的 App 并加入队列
+func (r *AppReconciler) appsForSecret(ctx context.Context, obj client.Object) []reconcile.Request {
+	return r.appsReferencing(ctx, secretIndexKey, obj)
+}
+
+func (r *AppReconciler) appsReferencing(ctx context.Context, indexKey string, obj client.Object) []reconcile.Request {
+	apps := &aloystechv2.AppList{}
+	if err := r.List(ctx, apps, client.InNamespace(obj.GetNamespace()), client.MatchingFields{indexKey: obj.GetName()}); err != nil {
+		log.FromContext(ctx).Error(err, "Failed to list the apps referencing the object.", "index", indexKey, "name", obj.GetName())
+		return nil
+	}
+	requests := make([]reconcile.Request, 0, len(apps.Items))
+	for _, app := range apps.Items {
+		requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Namespace: app.Namespace, Name: app.Name}})
+	}
+	return requests
+}
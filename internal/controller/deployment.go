@@ -2,74 +2,159 @@ package controller
 
 import (
 	"context"
-	corev1 "k8s.io/api/core/v1"
-	"reflect"
 
-	aloystechv1 "aloys.tech/api/v1"
-	"aloys.tech/internal/utils"
+	aloystechv2 "aloys.tech/api/v2"
 	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/log"
 )
 
-func (r *AppReconciler) reconcileDeployment(ctx context.Context, app *aloystechv1.App) (ctrl.Result, error) {
+func (r *AppReconciler) reconcileDeployment(ctx context.Context, app *aloystechv2.App) (ctrl.Result, error) {
 	deployName := app.Name + "-deploy"
 	logger := log.FromContext(ctx).WithName("reconcileDeployment").WithName(deployName)
-	// 创建使用模版，是为了可以在模块添加一些亲和性，资源请求这些配置,这步骤在前面是想判断一下deploy的内容是否需要更新
-	appDeploy := utils.NewDeployment(app)
-	if err := ctrl.SetControllerReference(app, appDeploy, r.Scheme); err != nil {
-		logger.Error(err, "Failed to set the controller reference for the app deployment,will requeue after a short time.")
-		return ctrl.Result{RequeueAfter: GenericRequeueDuration}, err
-	}
 	dp := &appsv1.Deployment{}
 	err := r.Get(ctx, GetNamespacedName(app.Name, "-deploy", app.Namespace), dp)
-	// 能查询到 err == nil
-	if err == nil {
-		logger.Info("The Deployment already exists.")
-		// 判断是否需要更新deploy,
-		if !reflect.DeepEqual(dp.Spec, appDeploy.Spec) {
-			// 不相同进行更新,这里想比较一样，看谁的版本谁最新的，进行更新那个版本
-			// 这里是想如果直接修改了deploy，那就按照修改的执行，但是不能确认修改了什么，监听的时候就很杂乱
-			// if dp.GetResourceVersion() > appDeploy.GetResourceVersion() {
-			// 	appDeploy.Spec.Replicas = dp.Spec.Replicas
-			// }
-			logger.Info("This Deployment has been updated. Update it. ")
-			if err := r.Update(ctx, appDeploy); err != nil {
-				logger.Error(err, "Failed to update the deployment,will requeue after a short time.")
-				r.Eventer.Eventf(appDeploy, corev1.EventTypeNormal, "DeploymentUpdated", "Failed to update the %s deployment ,will requeue after a short time. namespace: %s", appDeploy.Name, appDeploy.Namespace)
-				return ctrl.Result{RequeueAfter: GenericRequeueDuration}, err
-			}
-			logger.Info("The Deployment updated successfully.")
-			r.Eventer.Eventf(appDeploy, corev1.EventTypeNormal, "Deployment Updated", "The %s Deployment updated successfully. namespace:%s", appDeploy.Name, appDeploy.Namespace)
+	if err != nil && !errors.IsNotFound(err) {
+		logger.Error(err, "Failed to get the Deployment,will requeue after a short time.")
+		return ctrl.Result{RequeueAfter: GenericRequeueDuration}, err
+	}
+	exists := err == nil
+
+	// 不再使用 canary 策略之后撤掉进行中的 canary
+	if app.Status.Canary != nil && (!app.Spec.Strategy.IsCanary() || workloadKind(app) != aloystechv2.WorkloadDeployment) {
+		if err := r.cleanupCanary(ctx, app); err != nil {
+			logger.Error(err, "Failed to clean up the canary,will requeue after a short time.")
+			return ctrl.Result{RequeueAfter: GenericRequeueDuration}, err
 		}
-		// 判断deploy status 是否需要更新
-		if !reflect.DeepEqual(dp.Status, app.Status.DeploymentStatus) {
-			logger.Info("This Deployment Status has been updated. Update it.")
-			app.Status.DeploymentStatus = dp.Status
-			// 更新Status
-			if err := r.Status().Update(ctx, app); err != nil {
-				logger.Error(err, "Failed to update the app status,will requeue after a short time.")
-				r.Eventer.Eventf(appDeploy, corev1.EventTypeNormal, "App status Updated", "Failed to update the %s status,will requeue after a short time. namespace: %s", app.Name, app.Namespace)
+		app.Status.Canary = nil
+	}
+
+	// 工作负载切换成其他类型之后两种颜色的 Deployment 也不再需要
+	if app.Status.BlueGreen != nil && workloadKind(app) != aloystechv2.WorkloadDeployment {
+		if err := r.cleanupBlueGreen(ctx, app); err != nil {
+			logger.Error(err, "Failed to clean up the blue/green Deployments,will requeue after a short time.")
+			return ctrl.Result{RequeueAfter: GenericRequeueDuration}, err
+		}
+		app.Status.BlueGreen = nil
+	}
+
+	// 工作负载切换成其他类型之后删除原来的 Deployment
+	if workloadKind(app) != aloystechv2.WorkloadDeployment {
+		if exists {
+			logger.Info("The workload kind is not Deployment, delete the Deployment.", "kind", workloadKind(app))
+			if err := r.deleteChild(ctx, app, dp); err != nil {
+				logger.Error(err, "Failed to delete the Deployment,will requeue after a short time.")
 				return ctrl.Result{RequeueAfter: GenericRequeueDuration}, err
 			}
-			r.Eventer.Eventf(appDeploy, corev1.EventTypeNormal, "Deployment  status Updated", "This Deployment status has been updated.")
-			logger.Info("The Deployment status has been updated successfully.")
 		}
+		observeDeployment(app, nil)
 		return ctrl.Result{}, nil
 	}
-	// 错误不是NotFound 直接结束本轮
-	if !errors.IsNotFound(err) {
-		logger.Error(err, "Failed to get the Deployment,will requeue after a short time.")
+
+	// 创建使用模版，是为了可以在模块添加一些亲和性，资源请求这些配置
+	appDeploy, err := r.templates(app).NewDeployment(app)
+	if err != nil {
+		logger.Error(err, "Failed to render the app deployment.")
+		return ctrl.Result{}, err
+	}
+	if err := ctrl.SetControllerReference(app, appDeploy, r.Scheme); err != nil {
+		logger.Error(err, "Failed to set the controller reference for the app deployment,will requeue after a short time.")
 		return ctrl.Result{RequeueAfter: GenericRequeueDuration}, err
 	}
-	// 创建
-	// logger.Info("The Deployment start creating.")
-	if err := r.Create(ctx, appDeploy); err != nil {
-		logger.Error(err, "Failed to create the deployment,will requeue after a short time.")
+	// 引用的 ConfigMap/Secret 内容变化时修改 pod template 上的 hash，触发滚动更新
+	hash, err := r.configHash(ctx, app)
+	if err != nil {
+		logger.Error(err, "Failed to compute the config hash,will requeue after a short time.")
 		return ctrl.Result{RequeueAfter: GenericRequeueDuration}, err
 	}
-	r.Eventer.Eventf(appDeploy, corev1.EventTypeNormal, "Deployment created", "This Deployment created.")
-	logger.Info("The Deployment has been created.")
-	return ctrl.Result{}, nil
+	setConfigHash(&appDeploy.Spec.Template, hash)
+	r.setDefaultTopologySpread(app, &appDeploy.Spec.Template.Spec)
+	revision, err := specHash(appDeploy.Spec.Template)
+	if err != nil {
+		return ctrl.Result{RequeueAfter: GenericRequeueDuration}, err
+	}
+	setTemplateHash(appDeploy, revision)
+
+	if app.Spec.Strategy.IsBlueGreen() {
+		var legacy *appsv1.Deployment
+		if exists {
+			legacy = dp
+		}
+		result, err := r.reconcileBlueGreen(ctx, app, legacy, appDeploy, revision)
+		if err != nil {
+			logger.Error(err, "Failed to reconcile the blue/green Deployments,will requeue after a short time.")
+			return ctrl.Result{RequeueAfter: GenericRequeueDuration}, err
+		}
+		return result, nil
+	}
+
+	if rolledBack(app, revision) && app.Status.Canary != nil {
+		if err := r.cleanupCanary(ctx, app); err != nil {
+			logger.Error(err, "Failed to clean up the canary,will requeue after a short time.")
+			return ctrl.Result{RequeueAfter: GenericRequeueDuration}, err
+		}
+		app.Status.Canary = nil
+	}
+
+	var result ctrl.Result
+	if app.Spec.Strategy.IsCanary() && exists && !rolledBack(app, revision) {
+		var promote bool
+		promote, result, err = r.reconcileCanary(ctx, app, dp, appDeploy, revision)
+		if err != nil {
+			logger.Error(err, "Failed to reconcile the canary,will requeue after a short time.")
+			return ctrl.Result{RequeueAfter: GenericRequeueDuration}, err
+		}
+		// canary 发布完成之前 stable 保持原来的 pod template
+		if !promote {
+			observeDeployment(app, dp)
+			return result, nil
+		}
+	}
+
+	var live client.Object
+	var liveDeploy *appsv1.Deployment
+	if exists {
+		live, liveDeploy = dp, dp
+	}
+	// 开启自动回滚时，新的 pod template 超过发布期限后换回最后一个发布成功的版本
+	if err := r.reconcileRollback(ctx, app, liveDeploy, appDeploy, revision); err != nil {
+		logger.Error(err, "Failed to roll back the Deployment,will requeue after a short time.")
+		return ctrl.Result{RequeueAfter: GenericRequeueDuration}, err
+	}
+	replicas, err := r.desiredReplicas(ctx, app, live, dp.Spec.Replicas, appDeploy.Spec.Replicas)
+	if err != nil {
+		logger.Error(err, "Failed to restore the deployment replicas,will requeue after a short time.")
+		return ctrl.Result{RequeueAfter: GenericRequeueDuration}, err
+	}
+	appDeploy.Spec.Replicas = replicas
+	setTopologySpreadSelector(&appDeploy.Spec.Template.Spec, appDeploy.Spec.Selector)
+
+	// server-side apply 只比较 controller 拥有的字段，apiserver 填充的默认值不会再导致每次都更新
+	changed, err := r.applyChild(ctx, app, appDeploy)
+	if err != nil {
+		logger.Error(err, "Failed to apply the deployment,will requeue after a short time.")
+		return ctrl.Result{RequeueAfter: GenericRequeueDuration}, err
+	}
+	if changed {
+		logger.Info("The Deployment has been applied.")
+		r.Eventer.Eventf(app, corev1.EventTypeNormal, "DeploymentApplied", "The %s Deployment applied successfully. namespace:%s", appDeploy.Name, appDeploy.Namespace)
+	}
+	observeDeployment(app, appDeploy)
+
+	// 不再使用 blue/green 之后，等 -deploy 可用了再删除两种颜色，避免 Service 短暂没有可用的 pod
+	if app.Status.BlueGreen != nil {
+		if !deploymentRolledOut(appDeploy) {
+			return earlierRequeue(result, ctrl.Result{RequeueAfter: canaryCheckInterval}), nil
+		}
+		if err := r.cleanupBlueGreen(ctx, app); err != nil {
+			logger.Error(err, "Failed to clean up the blue/green Deployments,will requeue after a short time.")
+			return ctrl.Result{RequeueAfter: GenericRequeueDuration}, err
+		}
+		logger.Info("The Deployment is available, the blue/green Deployments have been deleted.")
+		app.Status.BlueGreen = nil
+	}
+	return result, nil
 }
@@ -0,0 +1,273 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	aloystechv2 "aloys.tech/api/v2"
+	appsv1 "k8s.io/api/apps/v1"
+	autoscalingv2 "k8s.io/api/autoscaling/v2"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	netv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// deletionCheckInterval 等待 hook 和子资源删除时，隔一会儿再检查
+const deletionCheckInterval = 5 * time.Second
+
+// ensureFinalizer 给 App 加上 finalizer，删除时才有机会运行 hook 和按 deletionPolicy 处理子资源
+func (r *AppReconciler) ensureFinalizer(ctx context.Context, app *aloystechv2.App) error {
+	if controllerutil.ContainsFinalizer(app, aloystechv2.AppFinalizer) {
+		return nil
+	}
+	patched := app.DeepCopy()
+	controllerutil.AddFinalizer(patched, aloystechv2.AppFinalizer)
+	// finalizers 是整个列表替换，带上 resourceVersion 避免覆盖别人同时加的 finalizer
+	if err := r.Patch(ctx, patched, client.MergeFromWithOptions(app, client.MergeFromWithOptimisticLock{})); err != nil {
+		return err
+	}
+	app.Finalizers, app.ResourceVersion = patched.Finalizers, patched.ResourceVersion
+	return nil
+}
+
+// finalize App 被删除之后先运行 pre-delete hook，再按 deletionPolicy 删除或保留子资源，全部处理完才移除 finalizer
+func (r *AppReconciler) finalize(ctx context.Context, app *aloystechv2.App) (ctrl.Result, error) {
+	if !controllerutil.ContainsFinalizer(app, aloystechv2.AppFinalizer) {
+		return ctrl.Result{}, nil
+	}
+	logger := log.FromContext(ctx).WithName("finalize").WithName(app.Name)
+	oldStatus := app.Status.DeepCopy()
+	if app.Status.Deletion == nil {
+		app.Status.Deletion = &aloystechv2.DeletionStatus{}
+	}
+
+	done, err := r.runPreDeleteHook(ctx, app)
+	// hook 渲染失败时等 spec 或模板修改，不按错误重试
+	if r.observeRenderFailed(app, err) {
+		err = nil
+	}
+	if err == nil && done {
+		done, err = r.removeChildren(ctx, app)
+	}
+	if statusErr := r.updateStatus(ctx, app, oldStatus); statusErr != nil && err == nil {
+		err = statusErr
+	}
+	if err != nil {
+		logger.Error(err, "Failed to clean up the app,will requeue after a short time.")
+		return ctrl.Result{RequeueAfter: GenericRequeueDuration}, err
+	}
+	if !done {
+		if app.Status.Deletion.Phase == aloystechv2.DeletionHookFailed {
+			// 失败的 hook 不会自己恢复，等用户删除 hook Job 或者修改 spec 时再协调
+			return ctrl.Result{}, nil
+		}
+		return ctrl.Result{RequeueAfter: deletionCheckInterval}, nil
+	}
+
+	patched := app.DeepCopy()
+	controllerutil.RemoveFinalizer(patched, aloystechv2.AppFinalizer)
+	if err := r.Patch(ctx, patched, client.MergeFromWithOptions(app, client.MergeFromWithOptimisticLock{})); err != nil && !errors.IsNotFound(err) {
+		logger.Error(err, "Failed to remove the finalizer,will requeue after a short time.")
+		return ctrl.Result{RequeueAfter: GenericRequeueDuration}, err
+	}
+	logger.Info("The app has been cleaned up, the finalizer removed.", "deletionPolicy", app.Spec.DeletionPolicyOrDefault())
+	return ctrl.Result{}, nil
+}
+
+// runPreDeleteHook 创建 hook Job 并等待它完成，没有配置 hook 时直接返回 true
+func (r *AppReconciler) runPreDeleteHook(ctx context.Context, app *aloystechv2.App) (bool, error) {
+	hook := app.Spec.PreDeleteHook
+	if hook == nil {
+		return true, nil
+	}
+	st := app.Status.Deletion
+	st.HookJob = app.Name + "-predelete"
+	job := &batchv1.Job{}
+	err := r.Get(ctx, GetNamespacedName(app.Name, "-predelete", app.Namespace), job)
+	if errors.IsNotFound(err) {
+		job, err = r.templates(app).NewPreDeleteJob(app)
+		if err != nil {
+			return false, err
+		}
+		if err := ctrl.SetControllerReference(app, job, r.Scheme); err != nil {
+			return false, err
+		}
+		if err := r.Create(ctx, job); err != nil && !errors.IsAlreadyExists(err) {
+			return false, err
+		}
+		st.Phase, st.Message = aloystechv2.DeletionRunningHook, "waiting for the pre-delete hook to complete"
+		r.Eventer.Eventf(app, corev1.EventTypeNormal, "PreDeleteHookStarted", "The %s pre-delete hook Job has been created.", job.Name)
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	for _, c := range job.Status.Conditions {
+		if c.Status != corev1.ConditionTrue {
+			continue
+		}
+		switch c.Type {
+		case batchv1.JobComplete:
+			return true, nil
+		case batchv1.JobFailed:
+			if hook.IgnoreFailure {
+				if st.Phase != aloystechv2.DeletionRemovingChildren {
+					r.Eventer.Eventf(app, corev1.EventTypeWarning, "PreDeleteHookFailed", "The %s pre-delete hook failed, the failure is ignored: %s", job.Name, c.Message)
+				}
+				return true, nil
+			}
+			if st.Phase != aloystechv2.DeletionHookFailed {
+				r.Eventer.Eventf(app, corev1.EventTypeWarning, "PreDeleteHookFailed", "The %s pre-delete hook failed, delete the Job to retry it: %s", job.Name, c.Message)
+			}
+			st.Phase = aloystechv2.DeletionHookFailed
+			st.Message = fmt.Sprintf("the pre-delete hook failed (%s: %s), delete the %s Job to retry it", c.Reason, c.Message, job.Name)
+			return false, nil
+		}
+	}
+	st.Phase, st.Message = aloystechv2.DeletionRunningHook, "waiting for the pre-delete hook to complete"
+	return false, nil
+}
+
+// retained 判断子资源是否按 deletionPolicy 保留，hook Job 总是删除
+func retained(app *aloystechv2.App, obj client.Object) bool {
+	if _, ok := obj.(*batchv1.Job); ok && obj.GetName() == app.Name+"-predelete" {
+		return false
+	}
+	switch app.Spec.DeletionPolicyOrDefault() {
+	case aloystechv2.DeletionPolicyOrphan:
+		return true
+	case aloystechv2.DeletionPolicyRetainIngressAndService:
+		switch o := obj.(type) {
+		case *corev1.Service, *netv1.Ingress:
+			return true
+		case *unstructured.Unstructured:
+			return o.GroupVersionKind().Group == GatewayAPIGroup
+		}
+	}
+	return false
+}
+
+// removeChildren 保留的子资源去掉指向 App 的 owner reference，其余的删除，全部删除完成后返回 true
+func (r *AppReconciler) removeChildren(ctx context.Context, app *aloystechv2.App) (bool, error) {
+	st := app.Status.Deletion
+	children, err := r.ownedChildren(ctx, app)
+	if err != nil {
+		return false, err
+	}
+	var remaining []string
+	for _, obj := range children {
+		name, err := r.childName(obj)
+		if err != nil {
+			return false, err
+		}
+		if retained(app, obj) {
+			if err := r.orphan(ctx, app, obj); err != nil {
+				return false, err
+			}
+			st.RetainedChildren = appendUnique(st.RetainedChildren, name)
+			continue
+		}
+		remaining = append(remaining, name)
+		if obj.GetDeletionTimestamp() != nil {
+			continue
+		}
+		if err := r.Delete(ctx, obj, client.PropagationPolicy(metav1.DeletePropagationBackground)); err != nil && !errors.IsNotFound(err) {
+			return false, err
+		}
+	}
+	st.RemainingChildren = remaining
+	if len(remaining) > 0 {
+		st.Phase, st.Message = aloystechv2.DeletionRemovingChildren, fmt.Sprintf("waiting for %d children to be deleted", len(remaining))
+		return false, nil
+	}
+	st.Phase, st.Message = aloystechv2.DeletionRemovingChildren, "all children have been removed"
+	if len(st.RetainedChildren) > 0 {
+		st.Message = "retained " + strings.Join(st.RetainedChildren, ", ")
+	}
+	return true, nil
+}
+
+// ownedChildren 列出 controller 为 App 创建的所有子资源
+func (r *AppReconciler) ownedChildren(ctx context.Context, app *aloystechv2.App) ([]client.Object, error) {
+	lists := []client.ObjectList{
+		&appsv1.DeploymentList{},
+		&appsv1.StatefulSetList{},
+		&batchv1.JobList{},
+		&batchv1.CronJobList{},
+		&autoscalingv2.HorizontalPodAutoscalerList{},
+		&corev1.ServiceList{},
+		&netv1.IngressList{},
+		&appsv1.ControllerRevisionList{},
+	}
+	for _, route := range r.gatewayRoutes() {
+		if route.gvk == nil {
+			continue
+		}
+		list := &unstructured.UnstructuredList{}
+		list.SetGroupVersionKind(route.gvk.GroupVersion().WithKind(route.kind + "List"))
+		lists = append(lists, list)
+	}
+
+	var children []client.Object
+	for _, list := range lists {
+		if err := r.List(ctx, list, client.InNamespace(app.Namespace)); err != nil {
+			return nil, err
+		}
+		items, err := meta.ExtractList(list)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range items {
+			obj, ok := item.(client.Object)
+			if ok && metav1.IsControlledBy(obj, app) {
+				children = append(children, obj)
+			}
+		}
+	}
+	return children, nil
+}
+
+// orphan 去掉子资源上指向 App 的 owner reference，App 删除之后垃圾回收不会再删除它
+func (r *AppReconciler) orphan(ctx context.Context, app *aloystechv2.App, obj client.Object) error {
+	patched := obj.DeepCopyObject().(client.Object)
+	var refs []metav1.OwnerReference
+	for _, ref := range obj.GetOwnerReferences() {
+		if ref.UID != app.UID {
+			refs = append(refs, ref)
+		}
+	}
+	patched.SetOwnerReferences(refs)
+	if err := r.Patch(ctx, patched, client.MergeFrom(obj)); err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+func (r *AppReconciler) childName(obj client.Object) (string, error) {
+	gvk, err := apiutil.GVKForObject(obj, r.Scheme)
+	if err != nil {
+		return "", err
+	}
+	return gvk.Kind + "/" + obj.GetName(), nil
+}
+
+func appendUnique(list []string, s string) []string {
+	for _, v := range list {
+		if v == s {
+			return list
+		}
+	}
+	return append(list, s)
+}
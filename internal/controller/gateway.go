@@ -0,0 +1,218 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	aloystechv2 "aloys.tech/api/v2"
+	"aloys.tech/internal/utils"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const GatewayAPIGroup = "gateway.networking.k8s.io"
+
+// gatewayRoute 描述一种 Gateway API 路由，gvk 为 nil 表示集群里没有对应的 CRD
+type gatewayRoute struct {
+	kind   string
+	suffix string
+	gvk    *schema.GroupVersionKind
+	wanted func(app *aloystechv2.App) bool
+	render func(set *utils.TemplateSet, app *aloystechv2.App) (*unstructured.Unstructured, error)
+}
+
+// discoverGatewayAPI 通过 RESTMapper 查找 HTTPRoute 和 GRPCRoute 的 CRD，使用 apiserver 的首选版本
+// 启动之后才安装的 CRD 需要重启 controller 才能生效
+func (r *AppReconciler) discoverGatewayAPI(mapper meta.RESTMapper) error {
+	for kind, gvk := range map[string]**schema.GroupVersionKind{"HTTPRoute": &r.httpRouteGVK, "GRPCRoute": &r.grpcRouteGVK} {
+		mapping, err := mapper.RESTMapping(schema.GroupKind{Group: GatewayAPIGroup, Kind: kind})
+		if meta.IsNoMatchError(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		found := mapping.GroupVersionKind
+		*gvk = &found
+	}
+	return nil
+}
+
+func gatewayEnabled(app *aloystechv2.App) bool {
+	return app.Spec.Exposure.GatewayAPIEnabled() && !isBatch(app)
+}
+
+func (r *AppReconciler) gatewayRoutes() []gatewayRoute {
+	return []gatewayRoute{
+		{kind: "HTTPRoute", suffix: "-httproute", gvk: r.httpRouteGVK, wanted: gatewayEnabled, render: (*utils.TemplateSet).NewHTTPRoute},
+		{kind: "GRPCRoute", suffix: "-grpcroute", gvk: r.grpcRouteGVK, render: (*utils.TemplateSet).NewGRPCRoute, wanted: func(app *aloystechv2.App) bool {
+			return gatewayEnabled(app) && len(app.Spec.Exposure.Gateway.GRPCRules) > 0
+		}},
+	}
+}
+
+func (r *AppReconciler) reconcileGatewayRoutes(ctx context.Context, app *aloystechv2.App) (ctrl.Result, error) {
+	logger := log.FromContext(ctx).WithName("reconcileGatewayRoutes").WithName(app.Name)
+	var applied []*unstructured.Unstructured
+	var missing []string
+	for _, route := range r.gatewayRoutes() {
+		if !route.wanted(app) {
+			if err := r.deleteGatewayRoute(ctx, app, route); err != nil {
+				logger.Error(err, "Failed to delete the route,will requeue after a short time.", "kind", route.kind)
+				return ctrl.Result{RequeueAfter: GenericRequeueDuration}, err
+			}
+			continue
+		}
+		if route.gvk == nil {
+			missing = append(missing, route.kind)
+			continue
+		}
+		obj, err := route.render(r.templates(app), app)
+		if err != nil {
+			logger.Error(err, "Failed to render the route.", "kind", route.kind)
+			return ctrl.Result{}, err
+		}
+		obj.SetGroupVersionKind(*route.gvk)
+		if weight, ok := canaryWeight(app); ok {
+			splitCanaryBackends(obj, app, weight)
+		}
+		if err := ctrl.SetControllerReference(app, obj, r.Scheme); err != nil {
+			logger.Error(err, "Failed to set the controller reference for the route,will requeue after a short time.", "kind", route.kind)
+			return ctrl.Result{RequeueAfter: GenericRequeueDuration}, err
+		}
+		changed, err := r.applyChild(ctx, app, obj)
+		if err != nil {
+			logger.Error(err, "Failed to apply the route,will requeue after a short time.", "kind", route.kind)
+			return ctrl.Result{RequeueAfter: GenericRequeueDuration}, err
+		}
+		if changed {
+			logger.Info("The route has been applied.", "kind", route.kind)
+		}
+		applied = append(applied, obj)
+	}
+	observeGatewayRoutes(app, applied)
+	if len(missing) > 0 {
+		// 缺少 CRD 不是重试能解决的问题，记录到 condition 上等 CRD 安装之后再处理
+		msg := fmt.Sprintf("the %s CRDs of %s are not installed in the cluster", strings.Join(missing, ", "), GatewayAPIGroup)
+		r.Eventer.Eventf(app, corev1.EventTypeWarning, ReasonGatewayAPIUnavailable, "Failed to expose the app through the Gateway API, %s.", msg)
+		setCondition(app, aloystechv2.ConditionRouteAccepted, metav1.ConditionFalse, ReasonGatewayAPIUnavailable, msg)
+	}
+	return ctrl.Result{}, nil
+}
+
+func (r *AppReconciler) deleteGatewayRoute(ctx context.Context, app *aloystechv2.App, route gatewayRoute) error {
+	if route.gvk == nil {
+		return nil
+	}
+	obj := &unstructured.Unstructured{}
+	obj.SetGroupVersionKind(*route.gvk)
+	err := r.Get(ctx, GetNamespacedName(app.Name, route.suffix, app.Namespace), obj)
+	if errors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := r.deleteChild(ctx, app, obj); err != nil {
+		return err
+	}
+	log.FromContext(ctx).Info("The route is no longer needed, deleted.", "kind", route.kind, "name", obj.GetName())
+	return nil
+}
+
+// observeGatewayRoutes 把路由被 Gateway 接受的情况记录到 App status 中，没有路由时清理 status
+func observeGatewayRoutes(app *aloystechv2.App, routes []*unstructured.Unstructured) {
+	app.Status.HTTPRoute, app.Status.GRPCRoute = nil, nil
+	if len(routes) == 0 {
+		meta.RemoveStatusCondition(&app.Status.Conditions, aloystechv2.ConditionRouteAccepted)
+		return
+	}
+	var pending, rejected []string
+	for _, route := range routes {
+		summary := routeSummary(route)
+		switch route.GetKind() {
+		case "HTTPRoute":
+			app.Status.HTTPRoute = summary
+		case "GRPCRoute":
+			app.Status.GRPCRoute = summary
+		}
+		for _, msg := range routeRejections(route) {
+			rejected = append(rejected, fmt.Sprintf("%s %s: %s", route.GetKind(), route.GetName(), msg))
+		}
+		if len(summary.AcceptedBy) == 0 {
+			pending = append(pending, route.GetKind())
+		}
+	}
+	switch {
+	case len(rejected) > 0:
+		setCondition(app, aloystechv2.ConditionRouteAccepted, metav1.ConditionFalse, ReasonRouteNotAccepted, strings.Join(rejected, "; "))
+	case len(pending) > 0:
+		setCondition(app, aloystechv2.ConditionRouteAccepted, metav1.ConditionFalse, ReasonAwaitingGateway, fmt.Sprintf("no gateway has accepted the %s yet", strings.Join(pending, ", ")))
+	default:
+		setCondition(app, aloystechv2.ConditionRouteAccepted, metav1.ConditionTrue, ReasonRouteAccepted, "")
+	}
+}
+
+func routeSummary(route *unstructured.Unstructured) *aloystechv2.RouteSummary {
+	summary := &aloystechv2.RouteSummary{Name: route.GetName()}
+	summary.Hostnames, _, _ = unstructured.NestedStringSlice(route.Object, "spec", "hostnames")
+	for _, parent := range routeParents(route) {
+		if c := meta.FindStatusCondition(parent.conditions, "Accepted"); c != nil && c.Status == metav1.ConditionTrue {
+			summary.AcceptedBy = append(summary.AcceptedBy, parent.name)
+		}
+	}
+	return summary
+}
+
+func routeRejections(route *unstructured.Unstructured) []string {
+	var msgs []string
+	for _, parent := range routeParents(route) {
+		if c := meta.FindStatusCondition(parent.conditions, "Accepted"); c != nil && c.Status == metav1.ConditionFalse {
+			msgs = append(msgs, fmt.Sprintf("rejected by %s: %s", parent.name, c.Message))
+		}
+	}
+	return msgs
+}
+
+type routeParent struct {
+	name       string
+	conditions []metav1.Condition
+}
+
+// routeParents 读取 status.parents，路由的 status 由 Gateway 的实现写入，每个 parent 一项
+func routeParents(route *unstructured.Unstructured) []routeParent {
+	parents, _, _ := unstructured.NestedSlice(route.Object, "status", "parents")
+	var result []routeParent
+	for _, p := range parents {
+		m, ok := p.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		name, _, _ := unstructured.NestedString(m, "parentRef", "name")
+		if ns, _, _ := unstructured.NestedString(m, "parentRef", "namespace"); ns != "" {
+			name = ns + "/" + name
+		}
+		parent := routeParent{name: name}
+		conditions, _, _ := unstructured.NestedSlice(m, "conditions")
+		for _, c := range conditions {
+			cm, ok := c.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			var cond metav1.Condition
+			if err := runtime.DefaultUnstructuredConverter.FromUnstructured(cm, &cond); err == nil {
+				parent.conditions = append(parent.conditions, cond)
+			}
+		}
+		result = append(result, parent)
+	}
+	return result
+}
@@ -0,0 +1,219 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	aloystechv2 "aloys.tech/api/v2"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// revisionName 每个 spec.deployment 的版本保存在一个 ControllerRevision 里，按 hash 命名，同样的 spec 只保存一份
+func revisionName(app *aloystechv2.App, hash string) string {
+	return app.Name + "-" + hash
+}
+
+// recordRevision spec.deployment 变化时保存一个新的版本，并根据工作负载的状态更新最新版本的发布结果。
+// status.history 按从新到旧排列，超过 revisionHistoryLimit 的版本连同 ControllerRevision 一起删除
+func (r *AppReconciler) recordRevision(ctx context.Context, app *aloystechv2.App) error {
+	if isBatch(app) {
+		return nil
+	}
+	hash, err := specHash(app.Spec.Deployment)
+	if err != nil {
+		return err
+	}
+	history := app.Status.History
+	if len(history) == 0 || history[0].Hash != hash {
+		if err := r.saveRevision(ctx, app, hash); err != nil {
+			return err
+		}
+		if len(history) > 0 && history[0].Outcome == aloystechv2.RevisionProgressing {
+			history[0].Outcome = aloystechv2.RevisionSuperseded
+		}
+		var next int64 = 1
+		if len(history) > 0 {
+			next = history[0].Revision + 1
+		}
+		history = append([]aloystechv2.RevisionRecord{{
+			Revision:   next,
+			Hash:       hash,
+			Image:      app.Spec.Deployment.Image,
+			Generation: app.Generation,
+			Time:       metav1.Now(),
+			Outcome:    aloystechv2.RevisionProgressing,
+		}}, history...)
+		log.FromContext(ctx).Info("Recorded a new revision of the deployment spec.", "revision", next, "hash", hash)
+	}
+	history[0].Outcome = revisionOutcome(app, history[0].Outcome)
+
+	limit := app.Spec.RevisionHistoryLimit()
+	if len(history) > limit {
+		if err := r.pruneRevisions(ctx, app, history[:limit], history[limit:]); err != nil {
+			return err
+		}
+		history = history[:limit]
+	}
+	app.Status.History = history
+	return nil
+}
+
+// revisionOutcome 根据工作负载的 condition 判断最新版本的发布结果，发布成功之后不再改变
+func revisionOutcome(app *aloystechv2.App, current aloystechv2.RevisionOutcome) aloystechv2.RevisionOutcome {
+	if current == aloystechv2.RevisionSucceeded {
+		return current
+	}
+	if rb := app.Status.Rollback; rb != nil && rb.FailedRevision != "" {
+		return aloystechv2.RevisionRolledBack
+	}
+	// canary 和 blue/green 发布过程中工作负载的 condition 反映的是旧版本
+	if c := app.Status.Canary; c != nil {
+		if c.Phase == aloystechv2.CanaryAborted {
+			return aloystechv2.RevisionAborted
+		}
+		return aloystechv2.RevisionProgressing
+	}
+	if bg := app.Status.BlueGreen; bg != nil && bg.PreviewRevision != "" {
+		if bg.Phase == aloystechv2.BlueGreenAborted {
+			return aloystechv2.RevisionAborted
+		}
+		return aloystechv2.RevisionProgressing
+	}
+	c := meta.FindStatusCondition(app.Status.Conditions, workloadConditionType(app))
+	switch {
+	case c == nil:
+		return current
+	case c.Status == metav1.ConditionTrue:
+		return aloystechv2.RevisionSucceeded
+	case c.Reason == ReasonProgressDeadlineExceeded || c.Reason == ReasonReplicaFailure:
+		return aloystechv2.RevisionFailed
+	default:
+		return aloystechv2.RevisionProgressing
+	}
+}
+
+func (r *AppReconciler) saveRevision(ctx context.Context, app *aloystechv2.App, hash string) error {
+	data, err := json.Marshal(app.Spec.Deployment)
+	if err != nil {
+		return err
+	}
+	cr := &appsv1.ControllerRevision{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      revisionName(app, hash),
+			Namespace: app.Namespace,
+			Labels:    map[string]string{"app": app.Name},
+		},
+		Data: runtime.RawExtension{Raw: data},
+	}
+	if len(app.Status.History) > 0 {
+		cr.Revision = app.Status.History[0].Revision + 1
+	}
+	if err := ctrl.SetControllerReference(app, cr, r.Scheme); err != nil {
+		return err
+	}
+	// 回到之前用过的 spec 时 ControllerRevision 已经存在，内容相同直接复用
+	if err := r.Create(ctx, cr); err != nil && !errors.IsAlreadyExists(err) {
+		return err
+	}
+	return nil
+}
+
+// pruneRevisions 删除超出数量限制的版本，仍然被保留的版本引用的 ControllerRevision 不删除，
+// 不属于 App 的同名 ControllerRevision 也不删除，见 deleteChild
+func (r *AppReconciler) pruneRevisions(ctx context.Context, app *aloystechv2.App, kept, pruned []aloystechv2.RevisionRecord) error {
+	inUse := map[string]bool{}
+	for _, h := range kept {
+		inUse[h.Hash] = true
+	}
+	for _, h := range pruned {
+		if inUse[h.Hash] {
+			continue
+		}
+		cr := &appsv1.ControllerRevision{ObjectMeta: metav1.ObjectMeta{Name: revisionName(app, h.Hash), Namespace: app.Namespace}}
+		if err := r.deleteIfExists(ctx, app, cr); err != nil {
+			return err
+		}
+		inUse[h.Hash] = true
+	}
+	return nil
+}
+
+// restoreRevision 处理 rollback-to 注解，把 spec.deployment 恢复成 history 中对应版本保存的内容。
+// 恢复之后 spec 重新成为唯一的来源，后续按正常的发布流程滚动更新，并记录为一个新的版本
+func (r *AppReconciler) restoreRevision(ctx context.Context, app *aloystechv2.App) error {
+	value, ok := app.Annotations[aloystechv2.RollbackToAnnotation]
+	if !ok {
+		return nil
+	}
+	logger := log.FromContext(ctx).WithName("restoreRevision").WithName(app.Name)
+	restored := app.DeepCopy()
+	delete(restored.Annotations, aloystechv2.RollbackToAnnotation)
+
+	spec, err := r.revisionSpec(ctx, app, value)
+	if err != nil {
+		if !errors.IsNotFound(err) && !isInvalidRevision(err) {
+			return err
+		}
+		// 找不到的版本重试也没有用，去掉注解并提示用户
+		r.Eventer.Eventf(app, corev1.EventTypeWarning, "RollbackFailed", "The %s annotation %q is ignored, %s.", aloystechv2.RollbackToAnnotation, value, err)
+		if err := r.Patch(ctx, restored, client.MergeFrom(app)); err != nil {
+			return err
+		}
+		app.Annotations, app.ResourceVersion = restored.Annotations, restored.ResourceVersion
+		return nil
+	}
+	restored.Spec.Deployment = *spec
+	if err := r.Update(ctx, restored); err != nil {
+		return err
+	}
+	logger.Info("Restored the deployment spec from the revision.", "revision", value)
+	r.Eventer.Eventf(app, corev1.EventTypeNormal, "RolledBackTo", "The deployment spec has been restored from the revision %s, image %s.", value, spec.Image)
+	// status 保留这次协调之前的内容，不用 apiserver 返回的覆盖
+	app.ObjectMeta, app.Spec = restored.ObjectMeta, restored.Spec
+	return nil
+}
+
+type invalidRevisionError struct{ msg string }
+
+func (e invalidRevisionError) Error() string { return e.msg }
+
+func isInvalidRevision(err error) bool {
+	_, ok := err.(invalidRevisionError)
+	return ok
+}
+
+func (r *AppReconciler) revisionSpec(ctx context.Context, app *aloystechv2.App, value string) (*aloystechv2.AppDeploymentSpec, error) {
+	number, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return nil, invalidRevisionError{msg: "it must be a revision number from status.history"}
+	}
+	var hash string
+	for _, h := range app.Status.History {
+		if h.Revision == number {
+			hash = h.Hash
+			break
+		}
+	}
+	if hash == "" {
+		return nil, invalidRevisionError{msg: fmt.Sprintf("the revision %d is not in status.history", number)}
+	}
+	cr := &appsv1.ControllerRevision{}
+	if err := r.Get(ctx, GetNamespacedName(revisionName(app, hash), "", app.Namespace), cr); err != nil {
+		return nil, err
+	}
+	spec := &aloystechv2.AppDeploymentSpec{}
+	if err := json.Unmarshal(cr.Data.Raw, spec); err != nil {
+		return nil, invalidRevisionError{msg: fmt.Sprintf("the revision %d cannot be decoded: %v", number, err)}
+	}
+	return spec, nil
+}
@@ -0,0 +1,274 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	aloystechv2 "aloys.tech/api/v2"
+	"github.com/robfig/cron/v3"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// jobRecreateDelay 删除旧 Job 之后等待一会儿再创建新的，旧 Job 的 pod 需要时间清理
+const jobRecreateDelay = 5 * time.Second
+
+func (r *AppReconciler) reconcileJob(ctx context.Context, app *aloystechv2.App) (ctrl.Result, error) {
+	jobName := app.Name + "-job"
+	logger := log.FromContext(ctx).WithName("reconcileJob").WithName(jobName)
+	job := &batchv1.Job{}
+	err := r.Get(ctx, GetNamespacedName(app.Name, "-job", app.Namespace), job)
+	if err != nil && !errors.IsNotFound(err) {
+		logger.Error(err, "Failed to get the Job,will requeue after a short time.")
+		return ctrl.Result{RequeueAfter: GenericRequeueDuration}, err
+	}
+	exists := err == nil
+
+	if workloadKind(app) != aloystechv2.WorkloadJob {
+		if exists {
+			logger.Info("The workload kind is not Job, delete the Job.", "kind", workloadKind(app))
+			if err := r.deleteChild(ctx, app, job, client.PropagationPolicy(metav1.DeletePropagationBackground)); err != nil {
+				logger.Error(err, "Failed to delete the Job,will requeue after a short time.")
+				return ctrl.Result{RequeueAfter: GenericRequeueDuration}, err
+			}
+		}
+		if workloadKind(app) != aloystechv2.WorkloadCronJob {
+			observeJob(app, nil)
+		}
+		return ctrl.Result{}, nil
+	}
+
+	appJob, err := r.templates(app).NewJob(app)
+	if err != nil {
+		logger.Error(err, "Failed to render the app job.")
+		return ctrl.Result{}, err
+	}
+	if err := ctrl.SetControllerReference(app, appJob, r.Scheme); err != nil {
+		logger.Error(err, "Failed to set the controller reference for the app job,will requeue after a short time.")
+		return ctrl.Result{RequeueAfter: GenericRequeueDuration}, err
+	}
+	hash, err := r.configHash(ctx, app)
+	if err != nil {
+		logger.Error(err, "Failed to compute the config hash,will requeue after a short time.")
+		return ctrl.Result{RequeueAfter: GenericRequeueDuration}, err
+	}
+	setConfigHash(&appJob.Spec.Template, hash)
+	// Job 的 selector 由 apiserver 生成，按 pod template 的标签选择
+	setTopologySpreadSelector(&appJob.Spec.Template.Spec, &metav1.LabelSelector{MatchLabels: appJob.Spec.Template.Labels})
+	// Job 的 pod template 创建后不能修改，用 hash 判断 App 是否改了 Job，改了就删除重建
+	templateHash, err := specHash(appJob.Spec)
+	if err != nil {
+		return ctrl.Result{RequeueAfter: GenericRequeueDuration}, err
+	}
+	setTemplateHash(appJob, templateHash)
+
+	if exists {
+		if job.Annotations[TemplateHashAnnotation] == templateHash {
+			observeJob(app, job)
+			return ctrl.Result{}, nil
+		}
+		// Job 的 spec 基本不能修改，App 变化之后删除旧的 Job 再重新运行。
+		// 正在运行的 Job 不打断，等它结束之后再重建，Job 的 status 变化会重新触发协调
+		if jobResult(job) == aloystechv2.JobResultRunning {
+			logger.Info("The Job spec has been changed, recreate the Job after the running Job finishes.")
+			observeJob(app, job)
+			setCondition(app, aloystechv2.ConditionJobSucceeded, metav1.ConditionFalse, ReasonJobSpecPending,
+				fmt.Sprintf("the Job spec changed, %s is recreated after it finishes (%d active, %d failed)", jobName, job.Status.Active, job.Status.Failed))
+			return ctrl.Result{}, nil
+		}
+		logger.Info("The Job spec has been changed, recreate the Job.")
+		if err := r.deleteChild(ctx, app, job, client.PropagationPolicy(metav1.DeletePropagationBackground)); err != nil {
+			logger.Error(err, "Failed to delete the Job,will requeue after a short time.")
+			return ctrl.Result{RequeueAfter: GenericRequeueDuration}, err
+		}
+		r.Eventer.Eventf(app, corev1.EventTypeNormal, "JobRecreating", "The %s Job spec changed, the old Job deleted.", jobName)
+		return ctrl.Result{RequeueAfter: jobRecreateDelay}, nil
+	}
+
+	if _, err := r.applyChild(ctx, app, appJob); err != nil {
+		logger.Error(err, "Failed to apply the Job,will requeue after a short time.")
+		return ctrl.Result{RequeueAfter: GenericRequeueDuration}, err
+	}
+	logger.Info("The Job has been created.")
+	r.Eventer.Eventf(app, corev1.EventTypeNormal, "JobCreated", "The %s Job created.", jobName)
+	observeJob(app, appJob)
+	return ctrl.Result{}, nil
+}
+
+func (r *AppReconciler) reconcileCronJob(ctx context.Context, app *aloystechv2.App) (ctrl.Result, error) {
+	cronJobName := app.Name + "-cronjob"
+	logger := log.FromContext(ctx).WithName("reconcileCronJob").WithName(cronJobName)
+	if workloadKind(app) != aloystechv2.WorkloadCronJob {
+		cj := &batchv1.CronJob{}
+		err := r.Get(ctx, GetNamespacedName(app.Name, "-cronjob", app.Namespace), cj)
+		if err == nil {
+			logger.Info("The workload kind is not CronJob, delete the CronJob.", "kind", workloadKind(app))
+			err = r.deleteChild(ctx, app, cj, client.PropagationPolicy(metav1.DeletePropagationBackground))
+		}
+		if err != nil && !errors.IsNotFound(err) {
+			logger.Error(err, "Failed to delete the CronJob,will requeue after a short time.")
+			return ctrl.Result{RequeueAfter: GenericRequeueDuration}, err
+		}
+		return ctrl.Result{}, nil
+	}
+
+	appCronJob, err := r.templates(app).NewCronJob(app)
+	if err != nil {
+		logger.Error(err, "Failed to render the app cronjob.")
+		return ctrl.Result{}, err
+	}
+	if err := ctrl.SetControllerReference(app, appCronJob, r.Scheme); err != nil {
+		logger.Error(err, "Failed to set the controller reference for the app cronjob,will requeue after a short time.")
+		return ctrl.Result{RequeueAfter: GenericRequeueDuration}, err
+	}
+	hash, err := r.configHash(ctx, app)
+	if err != nil {
+		logger.Error(err, "Failed to compute the config hash,will requeue after a short time.")
+		return ctrl.Result{RequeueAfter: GenericRequeueDuration}, err
+	}
+	setConfigHash(&appCronJob.Spec.JobTemplate.Spec.Template, hash)
+	setTopologySpreadSelector(&appCronJob.Spec.JobTemplate.Spec.Template.Spec,
+		&metav1.LabelSelector{MatchLabels: appCronJob.Spec.JobTemplate.Spec.Template.Labels})
+	changed, err := r.applyChild(ctx, app, appCronJob)
+	if err != nil {
+		logger.Error(err, "Failed to apply the CronJob,will requeue after a short time.")
+		return ctrl.Result{RequeueAfter: GenericRequeueDuration}, err
+	}
+	if changed {
+		logger.Info("The CronJob has been applied.")
+	}
+
+	runs, err := r.cronJobRuns(ctx, app, appCronJob.Name)
+	if err != nil {
+		logger.Error(err, "Failed to list the CronJob runs,will requeue after a short time.")
+		return ctrl.Result{RequeueAfter: GenericRequeueDuration}, err
+	}
+	observeCronJob(app, appCronJob, runs, time.Now())
+
+	// 到下一次调度时间再协调一次，保证 status 里的下次运行时间是最新的
+	if next := app.Status.Job.NextScheduleTime; next != nil {
+		return ctrl.Result{RequeueAfter: time.Until(next.Time) + time.Second}, nil
+	}
+	return ctrl.Result{}, nil
+}
+
+// cronJobRuns 列出 CronJob 创建的 Job，它们带着 jobTemplate 上的 app 标签，用它找到最近一次运行
+func (r *AppReconciler) cronJobRuns(ctx context.Context, app *aloystechv2.App, cronJobName string) ([]batchv1.Job, error) {
+	jobs := &batchv1.JobList{}
+	if err := r.List(ctx, jobs, client.InNamespace(app.Namespace), client.MatchingLabels{"app": app.Name}); err != nil {
+		return nil, err
+	}
+	var runs []batchv1.Job
+	for _, j := range jobs.Items {
+		if owner := metav1.GetControllerOf(&j); owner != nil && owner.Kind == "CronJob" && owner.Name == cronJobName {
+			runs = append(runs, j)
+		}
+	}
+	return runs, nil
+}
+
+func jobResult(job *batchv1.Job) aloystechv2.JobResult {
+	for _, c := range job.Status.Conditions {
+		if c.Status != corev1.ConditionTrue {
+			continue
+		}
+		switch c.Type {
+		case batchv1.JobComplete:
+			return aloystechv2.JobResultSucceeded
+		case batchv1.JobFailed:
+			return aloystechv2.JobResultFailed
+		}
+	}
+	return aloystechv2.JobResultRunning
+}
+
+// observeJob 把 Job 的当前状态记录到 App status 中，job 为 nil 表示工作负载不是 Job
+func observeJob(app *aloystechv2.App, job *batchv1.Job) {
+	if job == nil {
+		app.Status.Job = nil
+		meta.RemoveStatusCondition(&app.Status.Conditions, aloystechv2.ConditionJobSucceeded)
+		meta.RemoveStatusCondition(&app.Status.Conditions, aloystechv2.ConditionCronJobScheduled)
+		return
+	}
+	meta.RemoveStatusCondition(&app.Status.Conditions, aloystechv2.ConditionCronJobScheduled)
+	// Job 不能通过 scale 子资源扩缩容，去掉之前的工作负载留下的 selector
+	app.Status.Selector = ""
+	result := jobResult(job)
+	app.Status.Job = &aloystechv2.JobSummary{
+		Name:               job.Name,
+		LastJob:            job.Name,
+		LastRunTime:        job.Status.StartTime,
+		LastCompletionTime: job.Status.CompletionTime,
+		LastResult:         result,
+	}
+	switch result {
+	case aloystechv2.JobResultSucceeded:
+		setCondition(app, aloystechv2.ConditionJobSucceeded, metav1.ConditionTrue, ReasonJobSucceeded, "")
+	case aloystechv2.JobResultFailed:
+		setCondition(app, aloystechv2.ConditionJobSucceeded, metav1.ConditionFalse, ReasonJobFailed, jobFailureMessage(job))
+	default:
+		setCondition(app, aloystechv2.ConditionJobSucceeded, metav1.ConditionFalse, ReasonJobRunning,
+			fmt.Sprintf("%d active, %d failed", job.Status.Active, job.Status.Failed))
+	}
+}
+
+// observeCronJob 把 CronJob 最近一次运行的结果和下次调度时间记录到 App status 中
+func observeCronJob(app *aloystechv2.App, cj *batchv1.CronJob, runs []batchv1.Job, now time.Time) {
+	meta.RemoveStatusCondition(&app.Status.Conditions, aloystechv2.ConditionJobSucceeded)
+	app.Status.Selector = ""
+	summary := &aloystechv2.JobSummary{Name: cj.Name}
+	if next, err := nextSchedule(cj, now); err == nil {
+		summary.NextScheduleTime = &metav1.Time{Time: next}
+	}
+	app.Status.Job = summary
+
+	if len(runs) == 0 {
+		setCondition(app, aloystechv2.ConditionCronJobScheduled, metav1.ConditionTrue, ReasonScheduled, "the CronJob has not run yet")
+		return
+	}
+	sort.Slice(runs, func(i, j int) bool {
+		return runs[j].CreationTimestamp.Before(&runs[i].CreationTimestamp)
+	})
+	last := &runs[0]
+	summary.LastJob = last.Name
+	summary.LastRunTime = last.Status.StartTime
+	summary.LastCompletionTime = last.Status.CompletionTime
+	summary.LastResult = jobResult(last)
+	if summary.LastResult == aloystechv2.JobResultFailed {
+		setCondition(app, aloystechv2.ConditionCronJobScheduled, metav1.ConditionFalse, ReasonJobFailed,
+			fmt.Sprintf("the last run %s failed: %s", last.Name, jobFailureMessage(last)))
+		return
+	}
+	setCondition(app, aloystechv2.ConditionCronJobScheduled, metav1.ConditionTrue, ReasonScheduled,
+		fmt.Sprintf("the last run %s is %s", last.Name, summary.LastResult))
+}
+
+func jobFailureMessage(job *batchv1.Job) string {
+	for _, c := range job.Status.Conditions {
+		if c.Type == batchv1.JobFailed && c.Status == corev1.ConditionTrue {
+			return c.Message
+		}
+	}
+	return ""
+}
+
+// nextSchedule 按 CronJob 的 schedule 和 timeZone 计算下一次运行时间
+func nextSchedule(cj *batchv1.CronJob, now time.Time) (time.Time, error) {
+	spec := cj.Spec.Schedule
+	if cj.Spec.TimeZone != nil {
+		spec = "CRON_TZ=" + *cj.Spec.TimeZone + " " + spec
+	}
+	schedule, err := cron.ParseStandard(spec)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return schedule.Next(now), nil
+}
@@ -0,0 +1,55 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+
+	aloystechv2 "aloys.tech/api/v2"
+	"aloys.tech/internal/utils"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ReasonRenderFailed 模板渲染失败，修改 spec 或者 app-templates 之前重试也不会成功
+const ReasonRenderFailed = "RenderFailed"
+
+// observeRenderFailed 渲染失败时设置 RenderFailed condition 并在 App 上记录 Warning 事件，返回 err 是否是渲染失败；
+// err 为 nil 说明所有子资源都渲染成功，去掉之前的 RenderFailed condition
+func (r *AppReconciler) observeRenderFailed(app *aloystechv2.App, err error) bool {
+	var renderErr *utils.RenderError
+	if !errors.As(err, &renderErr) {
+		if err == nil {
+			meta.RemoveStatusCondition(&app.Status.Conditions, aloystechv2.ConditionRenderFailed)
+		}
+		return false
+	}
+	setCondition(app, aloystechv2.ConditionRenderFailed, metav1.ConditionTrue, ReasonRenderFailed, renderErr.Error())
+	r.Eventer.Eventf(app, corev1.EventTypeWarning, ReasonRenderFailed, "Failed to render the children: %v", renderErr)
+	return true
+}
+
+const (
+	// ReasonOverrideFailed spec.overrides 里的 patch 没法应用到渲染出来的子资源上
+	ReasonOverrideFailed   = "OverrideFailed"
+	ReasonOverridesApplied = "OverridesApplied"
+)
+
+// observeOverrides 把 spec.overrides 的应用结果记录到 OverridesApplied condition，没有 overrides 时去掉这个 condition
+func observeOverrides(app *aloystechv2.App, err error) {
+	var overrideErr *utils.OverrideError
+	if errors.As(err, &overrideErr) {
+		setCondition(app, aloystechv2.ConditionOverridesApplied, metav1.ConditionFalse, ReasonOverrideFailed, overrideErr.Error())
+		return
+	}
+	// 其他原因失败时不是所有子资源都渲染过，还不知道 patch 能不能应用，保持原来的 condition
+	if err != nil {
+		return
+	}
+	if len(app.Spec.Overrides) == 0 {
+		meta.RemoveStatusCondition(&app.Status.Conditions, aloystechv2.ConditionOverridesApplied)
+		return
+	}
+	setCondition(app, aloystechv2.ConditionOverridesApplied, metav1.ConditionTrue, ReasonOverridesApplied,
+		fmt.Sprintf("%d overrides applied", len(app.Spec.Overrides)))
+}
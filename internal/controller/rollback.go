@@ -0,0 +1,108 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	aloystechv2 "aloys.tech/api/v2"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// progressDeadlineExceeded 判断 Deployment 当前的 pod template 是否已经超过 progressDeadlineSeconds 还没有发布完成
+func progressDeadlineExceeded(dp *appsv1.Deployment) bool {
+	if dp.Status.ObservedGeneration < dp.Generation {
+		return false
+	}
+	for _, c := range dp.Status.Conditions {
+		if c.Type == appsv1.DeploymentProgressing && c.Status == corev1.ConditionFalse && c.Reason == ReasonProgressDeadlineExceeded {
+			return true
+		}
+	}
+	return false
+}
+
+func podImages(template corev1.PodTemplateSpec) string {
+	var images []string
+	for _, c := range template.Spec.Containers {
+		images = append(images, c.Image)
+	}
+	return strings.Join(images, ",")
+}
+
+// rolledBack 判断当前 spec 的 pod template 是否已经被回滚，回滚之后不再为它发布 canary
+func rolledBack(app *aloystechv2.App, revision string) bool {
+	return app.Spec.AutoRollback() && app.Status.Rollback != nil && app.Status.Rollback.FailedRevision == revision
+}
+
+// reconcileRollback 记录最后一个发布成功的 pod template，新的 pod template 超过发布期限时把 desired 换回它。
+// live 为集群中的 Deployment，不存在时为 nil，desired 和 revision 为按当前 spec 渲染的结果
+func (r *AppReconciler) reconcileRollback(ctx context.Context, app *aloystechv2.App, live, desired *appsv1.Deployment, revision string) error {
+	if !app.Spec.AutoRollback() {
+		app.Status.Rollback = nil
+		return nil
+	}
+	logger := log.FromContext(ctx).WithName("reconcileRollback").WithName(app.Name)
+	st := app.Status.Rollback
+	if st == nil {
+		st = &aloystechv2.RollbackStatus{}
+		app.Status.Rollback = st
+	}
+	// spec 修改了 pod template 之后重新尝试发布
+	if st.FailedRevision != "" && st.FailedRevision != revision {
+		st.FailedRevision, st.FailedImage, st.RollbackTime = "", "", nil
+	}
+	if live != nil && live.Annotations[TemplateHashAnnotation] == revision {
+		switch {
+		case deploymentRolledOut(live):
+			st.LastGoodRevision = revision
+		case progressDeadlineExceeded(live) && st.FailedRevision == "" && st.LastGoodRevision != "" && st.LastGoodRevision != revision:
+			now := metav1.Now()
+			st.FailedRevision, st.FailedImage, st.RollbackTime = revision, podImages(desired.Spec.Template), &now
+			logger.Info("The rollout exceeded its progress deadline, roll back.", "image", st.FailedImage, "revision", st.LastGoodRevision)
+			r.Eventer.Eventf(app, corev1.EventTypeWarning, ReasonRolledBack, "The image %s exceeded the progress deadline, rolled back to the revision %s.", st.FailedImage, st.LastGoodRevision)
+		}
+	}
+	if st.FailedRevision != revision {
+		return nil
+	}
+
+	template, err := r.revisionTemplate(ctx, live, st.LastGoodRevision)
+	if err != nil {
+		return err
+	}
+	if template == nil {
+		// 旧的 ReplicaSet 已经被清理，只能保持失败的 pod template，Degraded 里会带上原因
+		return fmt.Errorf("the ReplicaSet of the revision %s no longer exists, cannot roll back the image %s", st.LastGoodRevision, st.FailedImage)
+	}
+	desired.Spec.Template = *template
+	setTemplateHash(desired, st.LastGoodRevision)
+	return nil
+}
+
+// revisionTemplate 从 Deployment 保留的历史 ReplicaSet 中找到指定版本的 pod template，
+// Deployment 的 annotation 会被复制到它创建的 ReplicaSet 上，所以可以按 TemplateHashAnnotation 查找
+func (r *AppReconciler) revisionTemplate(ctx context.Context, dp *appsv1.Deployment, revision string) (*corev1.PodTemplateSpec, error) {
+	if dp == nil || dp.Spec.Selector == nil {
+		return nil, nil
+	}
+	list := &appsv1.ReplicaSetList{}
+	if err := r.List(ctx, list, client.InNamespace(dp.Namespace), client.MatchingLabels(dp.Spec.Selector.MatchLabels)); err != nil {
+		return nil, err
+	}
+	for i := range list.Items {
+		rs := &list.Items[i]
+		if !metav1.IsControlledBy(rs, dp) || rs.Annotations[TemplateHashAnnotation] != revision {
+			continue
+		}
+		template := rs.Spec.Template.DeepCopy()
+		// pod-template-hash 由 Deployment controller 添加，提交回 Deployment 时要去掉
+		delete(template.Labels, appsv1.DefaultDeploymentUniqueLabelKey)
+		return template, nil
+	}
+	return nil, nil
+}
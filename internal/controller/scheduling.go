@@ -0,0 +1,45 @@
+package controller
+
+import (
+	aloystechv2 "aloys.tech/api/v2"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// defaultTopologyKeys 默认的 topology spread 先按可用区、再按节点打散副本
+var defaultTopologyKeys = []string{corev1.LabelTopologyZone, corev1.LabelHostname}
+
+// setDefaultTopologySpread 开启 DefaultTopologySpread 后，没有配置 topologySpreadConstraints 的 App
+// 把副本尽量打散到不同的可用区和节点上，App 的 spec.deployment.defaultTopologySpread 可以单独开启或关闭。
+// 在 controller 里加在渲染好的工作负载上，不在模板里。使用 ScheduleAnyway，没有可用区标签的集群也能正常调度。
+// labelSelector 留空，由 setTopologySpreadSelector 按工作负载自己的 selector 补上
+func (r *AppReconciler) setDefaultTopologySpread(app *aloystechv2.App, pod *corev1.PodSpec) {
+	enabled := r.DefaultTopologySpread
+	if s := app.Spec.Deployment.DefaultTopologySpread; s != nil {
+		enabled = *s
+	}
+	if !enabled || len(pod.TopologySpreadConstraints) > 0 {
+		return
+	}
+	for _, key := range defaultTopologyKeys {
+		pod.TopologySpreadConstraints = append(pod.TopologySpreadConstraints, corev1.TopologySpreadConstraint{
+			MaxSkew:           1,
+			TopologyKey:       key,
+			WhenUnsatisfiable: corev1.ScheduleAnyway,
+		})
+	}
+}
+
+// setTopologySpreadSelector 没有 labelSelector 的 topology spread 不统计任何 pod，渲染时默认选择这个工作负载自己的 pod。
+// 放在 controller 里而不是 webhook，没有开启 webhook 或者用 generateName 创建的 App 也能生效；
+// canary 和 blue/green 各个颜色的 Deployment 的 pod 标签不同，要在换完标签之后各自按自己的 selector 补上
+func setTopologySpreadSelector(pod *corev1.PodSpec, selector *metav1.LabelSelector) {
+	if selector == nil || (len(selector.MatchLabels) == 0 && len(selector.MatchExpressions) == 0) {
+		return
+	}
+	for i := range pod.TopologySpreadConstraints {
+		if c := &pod.TopologySpreadConstraints[i]; c.LabelSelector == nil {
+			c.LabelSelector = selector.DeepCopy()
+		}
+	}
+}
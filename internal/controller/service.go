@@ -2,61 +2,126 @@ package controller
 
 import (
 	"context"
-	"reflect"
 
-	aloystechv1 "aloys.tech/api/v1"
+	aloystechv2 "aloys.tech/api/v2"
 	"aloys.tech/internal/utils"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/log"
 )
 
-func (r *AppReconciler) reconcileService(ctx context.Context, app *aloystechv1.App) (ctrl.Result, error) {
+func (r *AppReconciler) reconcileService(ctx context.Context, app *aloystechv2.App) (ctrl.Result, error) {
 	svcName := app.Name + "-svc"
 	logger := log.FromContext(ctx).WithName("reconcileService").WithName(svcName)
-	appService := utils.NewService(app)
-	if err := ctrl.SetControllerReference(app, appService, r.Scheme); err != nil {
-		logger.Error(err, "Failed to set the controller reference for the app appService ,will requeue after a short time.")
-		return ctrl.Result{RequeueAfter: GenericRequeueDuration}, err
-	}
-	svc := &corev1.Service{}
-	err := r.Get(ctx, GetNamespacedName(app.Name, "-svc", app.Namespace), svc)
-	if err == nil {
-		// 所以这里也不判断其他在不在，这个svc也是必须监听存在的资源，不存在马上创建
-		if !reflect.DeepEqual(svc.Spec, appService.Spec) {
-			// 不相同进行更新,这里想比较一样，看谁的版本谁最新的，进行更新那个版本
-			// 这里是想如果直接修改了deploy，那就按照修改的执行，但是不能确认修改了什么，监听的时候就很杂乱
-			// if dp.GetResourceVersion() > appDeploy.GetResourceVersion() {
-			// 	appDeploy.Spec.Replicas = dp.Spec.Replicas
-			// }
-			logger.Info("The Service has been updated. Update it. ")
-			if err := r.Update(ctx, appService); err != nil {
-				logger.Error(err, "Failed to update the Service,will requeue after a short time.")
-				return ctrl.Result{RequeueAfter: GenericRequeueDuration}, err
+	// Job 和 CronJob 不对外提供服务，删除之前可能创建过的 Service
+	if isBatch(app) {
+		for _, suffix := range []string{"-svc", "-headless"} {
+			svc := &corev1.Service{}
+			err := r.Get(ctx, GetNamespacedName(app.Name, suffix, app.Namespace), svc)
+			if errors.IsNotFound(err) {
+				continue
 			}
-			logger.Info("The Service updated successfully.")
-
-			logger.Info("This Service Status has been updated. Update it.")
-			app.Status.ServiceSpec = svc.Spec
-			// 更新Status
-			if err := r.Status().Update(ctx, app); err != nil {
-				logger.Error(err, "Failed to update the app status,will requeue after a short time.")
+			if err == nil {
+				err = r.deleteChild(ctx, app, svc)
+			}
+			if err != nil {
+				logger.Error(err, "Failed to delete the Service,will requeue after a short time.", "service", app.Name+suffix)
 				return ctrl.Result{RequeueAfter: GenericRequeueDuration}, err
 			}
-			logger.Info("The Service status has been updated successfully.")
+			logger.Info("The workload is a batch kind, the Service deleted.", "service", app.Name+suffix)
 		}
+		observeService(app, nil)
 		return ctrl.Result{}, nil
 	}
-	if !errors.IsNotFound(err) {
-		logger.Error(err, "Failed to get the Service, will requeue after a short time.")
+	if err := r.recreateServiceIfHeadlessChanged(ctx, app); err != nil {
+		logger.Error(err, "Failed to recreate the Service,will requeue after a short time.")
 		return ctrl.Result{RequeueAfter: GenericRequeueDuration}, err
 	}
-	logger.Info("The Service start creating.")
-	if err := r.Create(ctx, appService); err != nil {
-		logger.Error(err, "Failed to create the Service,will requeue after a short time.")
+	appService, err := r.templates(app).NewService(app)
+	if err != nil {
+		logger.Error(err, "Failed to render the app service.")
+		return ctrl.Result{}, err
+	}
+	// blue/green 发布时 Service 只选择 active 颜色的 pod，promote 的时候切换
+	if color := activeColor(app); color != "" {
+		appService.Spec.Selector[utils.ColorLabel] = color
+	}
+	if err := ctrl.SetControllerReference(app, appService, r.Scheme); err != nil {
+		logger.Error(err, "Failed to set the controller reference for the app appService ,will requeue after a short time.")
+		return ctrl.Result{RequeueAfter: GenericRequeueDuration}, err
+	}
+	// clusterIP 之类的字段由 apiserver 分配，apply 时不带这些字段，也就不会再碰到 clusterIP 不可修改的错误
+	changed, err := r.applyChild(ctx, app, appService)
+	if err != nil {
+		logger.Error(err, "Failed to apply the Service,will requeue after a short time.")
 		return ctrl.Result{RequeueAfter: GenericRequeueDuration}, err
 	}
-	logger.Info("The Service has been created.")
+	if changed {
+		logger.Info("The Service has been applied.")
+	}
+	if err := r.reconcileHeadlessService(ctx, app); err != nil {
+		logger.Error(err, "Failed to reconcile the headless Service,will requeue after a short time.")
+		return ctrl.Result{RequeueAfter: GenericRequeueDuration}, err
+	}
+	if err := r.reconcilePreviewService(ctx, app); err != nil {
+		logger.Error(err, "Failed to reconcile the preview Service,will requeue after a short time.")
+		return ctrl.Result{RequeueAfter: GenericRequeueDuration}, err
+	}
+	observeService(app, appService)
 	return ctrl.Result{}, nil
 }
+
+// recreateServiceIfHeadlessChanged clusterIP 创建后不能修改，在 headless 和其他类型之间切换时只能先删除再重新创建
+func (r *AppReconciler) recreateServiceIfHeadlessChanged(ctx context.Context, app *aloystechv2.App) error {
+	svc := &corev1.Service{}
+	err := r.Get(ctx, GetNamespacedName(app.Name, "-svc", app.Namespace), svc)
+	if errors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	// 不属于 App 的 Service 不删除，交给 applyChild 判断能不能接管
+	if (svc.Spec.ClusterIP == corev1.ClusterIPNone) == app.Spec.Service.IsHeadless() || !metav1.IsControlledBy(svc, app) {
+		return nil
+	}
+	log.FromContext(ctx).Info("The Service switches between headless and a cluster IP, delete it first.", "service", svc.Name)
+	if err := r.Delete(ctx, svc); err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+// reconcileHeadlessService StatefulSet 需要一个 headless Service 给 pod 提供稳定的 DNS，其他工作负载不需要就删除
+func (r *AppReconciler) reconcileHeadlessService(ctx context.Context, app *aloystechv2.App) error {
+	logger := log.FromContext(ctx).WithName("reconcileHeadlessService").WithName(app.Name + "-headless")
+	if !isStatefulSet(app) {
+		svc := &corev1.Service{}
+		err := r.Get(ctx, GetNamespacedName(app.Name, "-headless", app.Namespace), svc)
+		if errors.IsNotFound(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		logger.Info("The workload kind is not StatefulSet, delete the headless Service.", "kind", workloadKind(app))
+		return r.deleteChild(ctx, app, svc)
+	}
+	headless, err := r.templates(app).NewHeadlessService(app)
+	if err != nil {
+		return err
+	}
+	if err := ctrl.SetControllerReference(app, headless, r.Scheme); err != nil {
+		return err
+	}
+	changed, err := r.applyChild(ctx, app, headless)
+	if err != nil {
+		return err
+	}
+	if changed {
+		logger.Info("The headless Service has been applied.")
+	}
+	return nil
+}
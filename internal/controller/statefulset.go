@@ -0,0 +1,82 @@
+package controller
+
+import (
+	"context"
+
+	aloystechv2 "aloys.tech/api/v2"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+func (r *AppReconciler) reconcileStatefulSet(ctx context.Context, app *aloystechv2.App) (ctrl.Result, error) {
+	stsName := app.Name + "-sts"
+	logger := log.FromContext(ctx).WithName("reconcileStatefulSet").WithName(stsName)
+	sts := &appsv1.StatefulSet{}
+	err := r.Get(ctx, GetNamespacedName(app.Name, "-sts", app.Namespace), sts)
+	if err != nil && !errors.IsNotFound(err) {
+		logger.Error(err, "Failed to get the StatefulSet,will requeue after a short time.")
+		return ctrl.Result{RequeueAfter: GenericRequeueDuration}, err
+	}
+	exists := err == nil
+
+	// 工作负载切换成其他类型之后删除原来的 StatefulSet，volumeClaimTemplates 创建的 PVC 保留，避免误删数据
+	if !isStatefulSet(app) {
+		if exists {
+			logger.Info("The workload kind is not StatefulSet, delete the StatefulSet.", "kind", workloadKind(app))
+			if err := r.deleteChild(ctx, app, sts); err != nil {
+				logger.Error(err, "Failed to delete the StatefulSet,will requeue after a short time.")
+				return ctrl.Result{RequeueAfter: GenericRequeueDuration}, err
+			}
+		}
+		observeStatefulSet(app, nil)
+		return ctrl.Result{}, nil
+	}
+
+	// 创建使用模版，是为了可以在模块添加一些亲和性，资源请求这些配置
+	appSts, err := r.templates(app).NewStatefulSet(app)
+	if err != nil {
+		logger.Error(err, "Failed to render the app statefulset.")
+		return ctrl.Result{}, err
+	}
+	if err := ctrl.SetControllerReference(app, appSts, r.Scheme); err != nil {
+		logger.Error(err, "Failed to set the controller reference for the app statefulset,will requeue after a short time.")
+		return ctrl.Result{RequeueAfter: GenericRequeueDuration}, err
+	}
+	// 引用的 ConfigMap/Secret 内容变化时修改 pod template 上的 hash，触发滚动更新
+	hash, err := r.configHash(ctx, app)
+	if err != nil {
+		logger.Error(err, "Failed to compute the config hash,will requeue after a short time.")
+		return ctrl.Result{RequeueAfter: GenericRequeueDuration}, err
+	}
+	setConfigHash(&appSts.Spec.Template, hash)
+	r.setDefaultTopologySpread(app, &appSts.Spec.Template.Spec)
+	setTopologySpreadSelector(&appSts.Spec.Template.Spec, appSts.Spec.Selector)
+
+	var live client.Object
+	if exists {
+		live = sts
+	}
+	replicas, err := r.desiredReplicas(ctx, app, live, sts.Spec.Replicas, appSts.Spec.Replicas)
+	if err != nil {
+		logger.Error(err, "Failed to restore the statefulset replicas,will requeue after a short time.")
+		return ctrl.Result{RequeueAfter: GenericRequeueDuration}, err
+	}
+	appSts.Spec.Replicas = replicas
+
+	// server-side apply 只比较 controller 拥有的字段，apiserver 填充的默认值不会再导致每次都更新
+	changed, err := r.applyChild(ctx, app, appSts)
+	if err != nil {
+		logger.Error(err, "Failed to apply the statefulset,will requeue after a short time.")
+		return ctrl.Result{RequeueAfter: GenericRequeueDuration}, err
+	}
+	if changed {
+		logger.Info("The StatefulSet has been applied.")
+		r.Eventer.Eventf(app, corev1.EventTypeNormal, "StatefulSetApplied", "The %s StatefulSet applied successfully. namespace:%s", appSts.Name, appSts.Namespace)
+	}
+	observeStatefulSet(app, appSts)
+	return ctrl.Result{}, nil
+}
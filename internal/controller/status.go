@@ -0,0 +1,389 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	aloystechv2 "aloys.tech/api/v2"
+	"aloys.tech/internal/utils"
+	appsv1 "k8s.io/api/apps/v1"
+	autoscalingv2 "k8s.io/api/autoscaling/v2"
+	corev1 "k8s.io/api/core/v1"
+	netv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Reason 统一放在这里，Ready/Progressing/Degraded 的汇总只依赖这些常量
+const (
+	ReasonReconcileFailed  = "ReconcileFailed"
+	ReasonFieldConflict    = "FieldConflict"
+	ReasonNotOwned         = "NotOwned"
+	ReasonReconciled       = "Reconciled"
+	ReasonChildrenNotReady = "ChildrenNotReady"
+	ReasonAllChildrenReady = "AllChildrenReady"
+
+	ReasonMinimumReplicasAvailable   = "MinimumReplicasAvailable"
+	ReasonMinimumReplicasUnavailable = "MinimumReplicasUnavailable"
+	ReasonRolloutInProgress          = "RolloutInProgress"
+	ReasonProgressDeadlineExceeded   = "ProgressDeadlineExceeded"
+	ReasonReplicaFailure             = "ReplicaFailure"
+	ReasonRolledBack                 = "RolledBack"
+
+	ReasonServiceAvailable    = "ServiceAvailable"
+	ReasonAwaitingClusterIP   = "AwaitingClusterIP"
+	ReasonAwaitingLoadBalance = "AwaitingLoadBalancer"
+
+	ReasonIngressAdmitted = "Admitted"
+	ReasonAwaitingAddress = "AwaitingAddress"
+
+	ReasonRouteAccepted         = "Accepted"
+	ReasonAwaitingGateway       = "AwaitingGateway"
+	ReasonRouteNotAccepted      = "NotAccepted"
+	ReasonGatewayAPIUnavailable = "GatewayAPIUnavailable"
+
+	ReasonAutoscalerPending = "AutoscalerPending"
+
+	ReasonJobRunning   = "JobRunning"
+	ReasonJobSucceeded = "JobSucceeded"
+	ReasonJobFailed    = "JobFailed"
+	// ReasonJobSpecPending App 改了 Job 的 spec，等正在运行的 Job 结束之后再重建
+	ReasonJobSpecPending = "JobSpecPending"
+	ReasonScheduled      = "Scheduled"
+)
+
+// degradedReasons 出现这些 reason 时子资源不会自己恢复，App 记为 Degraded 而不是 Progressing
+var degradedReasons = map[string]bool{
+	ReasonReconcileFailed:          true,
+	ReasonFieldConflict:            true,
+	ReasonNotOwned:                 true,
+	ReasonProgressDeadlineExceeded: true,
+	ReasonReplicaFailure:           true,
+	ReasonJobFailed:                true,
+	ReasonRouteNotAccepted:         true,
+	ReasonGatewayAPIUnavailable:    true,
+	ReasonRenderFailed:             true,
+}
+
+// childConditionTypes 返回当前 spec 下需要参与 Ready 汇总的子资源 condition
+func childConditionTypes(app *aloystechv2.App) []string {
+	types := []string{workloadConditionType(app)}
+	if !isBatch(app) {
+		types = append(types, aloystechv2.ConditionServiceReady)
+	}
+	if ingressEnabled(app) {
+		types = append(types, aloystechv2.ConditionIngressAdmitted)
+	}
+	if gatewayEnabled(app) {
+		types = append(types, aloystechv2.ConditionRouteAccepted)
+	}
+	return types
+}
+
+// advisoryConditionTypes 返回只报告状态、不参与 Ready 汇总的子资源 condition。
+// 默认的 App 没有设置 resources，HPA 拿不到 CPU 指标时 ScalingActive 一直是 False，不能因此卡住 Ready；
+// 只有 controller 自己协调 HPA 失败（degradedReasons）时才计入 Degraded
+func advisoryConditionTypes(app *aloystechv2.App) []string {
+	if autoscalingEnabled(app) {
+		return []string{aloystechv2.ConditionAutoscalerActive}
+	}
+	return nil
+}
+
+func ingressEnabled(app *aloystechv2.App) bool {
+	return app.Spec.Ingress.Enabled && !app.Spec.Service.HasNodePort() && !isBatch(app) && !app.Spec.Exposure.GatewayAPIEnabled()
+}
+
+// autoscalingEnabled 开启后创建 HPA，副本数交给 HPA 管理
+func autoscalingEnabled(app *aloystechv2.App) bool {
+	return app.Spec.AutoscalingEnabled()
+}
+
+func setCondition(app *aloystechv2.App, conditionType string, status metav1.ConditionStatus, reason, message string) {
+	meta.SetStatusCondition(&app.Status.Conditions, metav1.Condition{
+		Type:               conditionType,
+		Status:             status,
+		Reason:             reason,
+		Message:            message,
+		ObservedGeneration: app.Generation,
+	})
+}
+
+// setReconcileFailed 子资源协调失败时调用，失败原因会体现在对应 condition 上
+// server-side apply 的字段冲突单独用 FieldConflict 标记，同名的子资源不属于 App 时用 NotOwned 标记，
+// 模板渲染失败用 RenderFailed 标记，方便和其他错误区分
+func setReconcileFailed(app *aloystechv2.App, conditionType string, err error) {
+	reason := ReasonReconcileFailed
+	var notOwned *notOwnedError
+	var renderErr *utils.RenderError
+	switch {
+	case apierrors.IsConflict(err):
+		reason = ReasonFieldConflict
+	case errors.As(err, &notOwned):
+		reason = ReasonNotOwned
+	case errors.As(err, &renderErr):
+		reason = ReasonRenderFailed
+	}
+	setCondition(app, conditionType, metav1.ConditionFalse, reason, err.Error())
+}
+
+func deploymentReplicas(dp *appsv1.Deployment) int32 {
+	if dp.Spec.Replicas == nil {
+		return 1
+	}
+	return *dp.Spec.Replicas
+}
+
+// observeDeployment 把 Deployment 的当前状态记录到 App status 中，dp 为 nil 表示工作负载不是 Deployment
+func observeDeployment(app *aloystechv2.App, dp *appsv1.Deployment) {
+	if dp == nil {
+		app.Status.Deployment = nil
+		meta.RemoveStatusCondition(&app.Status.Conditions, aloystechv2.ConditionDeploymentAvailable)
+		return
+	}
+	app.Status.Deployment = &aloystechv2.DeploymentSummary{
+		Name:              dp.Name,
+		Replicas:          dp.Status.Replicas,
+		UpdatedReplicas:   dp.Status.UpdatedReplicas,
+		ReadyReplicas:     dp.Status.ReadyReplicas,
+		AvailableReplicas: dp.Status.AvailableReplicas,
+	}
+	// scale 子资源从这里读取当前副本数和 selector，kubectl scale 和 HPA 都依赖它们
+	app.Status.Replicas = dp.Status.Replicas
+	if dp.Spec.Selector != nil {
+		app.Status.Selector = metav1.FormatLabelSelector(dp.Spec.Selector)
+	}
+
+	for _, c := range dp.Status.Conditions {
+		if c.Type == appsv1.DeploymentProgressing && c.Reason == ReasonProgressDeadlineExceeded {
+			setCondition(app, aloystechv2.ConditionDeploymentAvailable, metav1.ConditionFalse, ReasonProgressDeadlineExceeded, c.Message)
+			return
+		}
+		if c.Type == appsv1.DeploymentReplicaFailure && c.Status == corev1.ConditionTrue {
+			setCondition(app, aloystechv2.ConditionDeploymentAvailable, metav1.ConditionFalse, ReasonReplicaFailure, c.Message)
+			return
+		}
+	}
+
+	replicas := deploymentReplicas(dp)
+	switch {
+	case dp.Status.ObservedGeneration < dp.Generation || dp.Status.UpdatedReplicas < replicas:
+		setCondition(app, aloystechv2.ConditionDeploymentAvailable, metav1.ConditionFalse, ReasonRolloutInProgress,
+			fmt.Sprintf("%d of %d replicas updated", dp.Status.UpdatedReplicas, replicas))
+	case dp.Status.AvailableReplicas < replicas:
+		setCondition(app, aloystechv2.ConditionDeploymentAvailable, metav1.ConditionFalse, ReasonMinimumReplicasUnavailable,
+			fmt.Sprintf("%d of %d replicas available", dp.Status.AvailableReplicas, replicas))
+	default:
+		setCondition(app, aloystechv2.ConditionDeploymentAvailable, metav1.ConditionTrue, ReasonMinimumReplicasAvailable,
+			fmt.Sprintf("%d of %d replicas available", dp.Status.AvailableReplicas, replicas))
+	}
+}
+
+// observeStatefulSet 把 StatefulSet 的当前状态记录到 App status 中，sts 为 nil 表示工作负载不是 StatefulSet
+func observeStatefulSet(app *aloystechv2.App, sts *appsv1.StatefulSet) {
+	if sts == nil {
+		app.Status.StatefulSet = nil
+		meta.RemoveStatusCondition(&app.Status.Conditions, aloystechv2.ConditionStatefulSetAvailable)
+		return
+	}
+	app.Status.StatefulSet = &aloystechv2.StatefulSetSummary{
+		Name:              sts.Name,
+		Replicas:          sts.Status.Replicas,
+		UpdatedReplicas:   sts.Status.UpdatedReplicas,
+		ReadyReplicas:     sts.Status.ReadyReplicas,
+		AvailableReplicas: sts.Status.AvailableReplicas,
+		CurrentRevision:   sts.Status.CurrentRevision,
+		UpdateRevision:    sts.Status.UpdateRevision,
+	}
+	app.Status.Replicas = sts.Status.Replicas
+	if sts.Spec.Selector != nil {
+		app.Status.Selector = metav1.FormatLabelSelector(sts.Spec.Selector)
+	}
+
+	replicas := int32(1)
+	if sts.Spec.Replicas != nil {
+		replicas = *sts.Spec.Replicas
+	}
+	// 设置了 partition 时只有序号不小于 partition 的 pod 会更新，更新完这部分就算完成
+	updating := replicas
+	if ru := sts.Spec.UpdateStrategy.RollingUpdate; ru != nil && ru.Partition != nil && *ru.Partition < replicas {
+		updating = replicas - *ru.Partition
+	}
+	switch {
+	case sts.Status.ObservedGeneration < sts.Generation || sts.Status.UpdatedReplicas < updating:
+		setCondition(app, aloystechv2.ConditionStatefulSetAvailable, metav1.ConditionFalse, ReasonRolloutInProgress,
+			fmt.Sprintf("%d of %d replicas updated", sts.Status.UpdatedReplicas, updating))
+	case sts.Status.AvailableReplicas < replicas:
+		setCondition(app, aloystechv2.ConditionStatefulSetAvailable, metav1.ConditionFalse, ReasonMinimumReplicasUnavailable,
+			fmt.Sprintf("%d of %d replicas available", sts.Status.AvailableReplicas, replicas))
+	default:
+		setCondition(app, aloystechv2.ConditionStatefulSetAvailable, metav1.ConditionTrue, ReasonMinimumReplicasAvailable,
+			fmt.Sprintf("%d of %d replicas available", sts.Status.AvailableReplicas, replicas))
+	}
+}
+
+// observeService 把 Service 的当前状态记录到 App status 中，svc 为 nil 表示不需要 Service
+func observeService(app *aloystechv2.App, svc *corev1.Service) {
+	if svc == nil {
+		app.Status.Service = nil
+		meta.RemoveStatusCondition(&app.Status.Conditions, aloystechv2.ConditionServiceReady)
+		return
+	}
+	summary := &aloystechv2.ServiceSummary{
+		Name:      svc.Name,
+		Type:      svc.Spec.Type,
+		ClusterIP: svc.Spec.ClusterIP,
+	}
+	for _, p := range svc.Spec.Ports {
+		summary.Ports = append(summary.Ports, p.Port)
+	}
+	app.Status.Service = summary
+
+	switch {
+	case svc.Spec.ClusterIP == "":
+		setCondition(app, aloystechv2.ConditionServiceReady, metav1.ConditionFalse, ReasonAwaitingClusterIP, "the service has no cluster IP yet")
+	case svc.Spec.Type == corev1.ServiceTypeLoadBalancer && len(svc.Status.LoadBalancer.Ingress) == 0:
+		setCondition(app, aloystechv2.ConditionServiceReady, metav1.ConditionFalse, ReasonAwaitingLoadBalance, "the load balancer has not been provisioned yet")
+	default:
+		setCondition(app, aloystechv2.ConditionServiceReady, metav1.ConditionTrue, ReasonServiceAvailable, "")
+	}
+}
+
+// observeIngress 把 Ingress 的当前状态记录到 App status 中，ingress 为 nil 表示不需要 ingress
+func observeIngress(app *aloystechv2.App, ing *netv1.Ingress) {
+	if ing == nil {
+		app.Status.Ingress = nil
+		meta.RemoveStatusCondition(&app.Status.Conditions, aloystechv2.ConditionIngressAdmitted)
+		return
+	}
+	summary := &aloystechv2.IngressSummary{Name: ing.Name}
+	for _, rule := range ing.Spec.Rules {
+		if rule.Host != "" {
+			summary.Hosts = append(summary.Hosts, rule.Host)
+		}
+	}
+	for _, lb := range ing.Status.LoadBalancer.Ingress {
+		if lb.IP != "" {
+			summary.Addresses = append(summary.Addresses, lb.IP)
+		} else if lb.Hostname != "" {
+			summary.Addresses = append(summary.Addresses, lb.Hostname)
+		}
+	}
+	app.Status.Ingress = summary
+
+	if len(summary.Addresses) == 0 {
+		setCondition(app, aloystechv2.ConditionIngressAdmitted, metav1.ConditionFalse, ReasonAwaitingAddress, "the ingress controller has not published an address yet")
+		return
+	}
+	setCondition(app, aloystechv2.ConditionIngressAdmitted, metav1.ConditionTrue, ReasonIngressAdmitted, strings.Join(summary.Addresses, ","))
+}
+
+// observeHorizontalPodAutoscaler 把 HPA 的当前状态记录到 App status 中，hpa 为 nil 表示没有开启自动扩缩容
+func observeHorizontalPodAutoscaler(app *aloystechv2.App, hpa *autoscalingv2.HorizontalPodAutoscaler) {
+	if hpa == nil {
+		app.Status.Autoscaler = nil
+		meta.RemoveStatusCondition(&app.Status.Conditions, aloystechv2.ConditionAutoscalerActive)
+		return
+	}
+	summary := &aloystechv2.AutoscalerSummary{
+		Name:            hpa.Name,
+		MaxReplicas:     hpa.Spec.MaxReplicas,
+		CurrentReplicas: hpa.Status.CurrentReplicas,
+		DesiredReplicas: hpa.Status.DesiredReplicas,
+	}
+	if hpa.Spec.MinReplicas != nil {
+		summary.MinReplicas = *hpa.Spec.MinReplicas
+	}
+	app.Status.Autoscaler = summary
+
+	for _, c := range hpa.Status.Conditions {
+		if c.Type != autoscalingv2.ScalingActive {
+			continue
+		}
+		status := metav1.ConditionFalse
+		if c.Status == corev1.ConditionTrue {
+			status = metav1.ConditionTrue
+		}
+		setCondition(app, aloystechv2.ConditionAutoscalerActive, status, c.Reason, c.Message)
+		return
+	}
+	setCondition(app, aloystechv2.ConditionAutoscalerActive, metav1.ConditionUnknown, ReasonAutoscalerPending, "the autoscaler has not reported any metrics yet")
+}
+
+// computeStatus 根据各子资源的 condition 汇总出 Ready/Progressing/Degraded 以及 phase
+func computeStatus(app *aloystechv2.App) {
+	var notReady, degraded []string
+	for _, t := range childConditionTypes(app) {
+		c := meta.FindStatusCondition(app.Status.Conditions, t)
+		if c == nil || c.Status != metav1.ConditionTrue {
+			notReady = append(notReady, t)
+		}
+		if c != nil && c.Status != metav1.ConditionTrue && degradedReasons[c.Reason] {
+			degraded = append(degraded, fmt.Sprintf("%s: %s", t, c.Message))
+		}
+	}
+	for _, t := range advisoryConditionTypes(app) {
+		if c := meta.FindStatusCondition(app.Status.Conditions, t); c != nil && c.Status != metav1.ConditionTrue && degradedReasons[c.Reason] {
+			degraded = append(degraded, fmt.Sprintf("%s: %s", t, c.Message))
+		}
+	}
+
+	// 自动回滚之后子资源恢复正常，但 spec 里的 image 并没有发布成功，直到 spec 修改之前都记为 Degraded
+	rolledBack := app.Status.Rollback != nil && app.Status.Rollback.FailedRevision != ""
+	if rolledBack {
+		degraded = append(degraded, fmt.Sprintf("the image %s exceeded the progress deadline and was rolled back to the revision %s",
+			app.Status.Rollback.FailedImage, app.Status.Rollback.LastGoodRevision))
+	}
+
+	switch {
+	case rolledBack:
+		setCondition(app, aloystechv2.ConditionDegraded, metav1.ConditionTrue, ReasonRolledBack, strings.Join(degraded, "; "))
+	case len(degraded) > 0:
+		setCondition(app, aloystechv2.ConditionDegraded, metav1.ConditionTrue, ReasonChildrenNotReady, strings.Join(degraded, "; "))
+	default:
+		setCondition(app, aloystechv2.ConditionDegraded, metav1.ConditionFalse, ReasonReconciled, "")
+	}
+
+	switch {
+	case len(notReady) > 0 && len(degraded) == 0:
+		setCondition(app, aloystechv2.ConditionProgressing, metav1.ConditionTrue, ReasonChildrenNotReady, "waiting for "+strings.Join(notReady, ", "))
+	default:
+		setCondition(app, aloystechv2.ConditionProgressing, metav1.ConditionFalse, ReasonReconciled, "")
+	}
+
+	switch {
+	case len(notReady) > 0:
+		setCondition(app, aloystechv2.ConditionReady, metav1.ConditionFalse, ReasonChildrenNotReady, "not ready: "+strings.Join(notReady, ", "))
+	default:
+		setCondition(app, aloystechv2.ConditionReady, metav1.ConditionTrue, ReasonAllChildrenReady, "")
+	}
+
+	switch {
+	case len(degraded) > 0:
+		app.Status.Phase = aloystechv2.AppPhaseDegraded
+	case len(notReady) == 0:
+		app.Status.Phase = aloystechv2.AppPhaseRunning
+	case app.Status.Deployment == nil && app.Status.StatefulSet == nil && app.Status.Job == nil:
+		app.Status.Phase = aloystechv2.AppPhasePending
+	default:
+		app.Status.Phase = aloystechv2.AppPhaseProgressing
+	}
+	// 删除过程中子资源的状态已经没有意义，phase 只反映删除的进度
+	if !app.DeletionTimestamp.IsZero() {
+		app.Status.Phase = aloystechv2.AppPhaseTerminating
+	}
+	app.Status.ObservedGeneration = app.Generation
+}
+
+// updateStatus 汇总 status 并且只在和上一次不同的时候写回，避免每轮协调都更新 App
+func (r *AppReconciler) updateStatus(ctx context.Context, app *aloystechv2.App, old *aloystechv2.AppStatus) error {
+	computeStatus(app)
+	if equality.Semantic.DeepEqual(old, &app.Status) {
+		return nil
+	}
+	return r.Status().Update(ctx, app)
+}
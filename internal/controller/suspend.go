@@ -0,0 +1,157 @@
+package controller
+
+import (
+	"context"
+	"time"
+
+	aloystechv2 "aloys.tech/api/v2"
+	appsv1 "k8s.io/api/apps/v1"
+	autoscalingv2 "k8s.io/api/autoscaling/v2"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	netv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const ReasonSuspended = "Suspended"
+
+// observeSuspended 根据 spec.suspend 设置 Suspended condition，恢复之后去掉它
+func observeSuspended(app *aloystechv2.App) {
+	if !app.Spec.Suspend {
+		meta.RemoveStatusCondition(&app.Status.Conditions, aloystechv2.ConditionSuspended)
+		return
+	}
+	setCondition(app, aloystechv2.ConditionSuspended, metav1.ConditionTrue, ReasonSuspended,
+		"spec.suspend is set, the children are not changed until it is cleared")
+}
+
+// getIfExists 读取子资源，不存在时返回 false
+func (r *AppReconciler) getIfExists(ctx context.Context, app *aloystechv2.App, name string, obj client.Object) (bool, error) {
+	err := r.Get(ctx, GetNamespacedName(name, "", app.Namespace), obj)
+	if errors.IsNotFound(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// observeChildren App 暂停时使用，只读取子资源的当前状态记录到 status，不创建、修改或删除任何子资源
+func (r *AppReconciler) observeChildren(ctx context.Context, app *aloystechv2.App) error {
+	kind := workloadKind(app)
+
+	var dp *appsv1.Deployment
+	if kind == aloystechv2.WorkloadDeployment {
+		live := &appsv1.Deployment{}
+		found, err := r.getIfExists(ctx, app, activeDeploymentName(app), live)
+		if err != nil {
+			return err
+		}
+		if found {
+			dp = live
+		}
+	}
+	observeDeployment(app, dp)
+
+	var sts *appsv1.StatefulSet
+	if kind == aloystechv2.WorkloadStatefulSet {
+		live := &appsv1.StatefulSet{}
+		found, err := r.getIfExists(ctx, app, app.Name+"-sts", live)
+		if err != nil {
+			return err
+		}
+		if found {
+			sts = live
+		}
+	}
+	observeStatefulSet(app, sts)
+
+	switch kind {
+	case aloystechv2.WorkloadJob:
+		job := &batchv1.Job{}
+		found, err := r.getIfExists(ctx, app, app.Name+"-job", job)
+		if err != nil {
+			return err
+		}
+		if !found {
+			job = nil
+		}
+		observeJob(app, job)
+	case aloystechv2.WorkloadCronJob:
+		cj := &batchv1.CronJob{}
+		found, err := r.getIfExists(ctx, app, app.Name+"-cronjob", cj)
+		if err != nil {
+			return err
+		}
+		if found {
+			runs, err := r.cronJobRuns(ctx, app, cj.Name)
+			if err != nil {
+				return err
+			}
+			observeCronJob(app, cj, runs, time.Now())
+		} else {
+			observeJob(app, nil)
+		}
+	default:
+		observeJob(app, nil)
+	}
+
+	var svc *corev1.Service
+	if !isBatch(app) {
+		live := &corev1.Service{}
+		found, err := r.getIfExists(ctx, app, app.Name+"-svc", live)
+		if err != nil {
+			return err
+		}
+		if found {
+			svc = live
+		}
+	}
+	observeService(app, svc)
+
+	var hpa *autoscalingv2.HorizontalPodAutoscaler
+	if autoscalingEnabled(app) {
+		live := &autoscalingv2.HorizontalPodAutoscaler{}
+		found, err := r.getIfExists(ctx, app, app.Name+"-hpa", live)
+		if err != nil {
+			return err
+		}
+		if found {
+			hpa = live
+		}
+	}
+	observeHorizontalPodAutoscaler(app, hpa)
+
+	var ing *netv1.Ingress
+	if ingressEnabled(app) {
+		live := &netv1.Ingress{}
+		found, err := r.getIfExists(ctx, app, app.Name+"-ingress", live)
+		if err != nil {
+			return err
+		}
+		if found {
+			ing = live
+		}
+	}
+	observeIngress(app, ing)
+
+	var routes []*unstructured.Unstructured
+	for _, route := range r.gatewayRoutes() {
+		if !route.wanted(app) || route.gvk == nil {
+			continue
+		}
+		live := &unstructured.Unstructured{}
+		live.SetGroupVersionKind(*route.gvk)
+		found, err := r.getIfExists(ctx, app, app.Name+route.suffix, live)
+		if err != nil {
+			return err
+		}
+		if found {
+			routes = append(routes, live)
+		}
+	}
+	observeGatewayRoutes(app, routes)
+	return nil
+}
@@ -0,0 +1,230 @@
+package controller
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"sync"
+
+	aloystechv2 "aloys.tech/api/v2"
+	"aloys.tech/internal/utils"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+const (
+	// TemplateConfigMapName 覆盖内置模板的 ConfigMap，key 是模板的文件名，例如 deployment.yml、pod.yml。
+	// 放在 controller 所在的命名空间对整个集群生效，放在其他命名空间只对这个命名空间的 App 生效，命名空间的优先。
+	// 命名空间级别的 ConfigMap 只有在集群级别的 ConfigMap 上通过 TemplateNamespacesAnnotation 允许之后才加载
+	TemplateConfigMapName = "app-templates"
+	// TemplateVersionAnnotation 写在 app-templates ConfigMap 上作为覆盖模板的版本，没有时使用内容的 hash
+	TemplateVersionAnnotation = "aloys.tech/template-version"
+	// TemplateNamespacesAnnotation 写在集群级别的 app-templates ConfigMap 上，逗号分隔的命名空间列表，
+	// 只有列出的命名空间可以用自己的 app-templates 覆盖模板，"*" 表示所有命名空间
+	TemplateNamespacesAnnotation = "aloys.tech/template-namespaces"
+
+	ReasonInvalidTemplates    = "InvalidTemplates"
+	ReasonTemplatesNotAllowed = "TemplatesNotAllowed"
+)
+
+// templateVersion 返回 ConfigMap 里模板的版本
+func templateVersion(cm *corev1.ConfigMap) string {
+	if v := cm.Annotations[TemplateVersionAnnotation]; v != "" {
+		return v
+	}
+	h := sha256.New()
+	writeHashEntry(h, cm.Name, cm.Data, nil)
+	return hex.EncodeToString(h.Sum(nil))[:10]
+}
+
+// TemplateLoader 把集群和命名空间两级的 app-templates ConfigMap 叠加在内置模板上，作为每个命名空间使用的模板。
+// ConfigMap 通过传入的 Reader 读取，一般是 manager 带缓存的 client，webhook 不是 leader 或者刚启动时也能读到。
+// 加载的结果缓存在 loader 里，ConfigMap 没有变化时直接复用；controller 和 webhook 各用一个 loader，互不影响事件的记录
+type TemplateLoader struct {
+	Reader client.Reader
+	// Namespace 是 controller 所在的命名空间，这里的 app-templates ConfigMap 对整个集群生效。
+	// 为空时没有集群级别的 ConfigMap 允许命名空间覆盖模板，所有 App 都使用内置模板
+	Namespace string
+
+	mu   sync.Mutex
+	sets map[string]*utils.TemplateSet
+}
+
+// templateLoad 一次加载的结果，changed 表示 ConfigMap 和上次加载时不同，调用方需要记录 ignored 和 invalid 的事件
+type templateLoad struct {
+	set      *utils.TemplateSet
+	previous *utils.TemplateSet
+	changed  bool
+	ignored  []*corev1.ConfigMap
+	invalid  *corev1.ConfigMap
+	err      error
+}
+
+// load 读取命名空间使用的 app-templates ConfigMap，没有变化时返回缓存的模板；
+// 校验失败时继续使用上一次合法的模板，修复 ConfigMap 之后自动恢复
+func (l *TemplateLoader) load(ctx context.Context, namespace string) (*templateLoad, error) {
+	if l == nil {
+		return &templateLoad{set: utils.BuiltinTemplates()}, nil
+	}
+	namespaces := []string{namespace}
+	if l.Namespace != "" && l.Namespace != namespace {
+		namespaces = []string{l.Namespace, namespace}
+	}
+	var cluster *corev1.ConfigMap
+	var layers, ignored []*corev1.ConfigMap
+	var sources []string
+	for _, ns := range namespaces {
+		cm := &corev1.ConfigMap{}
+		err := l.Reader.Get(ctx, GetNamespacedName(TemplateConfigMapName, "", ns), cm)
+		if errors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if ns == l.Namespace {
+			cluster = cm
+		} else if !namespaceTemplatesAllowed(cluster, ns) {
+			// 忽略的 ConfigMap 也记到来源里，事件只记录一次
+			ignored = append(ignored, cm)
+			sources = append(sources, ns+"@"+cm.ResourceVersion+"(ignored)")
+			continue
+		}
+		layers = append(layers, cm)
+		sources = append(sources, ns+"@"+cm.ResourceVersion)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	current := l.cachedLocked(namespace)
+	source := strings.Join(sources, ",")
+	if current.Source == source {
+		return &templateLoad{set: current}, nil
+	}
+	result := &templateLoad{previous: current, changed: true, ignored: ignored}
+	set := utils.BuiltinTemplates()
+	for _, cm := range layers {
+		scope := "namespace"
+		if cm == cluster {
+			scope = "cluster"
+		}
+		next, err := set.Override(cm.Data, scope+":"+templateVersion(cm))
+		if err != nil {
+			// 记下失败的来源，ConfigMap 修改之前不再重复校验和记录事件
+			set, result.invalid, result.err = current, cm, err
+			break
+		}
+		set = next
+	}
+	result.set = set.WithSource(source)
+	if l.sets == nil {
+		l.sets = map[string]*utils.TemplateSet{}
+	}
+	l.sets[namespace] = result.set
+	return result, nil
+}
+
+// For 返回命名空间里的 App 使用的模板
+func (l *TemplateLoader) For(ctx context.Context, namespace string) (*utils.TemplateSet, error) {
+	result, err := l.load(ctx, namespace)
+	if err != nil {
+		return nil, err
+	}
+	return result.set, nil
+}
+
+// DryRunOverrides 按 App 所在命名空间的模板检查 spec.overrides 能不能应用，交给 webhook 在接受 App 之前调用
+func (l *TemplateLoader) DryRunOverrides(ctx context.Context, app *aloystechv2.App) error {
+	set, err := l.For(ctx, app.Namespace)
+	if err != nil {
+		return err
+	}
+	return set.DryRunOverrides(app)
+}
+
+// cached 返回上次为命名空间加载的模板，还没有加载过时使用内置模板
+func (l *TemplateLoader) cached(namespace string) *utils.TemplateSet {
+	if l == nil {
+		return utils.BuiltinTemplates()
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.cachedLocked(namespace)
+}
+
+func (l *TemplateLoader) cachedLocked(namespace string) *utils.TemplateSet {
+	if set, ok := l.sets[namespace]; ok {
+		return set
+	}
+	return utils.BuiltinTemplates()
+}
+
+// loadTemplates 协调开始时加载 App 所在命名空间的模板，并把使用的版本记录到 status 上。
+// 忽略或者校验失败的 ConfigMap 在 App 和 ConfigMap 上记录一次 Warning 事件
+func (r *AppReconciler) loadTemplates(ctx context.Context, app *aloystechv2.App) error {
+	result, err := r.Templates.load(ctx, app.Namespace)
+	if err != nil {
+		return err
+	}
+	app.Status.TemplateVersion = result.set.Version
+	if !result.changed {
+		return nil
+	}
+	for _, cm := range result.ignored {
+		r.Eventer.Eventf(cm, corev1.EventTypeWarning, ReasonTemplatesNotAllowed,
+			"The templates are ignored, the namespace is not listed in the %s annotation of the ConfigMap %s/%s.", TemplateNamespacesAnnotation, r.Templates.Namespace, TemplateConfigMapName)
+		r.Eventer.Eventf(app, corev1.EventTypeWarning, ReasonTemplatesNotAllowed,
+			"The templates in the ConfigMap %s/%s are ignored, the namespace is not allowed to override the templates.", cm.Namespace, cm.Name)
+	}
+	if cm := result.invalid; cm != nil {
+		r.Eventer.Eventf(cm, corev1.EventTypeWarning, ReasonInvalidTemplates, "The templates are invalid and ignored: %v", result.err)
+		r.Eventer.Eventf(app, corev1.EventTypeWarning, ReasonInvalidTemplates,
+			"The templates in the ConfigMap %s/%s are invalid, still rendering with %s: %v", cm.Namespace, cm.Name, result.previous.Version, result.err)
+		return nil
+	}
+	if result.set.Version != utils.BuiltinTemplateVersion {
+		log.FromContext(ctx).Info("Loaded the templates.", "namespace", app.Namespace, "version", result.set.Version)
+	}
+	return nil
+}
+
+// templates 返回协调开始时为 App 所在命名空间加载的模板
+func (r *AppReconciler) templates(app *aloystechv2.App) *utils.TemplateSet {
+	return r.Templates.cached(app.Namespace)
+}
+
+// namespaceTemplatesAllowed 命名空间的 app-templates 可以修改 pod.yml，相当于可以创建任意的 pod，
+// 只有集群级别的 ConfigMap 上 TemplateNamespacesAnnotation 列出的命名空间才加载，租户不能修改 controller 命名空间里的 ConfigMap
+func namespaceTemplatesAllowed(cluster *corev1.ConfigMap, namespace string) bool {
+	if cluster == nil {
+		return false
+	}
+	for _, ns := range strings.Split(cluster.Annotations[TemplateNamespacesAnnotation], ",") {
+		if ns = strings.TrimSpace(ns); ns == "*" || ns == namespace {
+			return true
+		}
+	}
+	return false
+}
+
+// appsForTemplates app-templates 变化时重新渲染受影响的 App：集群级别的影响所有 App，命名空间级别的只影响这个命名空间
+func (r *AppReconciler) appsForTemplates(ctx context.Context, obj client.Object) []reconcile.Request {
+	var opts []client.ListOption
+	if r.Templates == nil || obj.GetNamespace() != r.Templates.Namespace {
+		opts = append(opts, client.InNamespace(obj.GetNamespace()))
+	}
+	apps := &aloystechv2.AppList{}
+	if err := r.List(ctx, apps, opts...); err != nil {
+		log.FromContext(ctx).Error(err, "Failed to list the apps using the templates.", "namespace", obj.GetNamespace())
+		return nil
+	}
+	requests := make([]reconcile.Request, 0, len(apps.Items))
+	for _, app := range apps.Items {
+		requests = append(requests, reconcile.Request{NamespacedName: GetNamespacedName(app.Name, "", app.Namespace)})
+	}
+	return requests
+}
@@ -0,0 +1,160 @@
+package controller
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+
+	aloystechv2 "aloys.tech/api/v2"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+)
+
+// TemplateHashAnnotation 记录子资源是按哪个版本的 spec 渲染的，用来判断 App 是否修改了工作负载
+const TemplateHashAnnotation = "aloys.tech/template-hash"
+
+// workloadKind 返回运行 App pod 的工作负载类型，没有设置时是 Deployment
+func workloadKind(app *aloystechv2.App) aloystechv2.WorkloadKind {
+	if app.Spec.Workload.Kind == "" {
+		return aloystechv2.WorkloadDeployment
+	}
+	return app.Spec.Workload.Kind
+}
+
+// isStatefulSet App 的 pod 由 StatefulSet 运行时返回 true
+func isStatefulSet(app *aloystechv2.App) bool {
+	return workloadKind(app) == aloystechv2.WorkloadStatefulSet
+}
+
+// isBatch Job 和 CronJob 不需要 Service、Ingress 和 HPA
+func isBatch(app *aloystechv2.App) bool {
+	return app.Spec.Workload.IsBatch()
+}
+
+// workloadConditionType 返回当前工作负载对应的 condition
+func workloadConditionType(app *aloystechv2.App) string {
+	switch workloadKind(app) {
+	case aloystechv2.WorkloadStatefulSet:
+		return aloystechv2.ConditionStatefulSetAvailable
+	case aloystechv2.WorkloadJob:
+		return aloystechv2.ConditionJobSucceeded
+	case aloystechv2.WorkloadCronJob:
+		return aloystechv2.ConditionCronJobScheduled
+	default:
+		return aloystechv2.ConditionDeploymentAvailable
+	}
+}
+
+// desiredReplicas 按副本数的归属决定提交给工作负载的副本数，live 为 nil 表示工作负载还不存在。
+// 开启自动扩缩容后副本数归 HPA 管理，App 里的副本数只在创建时作为初始值，之后返回 nil，apply 的对象里不带 replicas，
+// controller 不再是这个字段的 manager，不会把之前读到的副本数写回去，和 HPA 来回修改
+func (r *AppReconciler) desiredReplicas(ctx context.Context, app *aloystechv2.App, live client.Object, liveReplicas, rendered *int32) (*int32, error) {
+	if autoscalingEnabled(app) {
+		app.Status.ReplicasControlledBy = aloystechv2.ReplicaControllerHPA
+		if live == nil {
+			return rendered, nil
+		}
+		if liveReplicas != nil && managesReplicas(live, FieldManager) {
+			if err := r.handOverReplicas(ctx, live, *liveReplicas); err != nil {
+				return nil, err
+			}
+		}
+		return nil, nil
+	}
+	app.Status.ReplicasControlledBy = aloystechv2.ReplicaControllerApp
+	// 关闭自动扩缩容后 replicas 可能还记在 HPA 的 manager 名下，apply 会报冲突，
+	// 先用普通 patch 把副本数改回来并拿回这个字段，其他字段的冲突仍然照常上报
+	if live != nil && rendered != nil && (liveReplicas == nil || *liveReplicas != *rendered) {
+		patch := client.RawPatch(types.MergePatchType, []byte(fmt.Sprintf(`{"spec":{"replicas":%d}}`, *rendered)))
+		if err := r.Patch(ctx, live, patch, client.FieldOwner(FieldManager)); err != nil {
+			return nil, err
+		}
+	}
+	return rendered, nil
+}
+
+// ReplicasHandoverFieldManager controller 放弃 replicas 之前，先用这个 manager apply 一次同样的值，
+// 字段一直有 manager 占有，apiserver 不会在 controller 不再提交它的时候把副本数重置成默认值
+const ReplicasHandoverFieldManager = "handover-to-hpa"
+
+// handOverReplicas 把 .spec.replicas 的所有权交给 ReplicasHandoverFieldManager，之后 HPA 通过 scale 子资源修改它
+func (r *AppReconciler) handOverReplicas(ctx context.Context, live client.Object, replicas int32) error {
+	gvk, err := apiutil.GVKForObject(live, r.Scheme)
+	if err != nil {
+		return err
+	}
+	handover := &unstructured.Unstructured{}
+	handover.SetGroupVersionKind(gvk)
+	handover.SetName(live.GetName())
+	handover.SetNamespace(live.GetNamespace())
+	if err := unstructured.SetNestedField(handover.Object, int64(replicas), "spec", "replicas"); err != nil {
+		return err
+	}
+	return r.Patch(ctx, handover, client.Apply, client.FieldOwner(ReplicasHandoverFieldManager))
+}
+
+// managesReplicas 判断 manager 是否通过 server-side apply 占有 .spec.replicas
+func managesReplicas(obj client.Object, manager string) bool {
+	for _, f := range obj.GetManagedFields() {
+		if f.Manager != manager || f.Operation != metav1.ManagedFieldsOperationApply || f.FieldsV1 == nil {
+			continue
+		}
+		var fields map[string]map[string]interface{}
+		if err := json.Unmarshal(f.FieldsV1.Raw, &fields); err != nil {
+			continue
+		}
+		if _, ok := fields["f:spec"]["f:replicas"]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// setConfigHash 把引用配置的 hash 写到 pod template 上，hash 为空表示没有引用任何配置
+func setConfigHash(template *corev1.PodTemplateSpec, hash string) {
+	if hash == "" {
+		return
+	}
+	if template.Annotations == nil {
+		template.Annotations = map[string]string{}
+	}
+	template.Annotations[ConfigHashAnnotation] = hash
+}
+
+// specHash 计算渲染结果的 hash，写到 TemplateHashAnnotation 上
+func specHash(spec interface{}) (string, error) {
+	b, err := json.Marshal(spec)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])[:16], nil
+}
+
+// setTemplateHash 把 hash 记到子资源自己的注解上，不放在 pod template 里，避免 hash 本身触发滚动更新
+func setTemplateHash(obj client.Object, hash string) {
+	annotations := obj.GetAnnotations()
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	annotations[TemplateHashAnnotation] = hash
+	obj.SetAnnotations(annotations)
+}
+
+// runsRevision 判断 live 的 Deployment 是不是已经是 desired 的 pod template。
+// 没有 TemplateHashAnnotation 的 Deployment（之前的版本创建的，或者被人改过注解）不能当成已经是新版本，
+// 直接比较 pod template，desired 里没有设置的字段不参与比较，apiserver 填充的默认值不会导致误判
+func runsRevision(live, desired *appsv1.Deployment, revision string) bool {
+	if hash := live.Annotations[TemplateHashAnnotation]; hash != "" {
+		return hash == revision
+	}
+	return equality.Semantic.DeepDerivative(desired.Spec.Template, live.Spec.Template)
+}
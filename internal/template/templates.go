@@ -0,0 +1,9 @@
+// Package template 保存渲染子资源的内置模板，编译时嵌入到二进制中，不依赖进程的工作目录
+package template
+
+import "embed"
+
+// FS 内置的模板文件，文件名就是模板名，pod.yml 是各个工作负载共用的 pod template
+//
+//go:embed *.yml
+var FS embed.FS
@@ -0,0 +1,138 @@
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+
+	aloystechv2 "aloys.tech/api/v2"
+	jsonpatch "github.com/evanphx/json-patch/v5"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/util/strategicpatch"
+	"sigs.k8s.io/yaml"
+)
+
+// OverrideError spec.overrides 里的 patch 没法应用到渲染出来的子资源上，不修改 spec 重试也不会成功
+type OverrideError struct {
+	Index int
+	Kind  string
+	Err   error
+}
+
+func (e *OverrideError) Error() string {
+	return fmt.Sprintf("spec.overrides[%d] cannot be applied to the %s: %v", e.Index, e.Kind, e.Err)
+}
+
+func (e *OverrideError) Unwrap() error {
+	return e.Err
+}
+
+// applyOverrides 按顺序把 spec.overrides 里针对 kind 的 patch 应用到渲染好的 obj 上，
+// 每个 patch 的结果都要能解析回 obj 的类型，出错时可以指出是哪个 patch 的问题
+func applyOverrides(app *aloystechv2.App, kind string, obj interface{}) error {
+	var doc []byte
+	var patched reflect.Value
+	for i, o := range app.Spec.Overrides {
+		if o.Kind != kind {
+			continue
+		}
+		if doc == nil {
+			b, err := json.Marshal(obj)
+			if err != nil {
+				return err
+			}
+			doc = b
+		}
+		next, err := applyPatch(o, doc, obj)
+		if err == nil {
+			err = checkIdentity(doc, next)
+		}
+		if err == nil {
+			// patch 可能删除字段，解析到新的对象上，不能在原来的值上合并
+			patched = reflect.New(reflect.TypeOf(obj).Elem())
+			err = json.Unmarshal(next, patched.Interface())
+		}
+		if err != nil {
+			return &OverrideError{Index: i, Kind: kind, Err: err}
+		}
+		doc = next
+	}
+	if patched.IsValid() {
+		reflect.ValueOf(obj).Elem().Set(patched.Elem())
+	}
+	return nil
+}
+
+// applyPatch 把一个 patch 应用到 doc 上，Gateway API 的路由没有 Go 类型，strategic merge 退化成 JSON merge patch
+func applyPatch(o aloystechv2.ChildOverride, doc []byte, obj interface{}) ([]byte, error) {
+	// webhook 已经拒绝过这样的 patch，webhook 之前创建的 App 在这里拒绝
+	if f := o.ForbiddenField(); f != "" {
+		return nil, fmt.Errorf("the patch must not set %s", f)
+	}
+	patch, err := yaml.YAMLToJSON([]byte(o.Patch))
+	if err != nil {
+		return nil, fmt.Errorf("the patch is not valid YAML: %w", err)
+	}
+	switch o.TypeOrDefault() {
+	case aloystechv2.OverrideJSON6902:
+		ops, err := jsonpatch.DecodePatch(patch)
+		if err != nil {
+			return nil, fmt.Errorf("the patch is not a list of JSON6902 operations: %w", err)
+		}
+		return ops.Apply(doc)
+	case aloystechv2.OverrideStrategicMerge:
+		if _, ok := obj.(*unstructured.Unstructured); ok {
+			return jsonpatch.MergePatch(doc, patch)
+		}
+		return strategicpatch.StrategicMergePatch(doc, patch, obj)
+	default:
+		return nil, fmt.Errorf("unknown patch type %q", o.Type)
+	}
+}
+
+// checkIdentity patch 不能修改子资源的 apiVersion、kind、名字和命名空间，否则 controller 会创建出不受管理的对象
+func checkIdentity(before, after []byte) error {
+	var b, a metav1.PartialObjectMetadata
+	if err := json.Unmarshal(before, &b); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(after, &a); err != nil {
+		return fmt.Errorf("the patched object is invalid: %w", err)
+	}
+	if a.APIVersion != b.APIVersion || a.Kind != b.Kind || a.Name != b.Name || a.Namespace != b.Namespace {
+		return fmt.Errorf("the patch must not change the apiVersion, kind, name or namespace")
+	}
+	return nil
+}
+
+// DryRunOverrides 用这组模板渲染 spec.overrides 针对的每一种子资源，检查 patch 能不能应用，webhook 在接受 App 之前调用。
+// 只返回 patch 的错误，模板本身渲染失败由 controller 记录到 RenderFailed condition 上
+func (s *TemplateSet) DryRunOverrides(app *aloystechv2.App) error {
+	kinds := map[string]bool{}
+	for _, o := range app.Spec.Overrides {
+		kinds[o.Kind] = true
+	}
+	for _, name := range s.Names() {
+		name = name[:len(name)-len(".yml")]
+		want, ok := templateKinds[name]
+		if !ok || !kinds[want.kind] || !overridable(name) {
+			continue
+		}
+		obj := interface{}(&unstructured.Unstructured{})
+		if want.obj != nil {
+			obj = want.obj()
+		}
+		var overrideErr *OverrideError
+		if err := s.render(name, app, obj); errors.As(err, &overrideErr) {
+			return overrideErr
+		}
+	}
+	return nil
+}
+
+// overridable pre-delete hook 的 Job 不是 App 运行时的子资源，不应用 spec.overrides
+func overridable(templateName string) bool {
+	return templateName != "predelete_job"
+}
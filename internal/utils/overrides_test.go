@@ -0,0 +1,133 @@
+package utils
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	aloystechv2 "aloys.tech/api/v2"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func overrideApp(overrides ...aloystechv2.ChildOverride) *aloystechv2.App {
+	return &aloystechv2.App{
+		ObjectMeta: metav1.ObjectMeta{Name: "demo", Namespace: "default"},
+		Spec: aloystechv2.AppSpec{
+			Deployment:    aloystechv2.AppDeploymentSpec{Image: "nginx"},
+			Service:       aloystechv2.AppServiceSpec{Ports: []aloystechv2.ServicePort{{Name: "http", Port: 80}}},
+			PreDeleteHook: &aloystechv2.PreDeleteHook{Command: []string{"true"}},
+			Overrides:     overrides,
+		},
+	}
+}
+
+func TestStrategicMergeOverride(t *testing.T) {
+	app := overrideApp(aloystechv2.ChildOverride{Kind: "Deployment", Patch: `
+spec:
+  template:
+    spec:
+      tolerations:
+      - key: dedicated
+        operator: Exists
+      containers:
+      - name: proxy
+        image: envoy
+`})
+	d, err := BuiltinTemplates().NewDeployment(app)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// containers 按 name 合并，原来的容器保留
+	images := map[string]string{}
+	for _, c := range d.Spec.Template.Spec.Containers {
+		images[c.Name] = c.Image
+	}
+	if len(images) != 2 || images["demo"] != "nginx" || images["proxy"] != "envoy" {
+		t.Fatalf("the sidecar is not merged into the containers: %v", images)
+	}
+	if len(d.Spec.Template.Spec.Tolerations) != 1 || d.Spec.Template.Spec.Tolerations[0].Operator != corev1.TolerationOpExists {
+		t.Fatalf("the toleration is not added: %+v", d.Spec.Template.Spec.Tolerations)
+	}
+	canary, err := BuiltinTemplates().NewCanaryDeployment(app)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(canary.Spec.Template.Spec.Containers) != 2 {
+		t.Fatal("the canary Deployment is not patched")
+	}
+	if _, err := BuiltinTemplates().NewStatefulSet(app); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestJSON6902Override(t *testing.T) {
+	app := overrideApp(aloystechv2.ChildOverride{
+		Kind:  "Service",
+		Type:  aloystechv2.OverrideJSON6902,
+		Patch: `[{"op": "add", "path": "/metadata/annotations", "value": {"team": "platform"}}, {"op": "remove", "path": "/spec/selector"}]`,
+	})
+	s, err := BuiltinTemplates().NewService(app)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Annotations["team"] != "platform" || s.Spec.Selector != nil {
+		t.Fatalf("the JSON6902 patch is not applied: annotations %v, selector %v", s.Annotations, s.Spec.Selector)
+	}
+	// pre-delete hook 不应用 overrides
+	app.Spec.Overrides[0].Kind = "Job"
+	if _, err := BuiltinTemplates().NewPreDeleteJob(app); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOverrideErrors(t *testing.T) {
+	for name, tc := range map[string]struct {
+		override aloystechv2.ChildOverride
+		err      string
+	}{
+		"rename": {
+			override: aloystechv2.ChildOverride{Kind: "Deployment", Patch: "metadata:\n  name: other\n"},
+			err:      "must not change the apiVersion, kind, name or namespace",
+		},
+		"missing path": {
+			override: aloystechv2.ChildOverride{Kind: "Deployment", Type: aloystechv2.OverrideJSON6902, Patch: `[{"op": "replace", "path": "/spec/missing/field", "value": 1}]`},
+			err:      "spec.overrides[0] cannot be applied to the Deployment",
+		},
+		"wrong type": {
+			override: aloystechv2.ChildOverride{Kind: "Deployment", Patch: "spec:\n  replicas: many\n"},
+			err:      "spec.overrides[0] cannot be applied to the Deployment",
+		},
+		"host network": {
+			override: aloystechv2.ChildOverride{Kind: "Deployment", Type: aloystechv2.OverrideJSON6902, Patch: `[{"op": "add", "path": "/spec/template/spec/hostNetwork", "value": true}]`},
+			err:      "must not set spec.template.spec.hostNetwork",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			app := overrideApp(tc.override)
+			_, err := BuiltinTemplates().NewDeployment(app)
+			var overrideErr *OverrideError
+			var renderErr *RenderError
+			if !errors.As(err, &overrideErr) || !errors.As(err, &renderErr) || !strings.Contains(err.Error(), tc.err) {
+				t.Fatalf("expected an override error containing %q, got %v", tc.err, err)
+			}
+			if err := BuiltinTemplates().DryRunOverrides(app); !errors.As(err, &overrideErr) {
+				t.Fatalf("expected the dry-run to return the override error, got %v", err)
+			}
+		})
+	}
+}
+
+func TestDryRunOverridesGatewayRoutes(t *testing.T) {
+	app := overrideApp(aloystechv2.ChildOverride{Kind: "HTTPRoute", Patch: "metadata:\n  labels:\n    team: platform\n"})
+	if err := BuiltinTemplates().DryRunOverrides(app); err != nil {
+		t.Fatal(err)
+	}
+	u, err := BuiltinTemplates().NewHTTPRoute(app)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.GetLabels()["team"] != "platform" {
+		t.Fatalf("the merge patch is not applied to the HTTPRoute: %v", u.GetLabels())
+	}
+}
@@ -1,90 +1,277 @@
 package utils
 
 import (
-	"bytes"
+	"encoding/json"
 	"fmt"
+	"strings"
 	"text/template"
 
-	aloystechv1 "aloys.tech/api/v1"
+	aloystechv2 "aloys.tech/api/v2"
 	appv1 "k8s.io/api/apps/v1"
 	autoscalingv2 "k8s.io/api/autoscaling/v2"
+	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
 	netv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/util/yaml"
 )
 
-func parseTemplate(templateName string, app *aloystechv1.App) []byte {
-	tmpl, err := template.ParseFiles("./internal/template/" + templateName + ".yml")
-	if err != nil {
-		panic(err)
+// templateFuncs 复杂的字段直接以 JSON 的形式写进模板，JSON 本身就是合法的 YAML。
+// spec 里的字符串也一律用 toJson 写成带引号的 JSON 字符串，换行、冒号这些字符都会被转义，
+// 用户的输入只能成为一个值，不能插入新的字段，"n"、"yes" 之类的值也不会被 YAML 解析成 bool。
+// metadata 的 name 和 namespace 已经由 apiserver 校验为 DNS 名称，可以直接写进模板
+var templateFuncs = template.FuncMap{
+	"toJson": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return yamlSafe(string(b)), err
+	},
+	// indent 给每一行增加缩进，共用的片段嵌在不同层级的时候使用
+	"indent": func(n int, s string) string {
+		return strings.ReplaceAll(s, "\n", "\n"+strings.Repeat(" ", n))
+	},
+}
+
+// yamlSafe 把 YAML 不允许出现的字符（DEL、C1 控制字符、U+FFFE 等）转义成 \uXXXX，JSON 的其余部分保持不变。
+// 这些字符只可能出现在 JSON 字符串里，YAML 的双引号字符串同样能识别 \uXXXX
+func yamlSafe(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if r == 0x7f || (r >= 0x80 && r <= 0x9f) || r == 0xfeff || r == 0xfffe || r == 0xffff {
+			fmt.Fprintf(&b, "\\u%04x", r)
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// RenderError 模板渲染失败，spec 或者覆盖的模板有问题，不修改它们重试也不会成功
+type RenderError struct {
+	Template string
+	Err      error
+}
+
+func (e *RenderError) Error() string {
+	return fmt.Sprintf("failed to render %s: %v", e.Template, e.Err)
+}
+
+func (e *RenderError) Unwrap() error {
+	return e.Err
+}
+
+// render 用这组模板渲染 <templateName>.yml 并解析到 obj，最后应用 spec.overrides 里针对这种子资源的 patch
+func (s *TemplateSet) render(templateName string, app *aloystechv2.App, obj interface{}) error {
+	b, err := s.execute(templateName, app)
+	if err == nil {
+		err = yaml.Unmarshal(b, obj)
+	}
+	if err == nil && overridable(templateName) {
+		err = applyOverrides(app, templateKinds[templateName].kind, obj)
 	}
-	b := new(bytes.Buffer)
-	err = tmpl.Execute(b, app)
 	if err != nil {
-		panic(err)
+		return &RenderError{Template: templateName + ".yml", Err: err}
 	}
-	return b.Bytes()
+	return nil
 }
 
-func NewDeployment(app *aloystechv1.App) *appv1.Deployment {
-	defer func() {
-		if r := recover(); r != nil {
-			fmt.Printf("recover NewDeployment panic:%v\n", r)
-		}
-	}()
+func (s *TemplateSet) NewDeployment(app *aloystechv2.App) (*appv1.Deployment, error) {
 	d := &appv1.Deployment{}
-	err := yaml.Unmarshal(parseTemplate("deployment", app), d)
+	if err := s.render("deployment", app, d); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// canarySuffix canary 的 pod 使用单独的 app 标签，不会被 stable 的 Service 和 Deployment 选中
+const canarySuffix = "-canary"
+
+// NewCanaryDeployment 和 NewDeployment 使用同一个模板，只是名字和 app 标签换成 canary 的
+func (s *TemplateSet) NewCanaryDeployment(app *aloystechv2.App) (*appv1.Deployment, error) {
+	d, err := s.NewDeployment(app)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	return d
+	d.Name = app.Name + canarySuffix
+	canaryLabels(d.Labels, app)
+	if d.Spec.Selector != nil {
+		canaryLabels(d.Spec.Selector.MatchLabels, app)
+	}
+	canaryLabels(d.Spec.Template.Labels, app)
+	return d, nil
 }
 
-func NewIngress(app *aloystechv1.App) *netv1.Ingress {
-	i := &netv1.Ingress{}
-	err := yaml.Unmarshal(parseTemplate("ingress", app), i)
+// NewCanaryService canary 的 Service 只在集群内部给 Ingress 或 HTTPRoute 分流使用，统一是 ClusterIP
+func (s *TemplateSet) NewCanaryService(app *aloystechv2.App) (*corev1.Service, error) {
+	svc, err := s.NewService(app)
 	if err != nil {
-		panic(err)
-	}
-	return i
-}
-
-func NewService(app *aloystechv1.App) *corev1.Service {
-	s := &corev1.Service{}
-	// switch strings.ToUpper(app.Spec.Service.Type) {
-	// case "NODEPORT":
-	// 	err := yaml.Unmarshal(parseTemplate("service_nodePort", app), s)
-	// 	if err != nil {
-	// 		panic(err)
-	// 	}
-	// 	return s
-	// default:
-	// 	err := yaml.Unmarshal(parseTemplate("service", app), s)
-	// 	if err != nil {
-	// 		panic(err)
-	// 	}
-	// 	return s
-	// }
-
-	if app.Spec.Service.NodePort != 0 {
-		err := yaml.Unmarshal(parseTemplate("service_nodePort", app), s)
-		if err != nil {
-			panic(err)
+		return nil, err
+	}
+	svc.Name = app.Name + canarySuffix + "-svc"
+	canaryLabels(svc.Spec.Selector, app)
+	clusterIPOnly(svc)
+	return svc, nil
+}
+
+// ColorLabel 区分 blue/green 两套 pod，Service 按它选择 active 的那一套
+const ColorLabel = "aloys.tech/color"
+
+// NewColorDeployment 和 NewDeployment 使用同一个模板，名字和选择器加上颜色
+func (s *TemplateSet) NewColorDeployment(app *aloystechv2.App, color string) (*appv1.Deployment, error) {
+	d, err := s.NewDeployment(app)
+	if err != nil {
+		return nil, err
+	}
+	d.Name = app.Name + "-" + color
+	labels := []map[string]string{d.Labels, d.Spec.Template.Labels}
+	if d.Spec.Selector != nil {
+		labels = append(labels, d.Spec.Selector.MatchLabels)
+	}
+	for _, l := range labels {
+		if l != nil {
+			l[ColorLabel] = color
 		}
-		return s
 	}
-	err := yaml.Unmarshal(parseTemplate("service", app), s)
+	return d, nil
+}
+
+// NewPreviewService 选择 preview 颜色的 pod，只在集群内部访问
+func (s *TemplateSet) NewPreviewService(app *aloystechv2.App, color string) (*corev1.Service, error) {
+	svc, err := s.NewService(app)
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+	svc.Name = app.Name + "-preview-svc"
+	if svc.Spec.Selector == nil {
+		svc.Spec.Selector = map[string]string{}
 	}
-	return s
+	svc.Spec.Selector[ColorLabel] = color
+	clusterIPOnly(svc)
+	return svc, nil
 }
 
-func NewHorizontalPodAutoscaler(app *aloystechv1.App) *autoscalingv2.HorizontalPodAutoscaler {
-	h := &autoscalingv2.HorizontalPodAutoscaler{}
-	err := yaml.Unmarshal(parseTemplate("hpa", app), h)
+// clusterIPOnly 去掉只有 NodePort 和 LoadBalancer 才有的字段，headless 也改成普通的 ClusterIP
+func clusterIPOnly(s *corev1.Service) {
+	s.Spec.Type = corev1.ServiceTypeClusterIP
+	s.Spec.ClusterIP = ""
+	s.Spec.ExternalTrafficPolicy = ""
+	for i := range s.Spec.Ports {
+		s.Spec.Ports[i].NodePort = 0
+	}
+}
+
+// NewCanaryIngress 复制 App 的 Ingress，后端换成 canary 的 Service，由 nginx 按 weight 分流
+func (s *TemplateSet) NewCanaryIngress(app *aloystechv2.App, weight int32) (*netv1.Ingress, error) {
+	i, err := s.NewIngress(app)
 	if err != nil {
-		return nil
+		return nil, err
+	}
+	i.Name = app.Name + canarySuffix + "-ingress"
+	if i.Annotations == nil {
+		i.Annotations = map[string]string{}
+	}
+	// 证书由 App 的 Ingress 申请，canary 的 Ingress 不能再申请同一个 secret
+	delete(i.Annotations, "cert-manager.io/issuer")
+	delete(i.Annotations, "cert-manager.io/cluster-issuer")
+	i.Annotations["nginx.ingress.kubernetes.io/canary"] = "true"
+	i.Annotations["nginx.ingress.kubernetes.io/canary-weight"] = fmt.Sprint(weight)
+	for r := range i.Spec.Rules {
+		if i.Spec.Rules[r].HTTP == nil {
+			continue
+		}
+		for p := range i.Spec.Rules[r].HTTP.Paths {
+			if b := i.Spec.Rules[r].HTTP.Paths[p].Backend.Service; b != nil && b.Name == app.Name+"-svc" {
+				b.Name = app.Name + canarySuffix + "-svc"
+			}
+		}
+	}
+	return i, nil
+}
+
+func canaryLabels(labels map[string]string, app *aloystechv2.App) {
+	if labels != nil {
+		labels["app"] = app.Name + canarySuffix
+	}
+}
+
+func (s *TemplateSet) NewStatefulSet(app *aloystechv2.App) (*appv1.StatefulSet, error) {
+	sts := &appv1.StatefulSet{}
+	if err := s.render("statefulset", app, sts); err != nil {
+		return nil, err
+	}
+	return sts, nil
+}
+
+func (s *TemplateSet) NewJob(app *aloystechv2.App) (*batchv1.Job, error) {
+	j := &batchv1.Job{}
+	if err := s.render("job", app, j); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// NewPreDeleteJob 渲染删除 App 之前运行的 hook，spec.preDeleteHook 为空时不要调用
+func (s *TemplateSet) NewPreDeleteJob(app *aloystechv2.App) (*batchv1.Job, error) {
+	j := &batchv1.Job{}
+	if err := s.render("predelete_job", app, j); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+func (s *TemplateSet) NewCronJob(app *aloystechv2.App) (*batchv1.CronJob, error) {
+	c := &batchv1.CronJob{}
+	if err := s.render("cronjob", app, c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (s *TemplateSet) NewHeadlessService(app *aloystechv2.App) (*corev1.Service, error) {
+	svc := &corev1.Service{}
+	if err := s.render("service_headless", app, svc); err != nil {
+		return nil, err
+	}
+	return svc, nil
+}
+
+func (s *TemplateSet) NewIngress(app *aloystechv2.App) (*netv1.Ingress, error) {
+	i := &netv1.Ingress{}
+	if err := s.render("ingress", app, i); err != nil {
+		return nil, err
+	}
+	return i, nil
+}
+
+// NewHTTPRoute Gateway API 的 CRD 不一定安装在集群里，不引入它的 Go 类型，直接渲染成 unstructured
+func (s *TemplateSet) NewHTTPRoute(app *aloystechv2.App) (*unstructured.Unstructured, error) {
+	u := &unstructured.Unstructured{}
+	if err := s.render("httproute", app, u); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+func (s *TemplateSet) NewGRPCRoute(app *aloystechv2.App) (*unstructured.Unstructured, error) {
+	u := &unstructured.Unstructured{}
+	if err := s.render("grpcroute", app, u); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// NewService 根据 spec.service.type 渲染 ClusterIP、NodePort、LoadBalancer 或 headless 的 Service
+func (s *TemplateSet) NewService(app *aloystechv2.App) (*corev1.Service, error) {
+	svc := &corev1.Service{}
+	if err := s.render("service", app, svc); err != nil {
+		return nil, err
+	}
+	return svc, nil
+}
+
+func (s *TemplateSet) NewHorizontalPodAutoscaler(app *aloystechv2.App) (*autoscalingv2.HorizontalPodAutoscaler, error) {
+	h := &autoscalingv2.HorizontalPodAutoscaler{}
+	if err := s.render("hpa", app, h); err != nil {
+		return nil, err
 	}
-	return h
+	return h, nil
 }
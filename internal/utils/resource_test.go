@@ -0,0 +1,200 @@
+package utils
+
+import (
+	"sort"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	aloystechv2 "aloys.tech/api/v2"
+	appv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	netv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// fuzzInput 是 App spec 中会被写进模板的字符串
+type fuzzInput struct {
+	image, portName, configName, mountPath, claimName, host, path, hookImage string
+}
+
+func fuzzApp(in fuzzInput) *aloystechv2.App {
+	return &aloystechv2.App{
+		ObjectMeta: metav1.ObjectMeta{Name: "demo", Namespace: "default"},
+		Spec: aloystechv2.AppSpec{
+			Deployment: aloystechv2.AppDeploymentSpec{
+				Image:      in.image,
+				ConfigMaps: []aloystechv2.ConfigMount{{Name: in.configName, MountPath: in.mountPath}},
+				Secrets:    []aloystechv2.ConfigMount{{Name: in.configName, MountPath: in.mountPath}},
+			},
+			Service: aloystechv2.AppServiceSpec{
+				Ports: []aloystechv2.ServicePort{{Name: in.portName, Port: 80}},
+			},
+			Ingress: aloystechv2.AppIngressSpec{
+				Enabled: true,
+				Rules: []aloystechv2.IngressRule{{
+					Host:  in.host,
+					Paths: []aloystechv2.IngressPath{{Path: in.path, Port: in.portName}},
+				}},
+			},
+			Workload: aloystechv2.AppWorkloadSpec{
+				VolumeClaimTemplates: []aloystechv2.VolumeClaimTemplate{{Name: in.claimName, MountPath: in.mountPath}},
+			},
+			PreDeleteHook: &aloystechv2.PreDeleteHook{Image: in.hookImage},
+		},
+	}
+}
+
+func renderAll(t testing.TB, in fuzzInput) map[string]runtime.Object {
+	app := fuzzApp(in)
+	rendered := map[string]runtime.Object{}
+	for kind, render := range map[string]func(*aloystechv2.App) (runtime.Object, error){
+		"Deployment":  func(app *aloystechv2.App) (runtime.Object, error) { return BuiltinTemplates().NewDeployment(app) },
+		"StatefulSet": func(app *aloystechv2.App) (runtime.Object, error) { return BuiltinTemplates().NewStatefulSet(app) },
+		"Service":     func(app *aloystechv2.App) (runtime.Object, error) { return BuiltinTemplates().NewService(app) },
+		"Ingress":     func(app *aloystechv2.App) (runtime.Object, error) { return BuiltinTemplates().NewIngress(app) },
+		"PreDelete":   func(app *aloystechv2.App) (runtime.Object, error) { return BuiltinTemplates().NewPreDeleteJob(app) },
+	} {
+		obj, err := render(app)
+		if err != nil {
+			t.Fatalf("failed to render the %s: %v", kind, err)
+		}
+		rendered[kind] = obj
+	}
+	return rendered
+}
+
+// fieldPaths 返回对象中出现的所有字段路径，列表的下标统一写成 []
+func fieldPaths(t testing.TB, obj runtime.Object) map[string]bool {
+	u, err := runtime.DefaultUnstructuredConverter.ToUnstructured(obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	paths := map[string]bool{}
+	var walk func(prefix string, v interface{})
+	walk = func(prefix string, v interface{}) {
+		switch v := v.(type) {
+		case map[string]interface{}:
+			for k, child := range v {
+				// labels 和 annotations 的 key 本身就是数据
+				if strings.HasSuffix(prefix, ".labels") || strings.HasSuffix(prefix, ".annotations") {
+					k = "*"
+				}
+				paths[prefix+"."+k] = true
+				walk(prefix+"."+k, child)
+			}
+		case []interface{}:
+			for _, child := range v {
+				walk(prefix+"[]", child)
+			}
+		}
+	}
+	walk("", u)
+	return paths
+}
+
+// FuzzRenderNoInjection 任意字符串都只能成为字段的值：渲染结果里的字段不能超出正常输入渲染出来的字段，
+// 字符串的内容也必须原样出现在对应的字段里
+func FuzzRenderNoInjection(f *testing.F) {
+	// 空字符串会走模板里的默认值分支，和正常输入一起作为允许的字段
+	allowed := map[string]map[string]bool{}
+	for _, in := range []fuzzInput{
+		{"nginx:1.25", "http", "config", "/etc/config", "data", "example.com", "/api", "busybox"},
+		{},
+	} {
+		for kind, obj := range renderAll(f, in) {
+			if allowed[kind] == nil {
+				allowed[kind] = map[string]bool{}
+			}
+			for p := range fieldPaths(f, obj) {
+				allowed[kind][p] = true
+			}
+		}
+	}
+
+	f.Add("nginx:1.25", "http", "config", "/etc/config", "data", "example.com", "/api", "busybox")
+	f.Add("n", "yes", "on", "null", "~", "1e3", "0x10", "true")
+	f.Add("nginx\n          securityContext:\n            privileged: true", "http", "config", "/etc/config", "data", "example.com", "/", "busybox")
+	f.Add("nginx", "http", "config\n      hostPath:\n        path: /", "/etc\n      hostNetwork: true", "data", "example.com", "/", "busybox")
+	f.Add("nginx", "http\"}, {\"name\": \"x", "config", "/etc/config", "data\n      spec: {}", "a.com\n    - host: b.com", "/\n  extra: {}", "busybox'")
+	f.Add("{{ .Spec }}", "#", "&anchor", "*alias", "!!binary", "- item", "? key", ": value")
+	f.Add("\x7f\u0085\ufeff", "\t", "\r\n", "\\", "\"", "'", "%", " ")
+
+	f.Fuzz(func(t *testing.T, image, portName, configName, mountPath, claimName, host, path, hookImage string) {
+		in := fuzzInput{image, portName, configName, mountPath, claimName, host, path, hookImage}
+		rendered := renderAll(t, in)
+		for kind, obj := range rendered {
+			var extra []string
+			for p := range fieldPaths(t, obj) {
+				if !allowed[kind][p] {
+					extra = append(extra, p)
+				}
+			}
+			if len(extra) > 0 {
+				sort.Strings(extra)
+				t.Fatalf("the %s has fields outside the allowed set: %v", kind, extra)
+			}
+		}
+
+		// json.Marshal 会把非法的 UTF-8 替换成 U+FFFD，只有合法的字符串才能原样比较
+		for _, s := range []string{image, portName, configName, mountPath, claimName, host, path, hookImage} {
+			if !utf8.ValidString(s) {
+				return
+			}
+		}
+		pod := rendered["Deployment"].(*appv1.Deployment).Spec.Template.Spec
+		sts := rendered["StatefulSet"].(*appv1.StatefulSet)
+		svc := rendered["Service"].(*corev1.Service)
+		rule := rendered["Ingress"].(*netv1.Ingress).Spec.Rules[0]
+		hook := rendered["PreDelete"].(*batchv1.Job).Spec.Template.Spec.Containers[0]
+		if hookImage == "" {
+			hookImage = image
+		}
+		if path == "" {
+			path = "/"
+		}
+		for field, got := range map[string][2]string{
+			"image":                 {pod.Containers[0].Image, image},
+			"container port name":   {pod.Containers[0].Ports[0].Name, portName},
+			"service port name":     {svc.Spec.Ports[0].Name, portName},
+			"configMap name":        {pod.Volumes[0].ConfigMap.Name, configName},
+			"secret name":           {pod.Volumes[1].Secret.SecretName, configName},
+			"mount path":            {pod.Containers[0].VolumeMounts[0].MountPath, mountPath},
+			"claim name":            {sts.Spec.VolumeClaimTemplates[0].Name, claimName},
+			"ingress host":          {rule.Host, host},
+			"ingress path":          {rule.HTTP.Paths[0].Path, path},
+			"pre-delete hook image": {hook.Image, hookImage},
+		} {
+			if got[0] != got[1] {
+				t.Fatalf("the %s is rendered as %q, want %q", field, got[0], got[1])
+			}
+		}
+	})
+}
+
+func TestRenderSchedulingFields(t *testing.T) {
+	app := fuzzApp(fuzzInput{image: "nginx", portName: "http", configName: "config", mountPath: "/etc/config", claimName: "data"})
+	app.Spec.Deployment.NodeSelector = map[string]string{"disktype": "ssd"}
+	app.Spec.Deployment.Tolerations = []corev1.Toleration{{Key: "dedicated", Operator: corev1.TolerationOpExists}}
+	app.Spec.Deployment.Affinity = &corev1.Affinity{PodAntiAffinity: &corev1.PodAntiAffinity{}}
+	app.Spec.Deployment.PriorityClassName = "high"
+	app.Spec.Deployment.TopologySpreadConstraints = []corev1.TopologySpreadConstraint{{
+		MaxSkew: 1, TopologyKey: corev1.LabelTopologyZone, WhenUnsatisfiable: corev1.DoNotSchedule,
+	}}
+	d, err := BuiltinTemplates().NewDeployment(app)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sts, err := BuiltinTemplates().NewStatefulSet(app)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for kind, pod := range map[string]corev1.PodSpec{"Deployment": d.Spec.Template.Spec, "StatefulSet": sts.Spec.Template.Spec} {
+		if pod.NodeSelector["disktype"] != "ssd" || len(pod.Tolerations) != 1 || pod.Affinity == nil || pod.Affinity.PodAntiAffinity == nil ||
+			pod.PriorityClassName != "high" || len(pod.TopologySpreadConstraints) != 1 || pod.TopologySpreadConstraints[0].TopologyKey != corev1.LabelTopologyZone {
+			t.Fatalf("the scheduling fields are not rendered into the %s pod: %+v", kind, pod)
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	"io/fs"
+	"sort"
+	"strings"
+	"text/template"
+
+	aloystechv2 "aloys.tech/api/v2"
+	templates "aloys.tech/internal/template"
+	appv1 "k8s.io/api/apps/v1"
+	autoscalingv2 "k8s.io/api/autoscaling/v2"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	netv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// BuiltinTemplateVersion 是内置模板的版本，覆盖过的模板在它后面追加覆盖来源的版本
+const BuiltinTemplateVersion = "builtin"
+
+// TemplateSet 一组渲染子资源的模板，内置模板之上可以叠加 ConfigMap 里覆盖的文件
+type TemplateSet struct {
+	files map[string]string
+	// Version 标识这组模板，记录在 App 的 status.templateVersion 上
+	Version string
+	// Source 记录生成这组模板的 ConfigMap 版本，没有变化的时候不需要重新校验
+	Source string
+}
+
+var builtinTemplates = loadBuiltinTemplates()
+
+func loadBuiltinTemplates() *TemplateSet {
+	entries, err := fs.ReadDir(templates.FS, ".")
+	if err != nil {
+		panic(err)
+	}
+	files := map[string]string{}
+	for _, e := range entries {
+		b, err := fs.ReadFile(templates.FS, e.Name())
+		if err != nil {
+			panic(err)
+		}
+		files[e.Name()] = string(b)
+	}
+	return &TemplateSet{files: files, Version: BuiltinTemplateVersion}
+}
+
+// BuiltinTemplates 返回编译进二进制的内置模板
+func BuiltinTemplates() *TemplateSet {
+	return builtinTemplates
+}
+
+// Names 返回这组模板的文件名，已排序
+func (s *TemplateSet) Names() []string {
+	names := make([]string, 0, len(s.files))
+	for name := range s.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// WithSource 返回同一组模板，只把 Source 换成 source。
+// 覆盖的模板校验失败时用它记下失败的来源，继续使用原来的模板，ConfigMap 修改之前不再重复校验
+func (s *TemplateSet) WithSource(source string) *TemplateSet {
+	set := *s
+	set.Source = source
+	return &set
+}
+
+// Override 返回用 files 覆盖之后的一组模板，files 的 key 是模板的文件名，只能覆盖已有的模板。
+// 覆盖之后的每个模板都要能渲染出对应类型的合法对象，否则返回错误，原来的模板不受影响
+func (s *TemplateSet) Override(files map[string]string, version string) (*TemplateSet, error) {
+	merged := make(map[string]string, len(s.files))
+	for name, content := range s.files {
+		merged[name] = content
+	}
+	for name, content := range files {
+		if _, ok := s.files[name]; !ok {
+			return nil, fmt.Errorf("unknown template %s, the templates are %s", name, strings.Join(s.Names(), ", "))
+		}
+		merged[name] = content
+	}
+	set := &TemplateSet{files: merged, Version: s.Version + "+" + version}
+	if err := set.validate(); err != nil {
+		return nil, err
+	}
+	return set, nil
+}
+
+// execute 渲染 <name>.yml，pod.yml 里是各个工作负载共用的 pod template
+func (s *TemplateSet) execute(name string, app *aloystechv2.App) ([]byte, error) {
+	tmpl := template.New(name + ".yml").Funcs(templateFuncs)
+	// include 和 template 一样渲染共用的片段，但是结果可以继续交给 indent 处理
+	tmpl.Funcs(template.FuncMap{
+		"include": func(name string, data interface{}) (string, error) {
+			b := new(bytes.Buffer)
+			err := tmpl.ExecuteTemplate(b, name, data)
+			return b.String(), err
+		},
+	})
+	if _, err := tmpl.Parse(s.files[name+".yml"]); err != nil {
+		return nil, err
+	}
+	if _, err := tmpl.New("pod.yml").Parse(s.files["pod.yml"]); err != nil {
+		return nil, err
+	}
+	b := new(bytes.Buffer)
+	if err := tmpl.Execute(b, app); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// templateKinds 每个模板必须渲染出的对象，pod.yml 只是共用的片段，通过工作负载的模板一起校验。
+// Gateway API 的路由没有 Go 类型，只检查 kind
+var templateKinds = map[string]struct {
+	kind string
+	obj  func() interface{}
+}{
+	"deployment":       {"Deployment", func() interface{} { return &appv1.Deployment{} }},
+	"statefulset":      {"StatefulSet", func() interface{} { return &appv1.StatefulSet{} }},
+	"job":              {"Job", func() interface{} { return &batchv1.Job{} }},
+	"predelete_job":    {"Job", func() interface{} { return &batchv1.Job{} }},
+	"cronjob":          {"CronJob", func() interface{} { return &batchv1.CronJob{} }},
+	"service":          {"Service", func() interface{} { return &corev1.Service{} }},
+	"service_headless": {"Service", func() interface{} { return &corev1.Service{} }},
+	"ingress":          {"Ingress", func() interface{} { return &netv1.Ingress{} }},
+	"hpa":              {"HorizontalPodAutoscaler", func() interface{} { return &autoscalingv2.HorizontalPodAutoscaler{} }},
+	"httproute":        {"HTTPRoute", nil},
+	"grpcroute":        {"GRPCRoute", nil},
+}
+
+// validate 用几个有代表性的 App 渲染每个模板，结果必须是对应 kind 的对象，并且不能有未知的字段
+func (s *TemplateSet) validate() error {
+	for _, app := range validationApps() {
+		for name, want := range templateKinds {
+			b, err := s.execute(name, app)
+			if err != nil {
+				return fmt.Errorf("failed to render %s.yml: %w", name, err)
+			}
+			meta := &metav1.TypeMeta{}
+			if err := yaml.Unmarshal(b, meta); err != nil {
+				return fmt.Errorf("%s.yml does not render valid YAML: %w", name, err)
+			}
+			if meta.Kind != want.kind {
+				return fmt.Errorf("%s.yml must render kind %s, got %q", name, want.kind, meta.Kind)
+			}
+			if want.obj == nil {
+				continue
+			}
+			if err := yaml.UnmarshalStrict(b, want.obj()); err != nil {
+				return fmt.Errorf("%s.yml does not render a valid %s: %w", name, want.kind, err)
+			}
+		}
+	}
+	return nil
+}
+
+// validationApps 校验模板时使用的 App，尽量覆盖模板里的各个分支
+func validationApps() []*aloystechv2.App {
+	replicas := int32(2)
+	deployment := &aloystechv2.App{
+		ObjectMeta: metav1.ObjectMeta{Name: "validate", Namespace: "default"},
+		Spec: aloystechv2.AppSpec{
+			Deployment: aloystechv2.AppDeploymentSpec{
+				Image:             "nginx:1.25",
+				Replicas:          &replicas,
+				Env:               []corev1.EnvVar{{Name: "LEVEL", Value: "info"}},
+				ConfigMaps:        []aloystechv2.ConfigMount{{Name: "config", MountPath: "/etc/config"}},
+				Secrets:           []aloystechv2.ConfigMount{{Name: "secret", MountPath: "/etc/secret"}},
+				NodeSelector:      map[string]string{"disktype": "ssd"},
+				Tolerations:       []corev1.Toleration{{Key: "dedicated", Operator: corev1.TolerationOpExists}},
+				Affinity:          &corev1.Affinity{NodeAffinity: &corev1.NodeAffinity{}},
+				PriorityClassName: "high",
+				TopologySpreadConstraints: []corev1.TopologySpreadConstraint{{
+					MaxSkew: 1, TopologyKey: corev1.LabelHostname, WhenUnsatisfiable: corev1.ScheduleAnyway,
+				}},
+			},
+			Service: aloystechv2.AppServiceSpec{
+				Ports: []aloystechv2.ServicePort{{Name: "http", Port: 80, TargetPort: 8080}, {Name: "grpc", Port: 9090}},
+			},
+			Ingress: aloystechv2.AppIngressSpec{Enabled: true, Host: "example.com"},
+			Exposure: aloystechv2.AppExposureSpec{Gateway: &aloystechv2.AppGatewaySpec{
+				ParentRefs: []aloystechv2.GatewayParentRef{{Name: "gateway"}},
+				Hostnames:  []string{"example.com"},
+				GRPCRules:  []aloystechv2.GRPCRouteRule{{Method: &aloystechv2.GRPCMethodMatch{Service: "demo.Demo"}}},
+			}},
+			PreDeleteHook: &aloystechv2.PreDeleteHook{Command: []string{"/bin/sh", "-c", "exit 0"}},
+		},
+	}
+	statefulSet := deployment.DeepCopy()
+	statefulSet.Spec.Workload = aloystechv2.AppWorkloadSpec{
+		Kind:                 aloystechv2.WorkloadStatefulSet,
+		VolumeClaimTemplates: []aloystechv2.VolumeClaimTemplate{{Name: "data", MountPath: "/data"}},
+	}
+	cronJob := deployment.DeepCopy()
+	cronJob.Spec.Workload = aloystechv2.AppWorkloadSpec{Kind: aloystechv2.WorkloadCronJob, Schedule: "0 2 * * *"}
+	return []*aloystechv2.App{deployment, statefulSet, cronJob}
+}
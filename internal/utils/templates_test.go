@@ -0,0 +1,105 @@
+package utils
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	aloystechv2 "aloys.tech/api/v2"
+	appv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestBuiltinTemplatesAreValid(t *testing.T) {
+	if err := BuiltinTemplates().validate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTemplateOverride(t *testing.T) {
+	deployment := strings.Replace(BuiltinTemplates().files["deployment.yml"], "  labels:\n", "  labels:\n    team: platform\n", 1)
+	set, err := BuiltinTemplates().Override(map[string]string{"deployment.yml": deployment}, "cluster:v2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if set.Version != "builtin+cluster:v2" {
+		t.Fatalf("unexpected version %q", set.Version)
+	}
+
+	app := &aloystechv2.App{
+		ObjectMeta: metav1.ObjectMeta{Name: "demo", Namespace: "team-a"},
+		Spec:       aloystechv2.AppSpec{Deployment: aloystechv2.AppDeploymentSpec{Image: "nginx"}},
+	}
+	if got := mustRenderDeployment(t, set, app).Labels["team"]; got != "platform" {
+		t.Fatalf("the override is not used, team label %q", got)
+	}
+	if got := mustRenderDeployment(t, BuiltinTemplates(), app).Labels["team"]; got != "" {
+		t.Fatalf("the override leaks into the builtin templates, team label %q", got)
+	}
+}
+
+func TestTemplateOverrideRejectsInvalidTemplates(t *testing.T) {
+	for name, tc := range map[string]struct {
+		files map[string]string
+		err   string
+	}{
+		"unknown file": {
+			files: map[string]string{"daemonset.yml": "kind: DaemonSet"},
+			err:   "unknown template daemonset.yml",
+		},
+		"parse error": {
+			files: map[string]string{"service.yml": "kind: Service\nmetadata:\n  name: {{ .ObjectMeta.Name"},
+			err:   "failed to render service.yml",
+		},
+		"wrong kind": {
+			files: map[string]string{"ingress.yml": "apiVersion: v1\nkind: Service\n"},
+			err:   "ingress.yml must render kind Ingress",
+		},
+		"unknown field": {
+			files: map[string]string{"hpa.yml": "apiVersion: autoscaling/v2\nkind: HorizontalPodAutoscaler\nspec:\n  replicas: 3\n"},
+			err:   "hpa.yml does not render a valid HorizontalPodAutoscaler",
+		},
+		"broken pod template": {
+			files: map[string]string{"pod.yml": `{{ define "pod" }}  template: [{{ end }}`},
+			err:   "does not render valid YAML",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := BuiltinTemplates().Override(tc.files, "test")
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Fatalf("expected an error containing %q, got %v", tc.err, err)
+			}
+		})
+	}
+}
+
+func mustRenderDeployment(t *testing.T, set *TemplateSet, app *aloystechv2.App) *appv1.Deployment {
+	t.Helper()
+	d, err := set.NewDeployment(app)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func TestRenderReturnsRenderError(t *testing.T) {
+	// 校验用的 App 都有端口，只有没有端口的 App 渲染时才会失败
+	service := strings.Replace(BuiltinTemplates().files["service.yml"], "spec:\n", "spec:\n  clusterIP: {{ (index .Spec.Service.Ports 0).Name | toJson }}\n", 1)
+	set, err := BuiltinTemplates().Override(map[string]string{"service.yml": service}, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app := &aloystechv2.App{ObjectMeta: metav1.ObjectMeta{Name: "demo", Namespace: "team-a"}}
+	svc, err := set.NewService(app)
+	var renderErr *RenderError
+	if !errors.As(err, &renderErr) || renderErr.Template != "service.yml" {
+		t.Fatalf("expected a RenderError for service.yml, got %v", err)
+	}
+	if svc != nil {
+		t.Fatalf("expected no Service when rendering fails, got %v", svc)
+	}
+	if _, err := set.NewCanaryService(app); !errors.As(err, &renderErr) {
+		t.Fatalf("expected the canary Service to return the RenderError, got %v", err)
+	}
+}